@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit events
+const (
+	EventIssued   = "issued"
+	EventRejected = "rejected"
+	EventRevoked  = "revoked"
+)
+
+// AuditEntry is a single line of the audit log
+type AuditEntry struct {
+	Time         time.Time `json:"time"`
+	Event        string    `json:"event"`
+	Remote       string    `json:"remote"`
+	Token        string    `json:"token,omitempty"`
+	CommonName   string    `json:"common_name,omitempty"`
+	AltNames     []string  `json:"alt_names,omitempty"`
+	TTL          string    `json:"ttl,omitempty"`
+	SerialNumber string    `json:"serial_number,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+}
+
+// AuditLog appends one JSON entry per line for every issued, rejected and revoked certificate
+type AuditLog struct {
+	mtx  sync.Mutex
+	file *os.File
+}
+
+// OpenAuditLog opens the audit log at path for appending
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuditLog{file: file}, nil
+}
+
+// Record writes entry. Failures are logged, they never fail a request
+func (a *AuditLog) Record(entry AuditEntry) {
+	entry.Time = time.Now().UTC()
+	bts, err := json.Marshal(&entry)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if _, err := a.file.Write(append(bts, '\n')); err != nil {
+		log.Printf("Could Not Write Audit Log: %s\n", err)
+	}
+}
+
+// remoteAddr returns the host of the request's remote address
+func remoteAddr(remote string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return remote
+	}
+
+	return host
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"time"
+)
+
+// DefaultTTL is used when a request does not ask for a lifetime
+const DefaultTTL = 24 * time.Hour
+
+// Errors
+var (
+	ErrInvalidCSR    = errors.New("Invalid Certificate Signing Request")
+	ErrInvalidTTL    = errors.New("Invalid TTL")
+	ErrUnknownSerial = errors.New("Unknown Serial Number")
+	ErrUpstream      = errors.New("Certificate Authority Unavailable")
+)
+
+// CertificateAuthority signs certificate requests of snfs nodes.
+// Nodes keep their private keys and only send a CSR
+type CertificateAuthority interface {
+	Sign(req SigningRequest) (*Certificate, error)
+	// Revoke revokes the certificate with serial
+	Revoke(serial string) error
+	// Revoked lists the serial numbers of revoked certificates that have not expired
+	Revoked() ([]string, error)
+}
+
+// SigningRequest asks for a certificate for CommonName and AltNames with the key of CSR
+type SigningRequest struct {
+	CommonName string
+	AltNames   []string
+	TTL        time.Duration
+	CSR        []byte // PEM encoded
+}
+
+// Certificate is an issued certificate. All certificates are PEM encoded
+type Certificate struct {
+	Certificate  string   `json:"certificate"`
+	IssuingCA    string   `json:"issuing_ca"`
+	CAChain      []string `json:"ca_chain"`
+	SerialNumber string   `json:"serial_number"`
+}
+
+// parseCSR decodes a PEM encoded CSR and checks its signature
+func parseCSR(bts []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(bts)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, ErrInvalidCSR
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, ErrInvalidCSR
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, ErrInvalidCSR
+	}
+
+	return csr, nil
+}
+
+func encodeCertificate(der []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
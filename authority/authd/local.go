@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const rootTTL = 10 * 365 * 24 * time.Hour
+const intermediateTTL = 5 * 365 * 24 * time.Hour
+
+// Files of a local CA directory
+const (
+	rootCertFile         = "root.pem"
+	rootKeyFile          = "root.key"
+	intermediateCertFile = "intermediate.pem"
+	intermediateKeyFile  = "intermediate.key"
+	serialsFile          = "serials.json"
+)
+
+// IssuedCertificate records a certificate issued by the local CA
+type IssuedCertificate struct {
+	SerialNumber string     `json:"serial_number"`
+	CommonName   string     `json:"common_name"`
+	AltNames     []string   `json:"alt_names"`
+	NotAfter     time.Time  `json:"not_after"`
+	IssuedAt     time.Time  `json:"issued_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+}
+
+// LocalCA is a self contained certificate authority. On first start it generates a root
+// and an intermediate CA in dir. Node certificates are signed by the intermediate
+// and every issued serial number is recorded in dir/serials.json
+type LocalCA struct {
+	dir          string
+	mtx          sync.Mutex
+	root         *x509.Certificate
+	intermediate *x509.Certificate
+	key          crypto.Signer
+	issued       map[string]IssuedCertificate
+}
+
+// NewLocalCA loads the CA in dir, generating it if it does not exist yet.
+// commonName names the generated root
+func NewLocalCA(dir, commonName string) (*LocalCA, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	ca := &LocalCA{
+		dir:    dir,
+		issued: make(map[string]IssuedCertificate),
+	}
+
+	rootKey, root, err := ca.loadOrCreate(rootKeyFile, rootCertFile, func(key crypto.Signer) (*x509.Certificate, error) {
+		return ca.createCA(commonName+" Root Authority", rootTTL, key, nil, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	key, intermediate, err := ca.loadOrCreate(intermediateKeyFile, intermediateCertFile, func(key crypto.Signer) (*x509.Certificate, error) {
+		return ca.createCA(commonName+" Intermediate Authority", intermediateTTL, key, root, rootKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ca.root = root
+	ca.intermediate = intermediate
+	ca.key = key
+
+	if err := ca.loadSerials(); err != nil {
+		return nil, err
+	}
+
+	return ca, nil
+}
+
+func (ca *LocalCA) Sign(req SigningRequest) (*Certificate, error) {
+	csr, err := parseCSR(req.CSR)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := req.TTL
+	if ttl <= 0 {
+		return nil, ErrInvalidTTL
+	}
+
+	ca.mtx.Lock()
+	defer ca.mtx.Unlock()
+
+	serial, err := ca.newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	notAfter := now.Add(ttl)
+	if notAfter.After(ca.intermediate.NotAfter) {
+		notAfter = ca.intermediate.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: req.CommonName},
+		DNSNames:     append([]string{req.CommonName}, req.AltNames...),
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.intermediate, csr.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+
+	record := IssuedCertificate{
+		SerialNumber: formatSerial(serial),
+		CommonName:   req.CommonName,
+		AltNames:     req.AltNames,
+		NotAfter:     notAfter,
+		IssuedAt:     now,
+	}
+	ca.issued[record.SerialNumber] = record
+	if err := ca.saveSerials(); err != nil {
+		delete(ca.issued, record.SerialNumber)
+		return nil, err
+	}
+
+	intermediate := encodeCertificate(ca.intermediate.Raw)
+	return &Certificate{
+		Certificate:  encodeCertificate(der),
+		IssuingCA:    intermediate,
+		CAChain:      []string{intermediate, encodeCertificate(ca.root.Raw)},
+		SerialNumber: record.SerialNumber,
+	}, nil
+}
+
+func (ca *LocalCA) Revoke(serial string) error {
+	ca.mtx.Lock()
+	defer ca.mtx.Unlock()
+
+	record, ok := ca.issued[serial]
+	if !ok {
+		return ErrUnknownSerial
+	}
+
+	if record.RevokedAt != nil {
+		return nil
+	}
+
+	now := time.Now()
+	record.RevokedAt = &now
+	ca.issued[serial] = record
+	if err := ca.saveSerials(); err != nil {
+		record.RevokedAt = nil
+		ca.issued[serial] = record
+		return err
+	}
+
+	return nil
+}
+
+func (ca *LocalCA) Revoked() ([]string, error) {
+	ca.mtx.Lock()
+	defer ca.mtx.Unlock()
+
+	now := time.Now()
+	serials := make([]string, 0)
+	for serial, record := range ca.issued {
+		if record.RevokedAt != nil && record.NotAfter.After(now) {
+			serials = append(serials, serial)
+		}
+	}
+
+	return serials, nil
+}
+
+// Issued returns the certificate issued with serial
+func (ca *LocalCA) Issued(serial string) (IssuedCertificate, bool) {
+	ca.mtx.Lock()
+	defer ca.mtx.Unlock()
+
+	record, ok := ca.issued[serial]
+	return record, ok
+}
+
+func (ca *LocalCA) createCA(commonName string, ttl time.Duration, key crypto.Signer, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(ttl),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	if parent == nil {
+		// self signed root
+		parent = template
+		parentKey = key
+	} else if template.NotAfter.After(parent.NotAfter) {
+		template.NotAfter = parent.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// loadOrCreate reads a key pair from dir or generates a new key and certificate with create
+func (ca *LocalCA) loadOrCreate(keyFile, certFile string, create func(crypto.Signer) (*x509.Certificate, error)) (crypto.Signer, *x509.Certificate, error) {
+	keyPath := filepath.Join(ca.dir, keyFile)
+	certPath := filepath.Join(ca.dir, certFile)
+
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		cert, err := create(key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return nil, nil, err
+		}
+
+		if err := ioutil.WriteFile(certPath, []byte(encodeCertificate(cert.Raw)), 0644); err != nil {
+			return nil, nil, err
+		}
+
+		return key, cert, nil
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	certBlock, _ := pem.Decode(certPEM)
+	if keyBlock == nil || certBlock == nil {
+		return nil, nil, fmt.Errorf("Invalid CA Files %s, %s", keyPath, certPath)
+	}
+
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, cert, nil
+}
+
+func (ca *LocalCA) loadSerials() error {
+	bts, err := ioutil.ReadFile(filepath.Join(ca.dir, serialsFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var records []IssuedCertificate
+	if err := json.Unmarshal(bts, &records); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		ca.issued[record.SerialNumber] = record
+	}
+
+	return nil
+}
+
+// saveSerials writes the serial index. Callers hold ca.mtx
+func (ca *LocalCA) saveSerials() error {
+	records := make([]IssuedCertificate, 0, len(ca.issued))
+	for _, record := range ca.issued {
+		records = append(records, record)
+	}
+
+	bts, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(ca.dir, serialsFile+".tmp")
+	if err := ioutil.WriteFile(tmp, bts, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(ca.dir, serialsFile))
+}
+
+// newSerial returns a random serial number that was not issued before. Callers hold ca.mtx
+func (ca *LocalCA) newSerial() (*big.Int, error) {
+	for i := 0; i < 8; i++ {
+		serial, err := randomSerial()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := ca.issued[formatSerial(serial)]; !ok {
+			return serial, nil
+		}
+	}
+
+	return nil, errors.New("Could Not Allocate Serial Number")
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// formatSerial formats serial as colon separated hex like Vault does
+func formatSerial(serial *big.Int) string {
+	bts := serial.Bytes()
+	out := make([]byte, 0, len(bts)*3)
+	for i, b := range bts {
+		if i > 0 {
+			out = append(out, ':')
+		}
+		out = append(out, fmt.Sprintf("%02x", b)...)
+	}
+
+	return string(out)
+}
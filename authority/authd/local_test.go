@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newCSR returns a PEM encoded CSR for commonName and dnsNames along with its key
+func newCSR(t *testing.T, commonName string, dnsNames ...string) ([]byte, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: commonName},
+		DNSNames: dnsNames,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), key
+}
+
+func newLocalCA(t *testing.T, dir string) *LocalCA {
+	t.Helper()
+
+	ca, err := NewLocalCA(dir, "snfs test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ca
+}
+
+func parseCertificate(t *testing.T, raw string) *x509.Certificate {
+	t.Helper()
+
+	block, _ := pem.Decode([]byte(raw))
+	if block == nil {
+		t.Fatalf("no PEM block in %q", raw)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestLocalCASignUsesRequestNames(t *testing.T) {
+	ca := newLocalCA(t, t.TempDir())
+
+	// the CSR asks for names the policy never checked
+	csr, key := newCSR(t, "authd.example.com", "authd.example.com", "other.node.snfs")
+	issued, err := ca.Sign(SigningRequest{
+		CommonName: "abcd.node.snfs",
+		AltNames:   []string{"abcd.node.snfs.local"},
+		TTL:        time.Hour,
+		CSR:        csr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := parseCertificate(t, issued.Certificate)
+	if cert.Subject.CommonName != "abcd.node.snfs" {
+		t.Errorf("common name = %q, want abcd.node.snfs", cert.Subject.CommonName)
+	}
+
+	if want := []string{"abcd.node.snfs", "abcd.node.snfs.local"}; !reflect.DeepEqual(cert.DNSNames, want) {
+		t.Errorf("dns names = %v, want %v", cert.DNSNames, want)
+	}
+
+	if !reflect.DeepEqual(cert.PublicKey, key.Public()) {
+		t.Error("certificate is not issued for the key of the CSR")
+	}
+
+	if remaining := time.Until(cert.NotAfter); remaining > time.Hour || remaining < 59*time.Minute {
+		t.Errorf("certificate expires in %s, want 1h", remaining)
+	}
+
+	if issued.SerialNumber != formatSerial(cert.SerialNumber) {
+		t.Errorf("serial number = %s, certificate has %s", issued.SerialNumber, formatSerial(cert.SerialNumber))
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(parseCertificate(t, issued.CAChain[len(issued.CAChain)-1]))
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(parseCertificate(t, issued.IssuingCA))
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		DNSName:       "abcd.node.snfs",
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		t.Errorf("certificate does not chain to the root: %s", err)
+	}
+}
+
+func TestLocalCAPersistsSerials(t *testing.T) {
+	dir := t.TempDir()
+	ca := newLocalCA(t, dir)
+
+	csr, _ := newCSR(t, "node")
+	first, err := ca.Sign(SigningRequest{CommonName: "a.node.snfs", TTL: time.Hour, CSR: csr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := ca.Sign(SigningRequest{CommonName: "b.node.snfs", AltNames: []string{"b"}, TTL: time.Hour, CSR: csr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.SerialNumber == second.SerialNumber {
+		t.Fatalf("serial number %s was issued twice", first.SerialNumber)
+	}
+
+	if err := ca.Revoke(first.SerialNumber); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, serialsFile)); err != nil {
+		t.Fatalf("serial index was not written: %s", err)
+	}
+
+	rootPEM, err := ioutil.ReadFile(filepath.Join(dir, rootCertFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted authd keeps its CA and the serials it issued
+	reloaded := newLocalCA(t, dir)
+	if !reloaded.root.Equal(ca.root) || !reloaded.intermediate.Equal(ca.intermediate) {
+		t.Error("CA was regenerated on reload")
+	}
+
+	if after, _ := ioutil.ReadFile(filepath.Join(dir, rootCertFile)); string(after) != string(rootPEM) {
+		t.Error("root certificate was rewritten on reload")
+	}
+
+	record, ok := reloaded.Issued(second.SerialNumber)
+	if !ok {
+		t.Fatalf("serial %s was lost on reload", second.SerialNumber)
+	}
+
+	if record.CommonName != "b.node.snfs" || !reflect.DeepEqual(record.AltNames, []string{"b"}) || record.RevokedAt != nil {
+		t.Errorf("reloaded record = %+v", record)
+	}
+
+	revoked, err := reloaded.Revoked()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(revoked, []string{first.SerialNumber}) {
+		t.Errorf("revoked = %v, want [%s]", revoked, first.SerialNumber)
+	}
+}
+
+func TestLocalCARevokeIsIdempotent(t *testing.T) {
+	ca := newLocalCA(t, t.TempDir())
+
+	csr, _ := newCSR(t, "node")
+	issued, err := ca.Sign(SigningRequest{CommonName: "a.node.snfs", TTL: time.Hour, CSR: csr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ca.Revoke(issued.SerialNumber); err != nil {
+		t.Fatal(err)
+	}
+
+	record, _ := ca.Issued(issued.SerialNumber)
+	revokedAt := *record.RevokedAt
+
+	if err := ca.Revoke(issued.SerialNumber); err != nil {
+		t.Fatal(err)
+	}
+
+	if record, _ := ca.Issued(issued.SerialNumber); !record.RevokedAt.Equal(revokedAt) {
+		t.Errorf("revoking again moved the revocation from %s to %s", revokedAt, record.RevokedAt)
+	}
+}
+
+func TestLocalCASignRejects(t *testing.T) {
+	ca := newLocalCA(t, t.TempDir())
+
+	csr, _ := newCSR(t, "node")
+	block, _ := pem.Decode(csr)
+
+	tampered := append([]byte{}, block.Bytes...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	cases := []struct {
+		name string
+		req  SigningRequest
+		err  error
+	}{
+		{"no CSR", SigningRequest{CommonName: "a", TTL: time.Hour}, ErrInvalidCSR},
+		{"not PEM", SigningRequest{CommonName: "a", TTL: time.Hour, CSR: []byte("csr")}, ErrInvalidCSR},
+		{"wrong block", SigningRequest{CommonName: "a", TTL: time.Hour, CSR: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: block.Bytes})}, ErrInvalidCSR},
+		{"bad signature", SigningRequest{CommonName: "a", TTL: time.Hour, CSR: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: tampered})}, ErrInvalidCSR},
+		{"no TTL", SigningRequest{CommonName: "a", CSR: csr}, ErrInvalidTTL},
+		{"negative TTL", SigningRequest{CommonName: "a", TTL: -time.Hour, CSR: csr}, ErrInvalidTTL},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := ca.Sign(c.req); !errors.Is(err, c.err) {
+				t.Errorf("err = %v, want %v", err, c.err)
+			}
+		})
+	}
+
+	if len(ca.issued) != 0 {
+		t.Errorf("rejected requests were recorded: %v", ca.issued)
+	}
+}
+
+func TestLocalCARevokeUnknownSerial(t *testing.T) {
+	ca := newLocalCA(t, t.TempDir())
+
+	if err := ca.Revoke("01:02:03"); !errors.Is(err, ErrUnknownSerial) {
+		t.Errorf("err = %v, want %v", err, ErrUnknownSerial)
+	}
+}
+
+func TestNewLocalCARejectsCorruptFiles(t *testing.T) {
+	dir := t.TempDir()
+	newLocalCA(t, dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, serialsFile), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewLocalCA(dir, "snfs test"); err == nil {
+		t.Error("loaded a CA with a corrupt serial index")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, rootKeyFile), []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewLocalCA(dir, "snfs test"); err == nil {
+		t.Error("loaded a CA with a corrupt root key")
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
-	"bytes"
+	"crypto/subtle"
 	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -14,82 +17,120 @@ import (
 type CSR struct {
 	CommonName string `json:"common_name"`
 	TTL        string `json:"ttl"`
+	AltNames   string `json:"alt_names,omitempty"`
+	CSR        string `json:"csr"`
 }
 
 type CSRResponse struct {
-	RequestID     string          `json:"request_id"`
-	LeaseID       string          `json:"lease_id"`
-	Renewable     bool            `json:"renewable"`
-	LeaseDuration int32           `json:"lease_duration"`
-	Data          CSRResponseData `json:"data"`
+	Data *Certificate `json:"data"`
 }
 
-type CSRResponseData struct {
-	CAChain        []string `json:"ca_chain"`
-	Certificate    string   `json:"certificate"`
-	IssuingCA      string   `json:"issuing_ca"`
-	PrivateKey     string   `json:"private_key"`
-	PrivateKeyType string   `json:"private_key_type"`
-	SerialNumber   string   `json:"serial_number"`
+type RevokeRequest struct {
+	SerialNumber string `json:"serial_number"`
+}
+
+type RevokedResponse struct {
+	Data struct {
+		Serials   []string  `json:"serials"`
+		UpdatedAt time.Time `json:"updated_at"`
+	} `json:"data"`
 }
 
 func main() {
 	if err := godotenv.Load(); err != nil {
-		panic("Could not load environment file")
+		log.Println("No environment file loaded")
 	}
 
-	vaultToken := os.Getenv("VAULT_DEV_TOKEN")
-	vaultURL := os.Getenv("VAULT_URL")
+	ca, err := newCertificateAuthority()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	http.Handle("/certificate", certificate(vaultToken, vaultURL))
+	policy, err := newPolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := http.ListenAndServe(getListenAddr(), nil); err != nil {
-		log.Println(err)
+	audit, err := OpenAuditLog(getEnv("AUTHD_AUDIT_LOG", "audit.log"))
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// client := &http.Client{}
-	// csr := &CSR{
-	// 	CommonName: "lucky-goat.snfs.com",
-	// 	TTL:        "24h",
-	// }
+	owners, err := OpenNodeOwners(getEnv("AUTHD_NODE_OWNERS", "owners.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// bts, err := json.Marshal(csr)
-	// if err != nil {
-	// 	panic(err)
-	// }
+	revocations, err := OpenRevocations(getEnv("AUTHD_REVOCATIONS", "revocations.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// buf := bytes.NewBuffer(bts)
-	// fmt.Println("Sending CSR")
-	// fmt.Println(buf.String())
+	http.Handle("/certificate", certificate(ca, policy, owners, revocations, audit))
+	http.Handle("/revoke", revoke(ca, revocations, os.Getenv("AUTHD_ADMIN_TOKEN"), audit))
+	http.Handle("/revoked", revoked(ca))
 
-	// req, err := http.NewRequest("POST", vaultURL, buf)
-	// if err != nil {
-	// 	panic(err)
-	// }
+	if err := http.ListenAndServe(getListenAddr(), nil); err != nil {
+		log.Println(err)
+	}
+}
 
-	// req.Header.Add("X-Vault-Token", vaultToken)
-	// resp, err := client.Do(req)
+// newCertificateAuthority returns the backend selected by AUTHD_CA (local or vault).
+// Without AUTHD_CA Vault is used when VAULT_URL is set
+func newCertificateAuthority() (CertificateAuthority, error) {
+	backend := os.Getenv("AUTHD_CA")
+	if backend == "" {
+		backend = "local"
+		if os.Getenv("VAULT_URL") != "" {
+			backend = "vault"
+		}
+	}
 
-	// if err != nil {
-	// 	panic(err)
-	// }
+	switch backend {
+	case "vault":
+		return NewVaultCA(vaultSignURL(os.Getenv("VAULT_URL")), os.Getenv("VAULT_DEV_TOKEN")), nil
+	case "local":
+		return NewLocalCA(getEnv("AUTHD_CA_DIR", "ca"), getEnv("AUTHD_CA_NAME", "snfs.com"))
+	default:
+		return nil, fmt.Errorf("Unknown Certificate Authority %s", backend)
+	}
+}
 
-	// defer resp.Body.Close()
+// newPolicy reads the enrollment policy from AUTHD_DOMAIN, AUTHD_MAX_TTL
+// and the join tokens in AUTHD_JOIN_TOKENS (comma separated) or AUTHD_JOIN_TOKENS_FILE
+func newPolicy() (*Policy, error) {
+	maxTTL := DefaultMaxTTL
+	if value := os.Getenv("AUTHD_MAX_TTL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid AUTHD_MAX_TTL: %s", err)
+		}
+		maxTTL = parsed
+	}
 
-	// body, err := ioutil.ReadAll(resp.Body)
-	// if err != nil {
-	// 	panic(err)
-	// }
+	tokens := strings.Split(os.Getenv("AUTHD_JOIN_TOKENS"), ",")
+	if path := os.Getenv("AUTHD_JOIN_TOKENS_FILE"); path != "" {
+		fromFile, err := ReadJoinTokens(path)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, fromFile...)
+	}
+
+	policy := NewPolicy(getEnv("AUTHD_DOMAIN", "snfs.com"), maxTTL, tokens)
+	if len(policy.tokens) == 0 {
+		log.Println("No join tokens configured, enrollment is disabled")
+	}
 
-	// var csrResp CSRResponse
-	// if err := json.Unmarshal(body, &csrResp); err != nil {
-	// 	panic(err)
-	// }
+	return policy, nil
+}
 
-	// fmt.Println(csrResp.Data.Certificate)
-	// fmt.Println(csrResp.Data.PrivateKey)
-	// fmt.Println(csrResp.Data.IssuingCA)
+func getEnv(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
 
+	return def
 }
 
 func getListenAddr() string {
@@ -97,86 +138,215 @@ func getListenAddr() string {
 	return ":" + port
 }
 
-func certificate(vaultToken, vaultURL string) http.HandlerFunc {
+// certificate signs the CSR of a node holding a join token. A node id is only
+// signed for the key it was first issued for, and never again once revoked
+func certificate(ca CertificateAuthority, policy *Policy, owners *NodeOwners, revocations *Revocations, audit *AuditLog) http.HandlerFunc {
 	return func(res http.ResponseWriter, r *http.Request) {
-		csr, err := parseRequestBody(r)
-		if err != nil {
-			res.WriteHeader(400)
+		if r.Method != http.MethodPost {
+			res.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		entry := AuditEntry{Event: EventRejected, Remote: remoteAddr(r.RemoteAddr)}
+		reject := func(status int, err error) {
+			entry.Reason = err.Error()
+			audit.Record(entry)
+			res.WriteHeader(status)
 			res.Write([]byte(err.Error()))
+		}
+
+		token, err := policy.Authenticate(r)
+		if err != nil {
+			reject(http.StatusUnauthorized, err)
 			return
 		}
+		entry.Token = token
 
-		log.Printf("Getting Certificate for %s\n", csr.CommonName)
-		client := &http.Client{}
-		vReq, err := vaultRequest(csr, vaultURL, vaultToken)
+		csr, err := parseRequestBody(res, r)
 		if err != nil {
-			res.WriteHeader(400)
-			res.Write([]byte(err.Error()))
+			reject(http.StatusBadRequest, err)
+			return
+		}
+
+		req, err := signingRequest(csr)
+		entry.CommonName = req.CommonName
+		entry.AltNames = req.AltNames
+		entry.TTL = csr.TTL
+		if err != nil {
+			reject(http.StatusBadRequest, err)
 			return
 		}
 
-		resp, err := client.Do(vReq)
+		if err := policy.Check(req); err != nil {
+			reject(http.StatusForbidden, err)
+			return
+		}
 
+		parsed, err := parseCSR(req.CSR)
 		if err != nil {
-			res.WriteHeader(400)
-			res.Write([]byte(err.Error()))
+			reject(http.StatusBadRequest, err)
+			return
+		}
+
+		if err := revocations.Check(req, policy.Domain, parsed.PublicKey); err != nil {
+			status := signStatus(err)
+			if errors.Is(err, ErrRevokedNode) {
+				status = http.StatusForbidden
+			}
+			reject(status, err)
 			return
 		}
 
-		defer resp.Body.Close()
+		if err := owners.Claim(req, policy.Domain, parsed.PublicKey); err != nil {
+			status := signStatus(err)
+			if errors.Is(err, ErrNodeIDTaken) {
+				status = http.StatusForbidden
+			}
+			reject(status, err)
+			return
+		}
 
-		body, err := ioutil.ReadAll(resp.Body)
+		log.Printf("Signing Certificate for %s\n", csr.CommonName)
+		issued, err := ca.Sign(req)
 		if err != nil {
-			res.WriteHeader(400)
-			res.Write([]byte(err.Error()))
+			reject(signStatus(err), err)
 			return
 		}
 
+		// a certificate that couldn't be revoked for good is not handed out
+		if err := revocations.Issued(issued.SerialNumber, req, policy.Domain, parsed.PublicKey); err != nil {
+			entry.SerialNumber = issued.SerialNumber
+			reject(http.StatusInternalServerError, err)
+			return
+		}
+
+		entry.Event = EventIssued
+		entry.SerialNumber = issued.SerialNumber
+		audit.Record(entry)
+
 		res.Header().Set("Content-Type", "application/json")
 		res.WriteHeader(http.StatusOK)
-		res.Write(body)
-
+		json.NewEncoder(res).Encode(&CSRResponse{Data: issued})
 	}
 }
 
-func requestBodyDecoder(request *http.Request) (*json.Decoder, error) {
-	body, err := ioutil.ReadAll(request.Body)
-	if err != nil {
-		return nil, err
+// signStatus maps an error of CertificateAuthority.Sign to a status code
+func signStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidCSR), errors.Is(err, ErrInvalidTTL):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUpstream):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
 	}
+}
 
-	request.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+// revoke revokes a certificate by serial number along with the key and node ids it was issued for.
+// It requires the X-Authd-Token header to match AUTHD_ADMIN_TOKEN and is disabled when no admin token is configured
+func revoke(ca CertificateAuthority, revocations *Revocations, adminToken string, audit *AuditLog) http.HandlerFunc {
+	return func(res http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			res.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
 
-	return json.NewDecoder(ioutil.NopCloser(bytes.NewBuffer(body))), nil
+		if adminToken == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Authd-Token")), []byte(adminToken)) != 1 {
+			res.WriteHeader(http.StatusUnauthorized)
+			return
+		}
 
-}
+		var rr RevokeRequest
+		if err := json.NewDecoder(r.Body).Decode(&rr); err != nil || rr.SerialNumber == "" {
+			res.WriteHeader(http.StatusBadRequest)
+			res.Write([]byte("Serial Number Is Required"))
+			return
+		}
 
-func parseRequestBody(request *http.Request) (CSR, error) {
-	decoder, err := requestBodyDecoder(request)
-	if err != nil {
-		return CSR{}, err
+		if err := ca.Revoke(rr.SerialNumber); err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrUnknownSerial):
+				status = http.StatusNotFound
+			case errors.Is(err, ErrUpstream):
+				status = http.StatusBadGateway
+			}
+			res.WriteHeader(status)
+			res.Write([]byte(err.Error()))
+			return
+		}
+
+		known, err := revocations.Revoke(rr.SerialNumber)
+		if err != nil {
+			res.WriteHeader(http.StatusInternalServerError)
+			res.Write([]byte(err.Error()))
+			return
+		}
+
+		if !known {
+			log.Printf("Certificate %s Was Issued Before Revocations Were Kept, Its Node May Enroll Again\n", rr.SerialNumber)
+		}
+
+		log.Printf("Revoked Certificate %s\n", rr.SerialNumber)
+		audit.Record(AuditEntry{Event: EventRevoked, Remote: remoteAddr(r.RemoteAddr), SerialNumber: rr.SerialNumber})
+		res.WriteHeader(http.StatusNoContent)
 	}
+}
 
-	var csr CSR
-	decoder.Decode(&csr)
-	return csr, err
+// revoked lists the serial numbers of revoked certificates.
+// Nodes poll it to reject revoked peers
+func revoked(ca CertificateAuthority) http.HandlerFunc {
+	return func(res http.ResponseWriter, r *http.Request) {
+		serials, err := ca.Revoked()
+		if err != nil {
+			res.WriteHeader(signStatus(err))
+			res.Write([]byte(err.Error()))
+			return
+		}
 
+		var rr RevokedResponse
+		rr.Data.Serials = serials
+		rr.Data.UpdatedAt = time.Now()
+
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(&rr)
+	}
 }
 
-func vaultRequest(csr CSR, url, token string) (*http.Request, error) {
-	bts, err := json.Marshal(csr)
-	if err != nil {
-		return nil, err
+// maxRequestSize bounds the size of enrollment requests
+const maxRequestSize = 64 << 10
+
+func parseRequestBody(res http.ResponseWriter, request *http.Request) (CSR, error) {
+	var csr CSR
+	decoder := json.NewDecoder(http.MaxBytesReader(res, request.Body, maxRequestSize))
+	if err := decoder.Decode(&csr); err != nil {
+		return CSR{}, fmt.Errorf("Invalid Request: %s", err)
 	}
 
-	buf := bytes.NewBuffer(bts)
+	return csr, nil
+}
 
-	req, err := http.NewRequest("POST", url, buf)
-	if err != nil {
-		return nil, err
+func signingRequest(csr CSR) (SigningRequest, error) {
+	ttl := DefaultTTL
+	if csr.TTL != "" {
+		parsed, err := time.ParseDuration(csr.TTL)
+		if err != nil {
+			return SigningRequest{}, ErrInvalidTTL
+		}
+		ttl = parsed
 	}
 
-	req.Header.Add("X-Vault-Token", token)
+	var altNames []string
+	for _, name := range strings.Split(csr.AltNames, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			altNames = append(altNames, name)
+		}
+	}
 
-	return req, nil
+	return SigningRequest{
+		CommonName: strings.ToLower(csr.CommonName),
+		AltNames:   altNames,
+		TTL:        ttl,
+		CSR:        []byte(csr.CSR),
+	}, nil
 }
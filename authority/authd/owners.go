@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrNodeIDTaken is returned when a node id is requested with another key than the one it was first issued for
+var ErrNodeIDTaken = errors.New("Node ID Is Bound To Another Key")
+
+// NodeOwner binds a node id to the key it was first issued for
+type NodeOwner struct {
+	NodeID    string    `json:"node_id"`
+	Key       string    `json:"key"`
+	ClaimedAt time.Time `json:"claimed_at"`
+}
+
+// NodeOwners remembers which key owns which node id, so a token holder can't obtain a
+// certificate for the node id of another node. Owners are kept in a JSON file
+type NodeOwners struct {
+	path   string
+	mtx    sync.Mutex
+	owners map[string]NodeOwner
+}
+
+// OpenNodeOwners loads the owners kept at path
+func OpenNodeOwners(path string) (*NodeOwners, error) {
+	o := &NodeOwners{
+		path:   path,
+		owners: make(map[string]NodeOwner),
+	}
+
+	bts, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return o, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var owners []NodeOwner
+	if err := json.Unmarshal(bts, &owners); err != nil {
+		return nil, err
+	}
+
+	for _, owner := range owners {
+		o.owners[owner.NodeID] = owner
+	}
+
+	return o, nil
+}
+
+// Claim binds the node ids named by the alternative names of req to public. It fails if one
+// of them is bound to another key already
+func (o *NodeOwners) Claim(req SigningRequest, domain string, public crypto.PublicKey) error {
+	key, err := keyFingerprint(public)
+	if err != nil {
+		return err
+	}
+
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	claimed := make([]string, 0)
+	for _, id := range nodeIDs(req, domain) {
+		if owner, ok := o.owners[id]; ok {
+			if owner.Key != key {
+				return fmt.Errorf("%w: %s", ErrNodeIDTaken, id)
+			}
+			continue
+		}
+
+		claimed = append(claimed, id)
+	}
+
+	if len(claimed) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	for _, id := range claimed {
+		o.owners[id] = NodeOwner{NodeID: id, Key: key, ClaimedAt: now}
+	}
+
+	if err := o.save(); err != nil {
+		for _, id := range claimed {
+			delete(o.owners, id)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// save writes the owners. Callers hold o.mtx
+func (o *NodeOwners) save() error {
+	owners := make([]NodeOwner, 0, len(o.owners))
+	for _, owner := range o.owners {
+		owners = append(owners, owner)
+	}
+
+	bts, err := json.MarshalIndent(owners, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(o.path), filepath.Base(o.path)+".tmp")
+	if err := ioutil.WriteFile(tmp, bts, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, o.path)
+}
+
+// keyFingerprint is the hex encoded SHA-256 of the DER encoded public key
+func keyFingerprint(public crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "", ErrInvalidCSR
+	}
+
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
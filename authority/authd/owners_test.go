@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestNodeOwnersClaim(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "owners.json")
+	owners, err := OpenNodeOwners(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	second, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	req := SigningRequest{CommonName: "abcd.node.snfs", AltNames: []string{"abcd.node.snfs", "other.example"}}
+	if err := owners.Claim(req, "snfs", first.Public()); err != nil {
+		t.Fatal(err)
+	}
+
+	// renewals reuse the key
+	if err := owners.Claim(req, "snfs", first.Public()); err != nil {
+		t.Errorf("renewal with the same key was rejected: %s", err)
+	}
+
+	if err := owners.Claim(req, "snfs", second.Public()); !errors.Is(err, ErrNodeIDTaken) {
+		t.Errorf("err = %v, want %v", err, ErrNodeIDTaken)
+	}
+
+	// names outside of the node domain are not node ids
+	other := SigningRequest{CommonName: "other.example", AltNames: []string{"other.example"}}
+	if err := owners.Claim(other, "snfs", second.Public()); err != nil {
+		t.Errorf("claim without node ids failed: %s", err)
+	}
+
+	reopened, err := OpenNodeOwners(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reopened.Claim(req, "snfs", second.Public()); !errors.Is(err, ErrNodeIDTaken) {
+		t.Errorf("binding was lost on reload, err = %v", err)
+	}
+
+	if _, ok := reopened.owners["other.example"]; ok {
+		t.Error("a name outside of the node domain was bound")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultMaxTTL bounds the lifetime of issued certificates
+const DefaultMaxTTL = 720 * time.Hour
+
+// Policy errors
+var (
+	ErrMissingToken       = errors.New("Join Token Required")
+	ErrInvalidToken       = errors.New("Invalid Join Token")
+	ErrNameNotAllowed     = errors.New("Name Not Allowed")
+	ErrTooManyAltNames    = errors.New("Too Many Alternative Names")
+	ErrTTLNotAllowed      = errors.New("TTL Not Allowed")
+	ErrNoTokensConfigured = errors.New("No Join Tokens Configured")
+)
+
+// label is a single lower case dns label
+var label = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// nodeID is the hex encoded DHT id carried in <id>.node.<domain>
+var nodeID = regexp.MustCompile(`^[0-9a-f]{1,64}$`)
+
+// Policy decides who may enroll and which certificates are issued.
+// Nodes authenticate with a pre-shared join token. Certificates may only name
+// <instance>.<domain> and optionally <node id>.node.<domain>, with a TTL of at most MaxTTL.
+// Which key may name a node id is decided by NodeOwners
+type Policy struct {
+	Domain string
+	MaxTTL time.Duration
+	tokens [][]byte
+}
+
+// NewPolicy returns a Policy for domain accepting tokens
+func NewPolicy(domain string, maxTTL time.Duration, tokens []string) *Policy {
+	p := &Policy{
+		Domain: strings.TrimPrefix(domain, "."),
+		MaxTTL: maxTTL,
+	}
+
+	for _, token := range tokens {
+		if token = strings.TrimSpace(token); token != "" {
+			p.tokens = append(p.tokens, []byte(token))
+		}
+	}
+
+	return p
+}
+
+// ReadJoinTokens reads one join token per line from path
+func ReadJoinTokens(path string) ([]string, error) {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Split(string(bts), "\n"), nil
+}
+
+// Authenticate checks the join token in the Authorization header ("Bearer <token>")
+// and returns a fingerprint of it for the audit log
+func (p *Policy) Authenticate(r *http.Request) (string, error) {
+	if len(p.tokens) == 0 {
+		return "", ErrNoTokensConfigured
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return "", ErrMissingToken
+	}
+
+	for _, known := range p.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), known) == 1 {
+			return tokenFingerprint(token), nil
+		}
+	}
+
+	return "", ErrInvalidToken
+}
+
+// Check validates the names and the TTL of req
+func (p *Policy) Check(req SigningRequest) error {
+	instance := strings.TrimSuffix(req.CommonName, "."+p.Domain)
+	if instance == req.CommonName || !label.MatchString(instance) {
+		return fmt.Errorf("%w: %s", ErrNameNotAllowed, req.CommonName)
+	}
+
+	if len(req.AltNames) > 1 {
+		return ErrTooManyAltNames
+	}
+
+	for _, name := range req.AltNames {
+		id := strings.TrimSuffix(name, ".node."+p.Domain)
+		if id == name || !nodeID.MatchString(id) {
+			return fmt.Errorf("%w: %s", ErrNameNotAllowed, name)
+		}
+	}
+
+	if req.TTL <= 0 || req.TTL > p.MaxTTL {
+		return fmt.Errorf("%w: %s exceeds %s", ErrTTLNotAllowed, req.TTL, p.MaxTTL)
+	}
+
+	return nil
+}
+
+func tokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("%x", sum[:4])
+}
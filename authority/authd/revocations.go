@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRevokedNode is returned when a certificate is requested for the key or a node id of a revoked certificate
+var ErrRevokedNode = errors.New("Node Has Been Revoked")
+
+// IssuedKey records the key and node ids a certificate was issued for
+type IssuedKey struct {
+	SerialNumber string     `json:"serial_number"`
+	NodeIDs      []string   `json:"node_ids"`
+	Key          string     `json:"key"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Revocations remembers the key and node ids of every issued certificate, so once it is revoked
+// its node can't simply enroll again with its join token. Records are kept in a JSON file
+type Revocations struct {
+	path   string
+	mtx    sync.Mutex
+	issued map[string]IssuedKey
+	// keys and nodeIDs hold the revoked key fingerprints and node ids
+	keys    map[string]bool
+	nodeIDs map[string]bool
+}
+
+// OpenRevocations loads the records kept at path
+func OpenRevocations(path string) (*Revocations, error) {
+	r := &Revocations{
+		path:    path,
+		issued:  make(map[string]IssuedKey),
+		keys:    make(map[string]bool),
+		nodeIDs: make(map[string]bool),
+	}
+
+	bts, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var issued []IssuedKey
+	if err := json.Unmarshal(bts, &issued); err != nil {
+		return nil, err
+	}
+
+	for _, record := range issued {
+		r.add(record)
+	}
+
+	return r, nil
+}
+
+// Check fails if the key or one of the node ids named by the alternative names of req
+// belong to a revoked certificate
+func (r *Revocations) Check(req SigningRequest, domain string, public crypto.PublicKey) error {
+	key, err := keyFingerprint(public)
+	if err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.keys[key] {
+		return fmt.Errorf("%w: key %s", ErrRevokedNode, key)
+	}
+
+	for _, id := range nodeIDs(req, domain) {
+		if r.nodeIDs[id] {
+			return fmt.Errorf("%w: %s", ErrRevokedNode, id)
+		}
+	}
+
+	return nil
+}
+
+// Issued records the key and node ids the certificate with serial was issued for
+func (r *Revocations) Issued(serial string, req SigningRequest, domain string, public crypto.PublicKey) error {
+	key, err := keyFingerprint(public)
+	if err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	record := IssuedKey{SerialNumber: normalizeSerial(serial), NodeIDs: nodeIDs(req, domain), Key: key}
+	r.issued[record.SerialNumber] = record
+
+	if err := r.save(); err != nil {
+		delete(r.issued, record.SerialNumber)
+		return err
+	}
+
+	return nil
+}
+
+// Revoke revokes the key and node ids of the certificate with serial. It returns
+// false if the certificate was not issued while records were kept
+func (r *Revocations) Revoke(serial string) (bool, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	record, ok := r.issued[normalizeSerial(serial)]
+	if !ok {
+		return false, nil
+	}
+
+	if record.RevokedAt != nil {
+		return true, nil
+	}
+
+	now := time.Now()
+	revoked := record
+	revoked.RevokedAt = &now
+	r.add(revoked)
+
+	// on failure the key and node ids stay refused until restart
+	return true, r.save()
+}
+
+// add indexes record. Callers hold r.mtx or own r
+func (r *Revocations) add(record IssuedKey) {
+	r.issued[record.SerialNumber] = record
+	if record.RevokedAt == nil {
+		return
+	}
+
+	r.keys[record.Key] = true
+	for _, id := range record.NodeIDs {
+		r.nodeIDs[id] = true
+	}
+}
+
+// save writes the records. Callers hold r.mtx
+func (r *Revocations) save() error {
+	issued := make([]IssuedKey, 0, len(r.issued))
+	for _, record := range r.issued {
+		issued = append(issued, record)
+	}
+
+	bts, err := json.MarshalIndent(issued, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(r.path), filepath.Base(r.path)+".tmp")
+	if err := ioutil.WriteFile(tmp, bts, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, r.path)
+}
+
+// nodeIDs returns the node ids named by the alternative names of req
+func nodeIDs(req SigningRequest, domain string) []string {
+	ids := make([]string, 0)
+	for _, name := range req.AltNames {
+		if id := strings.TrimSuffix(name, ".node."+domain); id != name {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// normalizeSerial formats serial as lower case, colon separated hex
+func normalizeSerial(serial string) string {
+	return strings.ToLower(strings.ReplaceAll(serial, "-", ":"))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestRevocationsRefuseRevokedNodes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revocations.json")
+	revocations, err := OpenRevocations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revokedKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	req := SigningRequest{CommonName: "a.snfs", AltNames: []string{"abcd.node.snfs"}}
+	if err := revocations.Issued("0A:1B", req, "snfs", revokedKey.Public()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := revocations.Check(req, "snfs", revokedKey.Public()); err != nil {
+		t.Errorf("renewal of a certificate that is not revoked was refused: %s", err)
+	}
+
+	if known, err := revocations.Revoke("0a:1b"); err != nil || !known {
+		t.Fatalf("revoke = %v, %v", known, err)
+	}
+
+	if known, _ := revocations.Revoke("ff:ff"); known {
+		t.Error("a serial that was never issued is known")
+	}
+
+	reopened, err := OpenRevocations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := SigningRequest{CommonName: "b.snfs", AltNames: []string{"ef01.node.snfs"}}
+	cases := []struct {
+		name   string
+		req    SigningRequest
+		public *ecdsa.PrivateKey
+		err    error
+	}{
+		{"same key and node id", req, revokedKey, ErrRevokedNode},
+		{"same node id with a new key", req, otherKey, ErrRevokedNode},
+		{"same key with a new node id", other, revokedKey, ErrRevokedNode},
+		{"new key and node id", other, otherKey, nil},
+	}
+
+	for _, c := range cases {
+		if err := reopened.Check(c.req, "snfs", c.public.Public()); !errors.Is(err, c.err) {
+			t.Errorf("%s: err = %v, want %v", c.name, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+type vaultSignRequest struct {
+	CSR        string `json:"csr"`
+	CommonName string `json:"common_name"`
+	AltNames   string `json:"alt_names,omitempty"`
+	TTL        string `json:"ttl"`
+}
+
+type vaultResponse struct {
+	RequestID     string      `json:"request_id"`
+	LeaseID       string      `json:"lease_id"`
+	Renewable     bool        `json:"renewable"`
+	LeaseDuration int32       `json:"lease_duration"`
+	Data          Certificate `json:"data"`
+	Errors        []string    `json:"errors"`
+}
+
+// VaultCA signs certificates with the sign endpoint of a Vault pki role,
+// e.g. https://127.0.0.1:8200/v1/pki_int/sign/<ROLE_NAME>
+type VaultCA struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewVaultCA returns a VaultCA for the sign endpoint at url
+func NewVaultCA(url, token string) *VaultCA {
+	return &VaultCA{
+		url:    url,
+		token:  token,
+		client: &http.Client{},
+	}
+}
+
+func (v *VaultCA) Sign(req SigningRequest) (*Certificate, error) {
+	if _, err := parseCSR(req.CSR); err != nil {
+		return nil, err
+	}
+
+	bts, err := json.Marshal(&vaultSignRequest{
+		CSR:        string(req.CSR),
+		CommonName: req.CommonName,
+		AltNames:   strings.Join(req.AltNames, ","),
+		TTL:        req.TTL.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	vReq, err := http.NewRequest("POST", v.url, bytes.NewBuffer(bts))
+	if err != nil {
+		return nil, err
+	}
+
+	vReq.Header.Add("X-Vault-Token", v.token)
+	resp, err := v.client.Do(vReq)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUpstream, err)
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var vResp vaultResponse
+	if err := json.Unmarshal(body, &vResp); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUpstream, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: Vault Returned %d: %s", ErrUpstream, resp.StatusCode, strings.Join(vResp.Errors, ", "))
+	}
+
+	return &vResp.Data, nil
+}
+
+func (v *VaultCA) Revoke(serial string) error {
+	bts, err := json.Marshal(map[string]string{"serial_number": serial})
+	if err != nil {
+		return err
+	}
+
+	vReq, err := http.NewRequest("POST", v.mount()+"/revoke", bytes.NewBuffer(bts))
+	if err != nil {
+		return err
+	}
+
+	vReq.Header.Add("X-Vault-Token", v.token)
+	resp, err := v.client.Do(vReq)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUpstream, err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%w: Vault Returned %d: %s", ErrUpstream, resp.StatusCode, body)
+	}
+
+	return nil
+}
+
+// Revoked reads the CRL of the pki mount
+func (v *VaultCA) Revoked() ([]string, error) {
+	resp, err := v.client.Get(v.mount() + "/crl")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUpstream, err)
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: Vault Returned %d: %s", ErrUpstream, resp.StatusCode, body)
+	}
+
+	crl, err := x509.ParseRevocationList(body)
+	if err != nil {
+		return nil, err
+	}
+
+	serials := make([]string, len(crl.RevokedCertificateEntries))
+	for i, entry := range crl.RevokedCertificateEntries {
+		serials[i] = formatSerial(entry.SerialNumber)
+	}
+
+	return serials, nil
+}
+
+// mount returns the url of the pki mount of the sign endpoint, e.g. .../v1/pki_int
+func (v *VaultCA) mount() string {
+	if i := strings.Index(v.url, "/sign/"); i >= 0 {
+		return v.url[:i]
+	}
+
+	return v.url
+}
+
+// vaultSignURL returns the sign endpoint of the role VAULT_URL points at.
+// VAULT_URL used to name the issue endpoint, which generates private keys inside Vault
+func vaultSignURL(url string) string {
+	return strings.Replace(url, "/issue/", "/sign/", 1)
+}
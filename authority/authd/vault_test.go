@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeVault serves the sign, revoke and crl endpoints of the pki mount /v1/pki_int
+type fakeVault struct {
+	token   string
+	signed  []vaultSignRequest
+	revoked []string
+	crl     []byte
+}
+
+func (f *fakeVault) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/v1/pki_int/crl" {
+		res.Write(f.crl)
+		return
+	}
+
+	if req.Header.Get("X-Vault-Token") != f.token {
+		res.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(res).Encode(map[string][]string{"errors": {"permission denied"}})
+		return
+	}
+
+	switch req.URL.Path {
+	case "/v1/pki_int/sign/snfs":
+		var body vaultSignRequest
+		json.NewDecoder(req.Body).Decode(&body)
+		f.signed = append(f.signed, body)
+		json.NewEncoder(res).Encode(vaultResponse{Data: Certificate{Certificate: "leaf", IssuingCA: "ca", SerialNumber: "0a:0b"}})
+
+	case "/v1/pki_int/revoke":
+		var body map[string]string
+		json.NewDecoder(req.Body).Decode(&body)
+		f.revoked = append(f.revoked, body["serial_number"])
+		res.WriteHeader(http.StatusNoContent)
+
+	default:
+		res.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(res).Encode(map[string][]string{"errors": {"no handler for route"}})
+	}
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, *httptest.Server) {
+	t.Helper()
+
+	vault := &fakeVault{token: "s.token"}
+	server := httptest.NewServer(vault)
+	t.Cleanup(server.Close)
+
+	return vault, server
+}
+
+func TestVaultCASignForwardsRequestNames(t *testing.T) {
+	vault, server := newFakeVault(t)
+	ca := NewVaultCA(vaultSignURL(server.URL+"/v1/pki_int/issue/snfs"), vault.token)
+
+	csr, _ := newCSR(t, "authd.example.com", "authd.example.com")
+	issued, err := ca.Sign(SigningRequest{
+		CommonName: "abcd.node.snfs",
+		AltNames:   []string{"abcd.node.snfs.local", "abcd"},
+		TTL:        time.Hour,
+		CSR:        csr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if issued.SerialNumber != "0a:0b" || issued.Certificate != "leaf" {
+		t.Errorf("issued = %+v", issued)
+	}
+
+	want := vaultSignRequest{
+		CSR:        string(csr),
+		CommonName: "abcd.node.snfs",
+		AltNames:   "abcd.node.snfs.local,abcd",
+		TTL:        "1h0m0s",
+	}
+	if len(vault.signed) != 1 || !reflect.DeepEqual(vault.signed[0], want) {
+		t.Errorf("vault was asked to sign %+v, want %+v", vault.signed, want)
+	}
+}
+
+func TestVaultCASignRejects(t *testing.T) {
+	vault, server := newFakeVault(t)
+	csr, _ := newCSR(t, "node")
+
+	// invalid CSRs never reach Vault
+	ca := NewVaultCA(server.URL+"/v1/pki_int/sign/snfs", vault.token)
+	if _, err := ca.Sign(SigningRequest{CommonName: "a", TTL: time.Hour, CSR: []byte("csr")}); !errors.Is(err, ErrInvalidCSR) {
+		t.Errorf("err = %v, want %v", err, ErrInvalidCSR)
+	}
+
+	if len(vault.signed) != 0 {
+		t.Errorf("invalid CSR was sent to vault: %+v", vault.signed)
+	}
+
+	denied := NewVaultCA(server.URL+"/v1/pki_int/sign/snfs", "s.wrong")
+	if _, err := denied.Sign(SigningRequest{CommonName: "a", TTL: time.Hour, CSR: csr}); !errors.Is(err, ErrUpstream) {
+		t.Errorf("err = %v, want %v", err, ErrUpstream)
+	}
+
+	unknownRole := NewVaultCA(server.URL+"/v1/pki_int/sign/other", vault.token)
+	if _, err := unknownRole.Sign(SigningRequest{CommonName: "a", TTL: time.Hour, CSR: csr}); !errors.Is(err, ErrUpstream) {
+		t.Errorf("err = %v, want %v", err, ErrUpstream)
+	}
+
+	server.Close()
+	if _, err := ca.Sign(SigningRequest{CommonName: "a", TTL: time.Hour, CSR: csr}); !errors.Is(err, ErrUpstream) {
+		t.Errorf("err = %v, want %v", err, ErrUpstream)
+	}
+}
+
+func TestVaultCARevoke(t *testing.T) {
+	vault, server := newFakeVault(t)
+
+	ca := NewVaultCA(server.URL+"/v1/pki_int/sign/snfs", vault.token)
+	if err := ca.Revoke("0a:0b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(vault.revoked, []string{"0a:0b"}) {
+		t.Errorf("vault revoked %v, want [0a:0b]", vault.revoked)
+	}
+
+	denied := NewVaultCA(server.URL+"/v1/pki_int/sign/snfs", "s.wrong")
+	if err := denied.Revoke("0a:0b"); !errors.Is(err, ErrUpstream) {
+		t.Errorf("err = %v, want %v", err, ErrUpstream)
+	}
+}
+
+func TestVaultCARevokedReadsCRL(t *testing.T) {
+	vault, server := newFakeVault(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "snfs test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, issuer, issuer, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if issuer, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+
+	vault.crl, err = x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: big.NewInt(0x0a0b), RevocationTime: time.Now()},
+			{SerialNumber: big.NewInt(0x01ff), RevocationTime: time.Now()},
+		},
+	}, issuer, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := NewVaultCA(server.URL+"/v1/pki_int/sign/snfs", vault.token)
+	revoked, err := ca.Revoked()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"0a:0b", "01:ff"}; !reflect.DeepEqual(revoked, want) {
+		t.Errorf("revoked = %v, want %v", revoked, want)
+	}
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(aclCmd)
+}
+
+var aclCmd = &cobra.Command{
+	Use:   "acl",
+	Short: "Restrict shares to named peers",
+	Long:  `Commands to list and edit the peers a share is served to. Peers are given as node id`,
+	Run: func(cmd *cobra.Command, args []string) {
+	},
+}
+
+func printACL(hash string, peers []string) {
+	if len(peers) == 0 {
+		fmt.Printf("%s is public\n", hash)
+		return
+	}
+
+	fmt.Printf("%s is served to %d peer(s)\n", hash, len(peers))
+	for _, peer := range peers {
+		fmt.Printf("  %s\n", peer)
+	}
+}
@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/alabianca/snfs/cli/services"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	aclCmd.AddCommand(aclAddCmd)
+}
+
+var aclAddCmd = &cobra.Command{
+	Use:   "add [hash] [peer...]",
+	Short: "Serve a share to more peers",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		acl := services.NewACLService()
+		var peers []string
+		for _, peer := range args[1:] {
+			var err error
+			if peers, err = acl.Add(args[0], peer); err != nil {
+				log.Fatalf("Error %s\n", err)
+			}
+		}
+
+		printACL(args[0], peers)
+	},
+}
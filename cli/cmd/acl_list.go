@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/alabianca/snfs/cli/services"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	aclCmd.AddCommand(aclListCmd)
+}
+
+var aclListCmd = &cobra.Command{
+	Use:   "list [hash]",
+	Short: "List the peers a share is served to",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		peers, err := services.NewACLService().List(args[0])
+		if err != nil {
+			log.Fatalf("Error %s\n", err)
+		}
+
+		printACL(args[0], peers)
+	},
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/alabianca/snfs/cli/services"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	aclCmd.AddCommand(aclRemoveCmd)
+}
+
+var aclRemoveCmd = &cobra.Command{
+	Use:   "remove [hash] [peer...]",
+	Short: "Stop serving a share to peers",
+	Long:  `Stop serving a share to peers. Removing the last peer makes the share public`,
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		acl := services.NewACLService()
+		var peers []string
+		for _, peer := range args[1:] {
+			var err error
+			if peers, err = acl.Remove(args[0], peer); err != nil {
+				log.Fatalf("Error %s\n", err)
+			}
+		}
+
+		printACL(args[0], peers)
+	},
+}
@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/alabianca/snfs/cli/services"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	aclCmd.AddCommand(aclSetCmd)
+}
+
+var aclSetCmd = &cobra.Command{
+	Use:   "set [hash] [peer...]",
+	Short: "Replace the peers a share is served to",
+	Long:  `Replace the peers a share is served to. Without peers the share becomes public`,
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		peers, err := services.NewACLService().Set(args[0], args[1:])
+		if err != nil {
+			log.Fatalf("Error %s\n", err)
+		}
+
+		printACL(args[0], peers)
+	},
+}
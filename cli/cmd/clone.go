@@ -1,42 +1,164 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"text/tabwriter"
 
 	"github.com/alabianca/spin"
 
 	"github.com/alabianca/snfs/cli/services"
+	"github.com/alabianca/snfs/util"
 
 	"github.com/spf13/cobra"
 )
 
+var clonePaths []string
+var cloneOutput string
+var cloneOverwrite bool
+var cloneSkip bool
+var cloneRename bool
+var cloneDryRun bool
+var cloneFrom []string
+
 func init() {
 	rootCmd.AddCommand(cloneCmd)
+	cloneCmd.Flags().StringArrayVarP(&clonePaths, "path", "p", nil, "Only clone this file or directory of the share (repeatable)")
+	cloneCmd.Flags().StringVarP(&cloneOutput, "output", "o", "", "Directory to clone into (defaults to a directory named after the hash)")
+	cloneCmd.Flags().BoolVar(&cloneOverwrite, "overwrite", false, "Replace files that already exist (default)")
+	cloneCmd.Flags().BoolVar(&cloneSkip, "skip", false, "Keep files that already exist")
+	cloneCmd.Flags().BoolVar(&cloneRename, "rename", false, "Write conflicting files next to the existing ones as \"name (n).ext\"")
+	cloneCmd.Flags().BoolVar(&cloneDryRun, "dry-run", false, "List what would be written without writing any content")
+	cloneCmd.Flags().StringArrayVar(&cloneFrom, "from", nil, "Reuse the unchanged parts of files in this directory, e.g. a clone of a previous version (repeatable)")
 }
 
 var cloneCmd = &cobra.Command{
-	Use:   "clone [hash]",
+	Use:   "clone [hash|capability link|label@publisher]",
 	Short: "Clone content",
 	Args:  cobra.MinimumNArgs(1),
-	Long:  `Clone the contents of a particular node into your current working directory`,
+	Long: `Clone the contents of a particular node into your current working directory, or into the directory given with --output.
+When the output directory already exists or --from is given, only the chunks of files that are not found locally are downloaded`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) < 1 {
 			log.Fatal("Please provide file hash to download")
 		}
 
-		runClone(args[0])
+		policy, err := conflictPolicy(cloneOverwrite, cloneSkip, cloneRename)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		dest := cloneOutput
+		if dest == "" {
+			dest = args[0]
+		}
+
+		// a name clones the content it currently points at
+		if util.IsName(args[0]) {
+			name, err := util.ParseName(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			record, err := services.NewNamesService().Resolve(args[0])
+			if err != nil {
+				log.Fatalf("Error %s\n", err)
+			}
+
+			fmt.Printf("%s is #%d %s\n", name, record.Sequence, record.Hash)
+			if cloneOutput == "" {
+				dest = name.Label
+			}
+			args[0] = record.Hash
+		}
+
+		if util.IsCapability(args[0]) {
+			capability, err := util.ParseCapability(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if len(clonePaths) > 0 || cloneDryRun {
+				log.Fatal("--path and --dry-run need the file listing, which encrypted shares do not publish")
+			}
+
+			if cloneOutput == "" {
+				dest = capability.ID.String()
+			}
+
+			runCloneEncrypted(capability, dest, policy)
+			return
+		}
+
+		if cloneDryRun {
+			runPlan(args[0], dest, policy)
+			return
+		}
+
+		runClone(args[0], dest, policy)
 	},
 }
 
-func runClone(fileHash string) {
+func conflictPolicy(overwrite, skip, rename bool) (util.ConflictPolicy, error) {
+	set := 0
+	for _, flag := range []bool{overwrite, skip, rename} {
+		if flag {
+			set++
+		}
+	}
+
+	if set > 1 {
+		return 0, errors.New("Only one of --overwrite, --skip and --rename can be used")
+	}
+
+	switch {
+	case skip:
+		return util.ConflictSkip, nil
+	case rename:
+		return util.ConflictRename, nil
+	default:
+		return util.ConflictOverwrite, nil
+	}
+}
+
+func runClone(fileHash, dest string, policy util.ConflictPolicy) {
 	spinner := spin.NewSpinner(spin.Dots2, os.Stdout)
 	errChan := make(chan error)
-	successChan := make(chan bool)
+	successChan := make(chan services.DeltaResult)
 
 	go initSpinnerWithText(spinner, fmt.Sprintf("Downloading -> %s", fileHash))
-	go clone(fileHash, successChan, errChan)
+	go clone(fileHash, dest, policy, successChan, errChan)
+
+	select {
+	case err := <-errChan:
+		spinner.Stop()
+		fmt.Printf("[Error] %s\n", err)
+	case result := <-successChan:
+		spinner.Stop()
+		fmt.Printf("Content downloaded into %s\n", dest)
+		if result.Reused > 0 {
+			fmt.Printf("Fetched %s of %s, %s reused from local files\n", formatBytes(result.Fetched), formatBytes(result.Size), Green(formatBytes(result.Reused)))
+		}
+	}
+}
+
+func runCloneEncrypted(capability util.Capability, dest string, policy util.ConflictPolicy) {
+	spinner := spin.NewSpinner(spin.Dots2, os.Stdout)
+	errChan := make(chan error)
+	successChan := make(chan bool)
+
+	go initSpinnerWithText(spinner, fmt.Sprintf("Downloading -> %s", capability.ID))
+	go func() {
+		storageService := services.NewStroageService()
+		if err := storageService.DownloadEncrypted(capability, dest, util.OnConflict(policy)); err != nil {
+			errChan <- err
+			return
+		}
+
+		successChan <- true
+	}()
 
 	select {
 	case err := <-errChan:
@@ -44,16 +166,67 @@ func runClone(fileHash string) {
 		fmt.Printf("[Error] %s\n", err)
 	case <-successChan:
 		spinner.Stop()
-		fmt.Println("Content downloaded")
+		fmt.Printf("Content downloaded and decrypted into %s\n", dest)
 	}
 }
 
-func clone(fileHash string, success chan bool, errc chan error) {
+func clone(fileHash, dest string, policy util.ConflictPolicy, success chan services.DeltaResult, errc chan error) {
 	storageService := services.NewStroageService()
-	if err := storageService.Download(fileHash); err != nil {
+
+	// an existing copy is updated in place
+	sources := cloneFrom
+	if _, err := os.Stat(dest); err == nil {
+		sources = append([]string{dest}, cloneFrom...)
+	}
+
+	if len(sources) > 0 {
+		result, err := storageService.DownloadDelta(fileHash, dest, clonePaths, sources, util.OnConflict(policy))
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		success <- result
+		return
+	}
+
+	download := func(hash string) error {
+		return storageService.Download(hash, dest, util.OnConflict(policy))
+	}
+
+	if len(clonePaths) > 0 {
+		download = func(hash string) error {
+			return storageService.DownloadPaths(hash, dest, clonePaths, util.OnConflict(policy))
+		}
+	}
+
+	if err := download(fileHash); err != nil {
 		errc <- err
 		return
 	}
 
-	success <- true
+	success <- services.DeltaResult{}
+}
+
+func runPlan(fileHash, dest string, policy util.ConflictPolicy) {
+	actions := make([]util.ExtractAction, 0)
+	report := func(action util.ExtractAction) {
+		actions = append(actions, action)
+	}
+
+	storageService := services.NewStroageService()
+	if err := storageService.Plan(fileHash, dest, clonePaths, util.OnConflict(policy), util.OnAction(report)); err != nil {
+		printError(err)
+		return
+	}
+
+	fmt.Printf("Dry run: %d entries for %s\n", len(actions), dest)
+	fmt.Println()
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(writer, "Action\tEntry\tPath\t")
+	for _, action := range actions {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t\n", action.Action, action.Name, action.Path)
+	}
+	writer.Flush()
+	fmt.Println()
 }
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/alabianca/snfs/cli/services"
+	"github.com/alabianca/snfs/util"
+
+	"github.com/spf13/cobra"
+)
+
+var followOutput string
+var followInterval time.Duration
+
+func init() {
+	rootCmd.AddCommand(followCmd)
+	followCmd.Flags().StringVarP(&followOutput, "output", "o", "", "Directory to mirror into (defaults to a directory named after the label of the name)")
+	followCmd.Flags().DurationVar(&followInterval, "interval", 10*time.Second, "How often to resolve the name for a new version")
+}
+
+var followCmd = &cobra.Command{
+	Use:   "follow [label@publisher]",
+	Short: "Mirror a synced directory",
+	Args:  cobra.ExactArgs(1),
+	Long: `Keep a local copy of a directory shared with snfs sync up to date, until interrupted.
+Only files that changed are downloaded and files removed from the directory are removed from the copy`,
+	Run: func(cmd *cobra.Command, args []string) {
+		name := args[0]
+		parsed, err := util.ParseName(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		dest := followOutput
+		if dest == "" {
+			dest = parsed.Label
+		}
+
+		if followInterval <= 0 {
+			log.Fatal("--interval must be positive")
+		}
+
+		state, err := services.ReadFollowState(dest)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if state.Name != "" && state.Name != name {
+			log.Fatalf("%s mirrors %s, not %s", dest, state.Name, name)
+		}
+
+		runFollow(name, dest, state)
+	},
+}
+
+// runFollow mirrors the content name points at into dest every time a new version is published
+func runFollow(name, dest string, state services.FollowState) {
+	fmt.Printf("Following %s into %s\n", White(name), dest)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	ticker := time.NewTicker(followInterval)
+	defer ticker.Stop()
+
+	for {
+		next, err := followOnce(name, dest, state)
+		if err != nil {
+			fmt.Printf("[Error] %s\n", err)
+		} else {
+			state = next
+		}
+
+		select {
+		case <-ticker.C:
+		case <-interrupt:
+			return
+		}
+	}
+}
+
+// followOnce brings dest up to date when name moved past state
+func followOnce(name, dest string, state services.FollowState) (services.FollowState, error) {
+	record, err := services.NewNamesService().Resolve(name)
+	if err != nil {
+		return state, err
+	}
+
+	if record.Hash == state.Hash {
+		return state, nil
+	}
+
+	// a replayed older record must not roll the mirror back
+	if state.Hash != "" && record.Sequence <= state.Sequence {
+		return state, fmt.Errorf("%s Resolved To #%d But %s Mirrors #%d", name, record.Sequence, dest, state.Sequence)
+	}
+
+	next, result, err := services.NewStroageService().Mirror(record.Hash, dest, state.Paths)
+	if err != nil {
+		return state, err
+	}
+
+	next.Name = name
+	next.Sequence = record.Sequence
+	if err := services.WriteFollowState(dest, next); err != nil {
+		return state, err
+	}
+
+	fmt.Printf("%s %s #%d %s: %d fetched (%s, %s reused), %d unchanged, %d removed\n", time.Now().Format("15:04:05"), White(name), record.Sequence, Green(record.Hash), result.Fetched, formatBytes(result.FetchedBytes), formatBytes(result.ReusedBytes), result.Unchanged, result.Removed)
+	return next, nil
+}
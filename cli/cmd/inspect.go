@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/alabianca/snfs/cli/services"
+	"github.com/alabianca/snfs/util"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+}
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect [hash]",
+	Short: "Inspect a share",
+	Args:  cobra.MinimumNArgs(1),
+	Long:  `Print the manifest and file tree of a share without saving its content`,
+	Run: func(cmd *cobra.Command, args []string) {
+		hash := args[0]
+		if util.IsCapability(hash) {
+			capability, err := util.ParseCapability(hash)
+			if err != nil {
+				log.Fatalf("Error %s\n", err)
+			}
+			hash = capability.ID.String()
+		}
+
+		storage := services.NewStroageService()
+		manifest, err := storage.Manifest(hash)
+		if err != nil {
+			log.Fatalf("Error %s\n", err)
+		}
+
+		printManifest(manifest)
+	},
+}
+
+func printManifest(manifest services.ShareManifest) {
+	fmt.Println()
+	fmt.Printf("%s         %s\n", White("Hash:"), Green(manifest.Hash))
+	fmt.Printf("%s      %s\n", White("Creator:"), manifest.Creator)
+	if manifest.Description != "" {
+		fmt.Printf("%s  %s\n", White("Description:"), manifest.Description)
+	}
+	fmt.Printf("%s         %s (Compressed)\n", White("Size:"), formatBytes(manifest.Size))
+	if len(manifest.Ignore) > 0 {
+		fmt.Printf("%s      %s\n", White("Ignored:"), strings.Join(manifest.Ignore, " "))
+	}
+	if manifest.Encrypted {
+		fmt.Printf("%s    %s\n", White("Encrypted:"), "yes, the file listing is only known to holders of the capability link")
+	}
+	fmt.Println()
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(writer, "Mode\tSize\tPath\t")
+	for _, entry := range manifest.Files {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t\n", entryMode(entry), entrySize(entry), entryName(entry))
+	}
+	writer.Flush()
+	fmt.Println()
+}
+
+// entryName indents the entry's base name by its depth so the listing reads as a tree
+func entryName(entry services.ManifestEntry) string {
+	clean := strings.TrimSuffix(entry.Path, "/")
+	depth := strings.Count(clean, "/")
+	name := strings.Repeat("  ", depth) + path.Base(clean)
+
+	switch entry.Type {
+	case "dir":
+		return name + "/"
+	case "symlink", "hardlink":
+		return name + " -> " + entry.Link
+	}
+
+	return name
+}
+
+func entryMode(entry services.ManifestEntry) string {
+	mode := entry.Mode
+	switch entry.Type {
+	case "dir":
+		mode |= os.ModeDir
+	case "symlink":
+		mode |= os.ModeSymlink
+	}
+
+	return mode.String()
+}
+
+func entrySize(entry services.ManifestEntry) string {
+	if entry.Type != "file" {
+		return "-"
+	}
+
+	return formatBytes(entry.Size)
+}
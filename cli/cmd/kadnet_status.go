@@ -28,9 +28,9 @@ var kadnetStatusCmd = &cobra.Command{
 		fmt.Printf("Found %d Contacts\n", len(entries))
 		fmt.Println()
 		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.Debug)
-		fmt.Fprintln(writer, "Bucket Index\tID\tAddress\tPort\t")
+		fmt.Fprintln(writer, "Bucket Index\tID\tAddress\tPort\tVerified\t")
 		for _, i := range entries {
-			fmt.Fprintf(writer, "%d\t%s\t%s\t%d\t\n", i.BucketIndex, i.Contact.ID, i.Contact.IP, i.Contact.Port)
+			fmt.Fprintf(writer, "%d\t%s\t%s\t%d\t%t\t\n", i.BucketIndex, i.Contact.ID, i.Contact.IP, i.Contact.Port, i.Verified)
 		}
 		writer.Flush()
 		fmt.Println()
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alabianca/snfs/cli/services"
+	"github.com/alabianca/snfs/util"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(publishCmd)
+	rootCmd.AddCommand(resolveCmd)
+}
+
+var publishCmd = &cobra.Command{
+	Use:   "publish [label] [hash]",
+	Short: "Point a name at content",
+	Args:  cobra.ExactArgs(2),
+	Long: `Point the name label@<publisher> at the content with hash. The record is signed with the daemon's key
+and every publish gets the next sequence number, so peers resolve the name to the latest hash`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := util.ValidateLabel(args[0]); err != nil {
+			log.Fatal(err)
+		}
+
+		if _, err := util.ParseContentID(args[1]); err != nil {
+			log.Fatal(err)
+		}
+
+		record, err := services.NewNamesService().Publish(args[0], args[1])
+		if err != nil {
+			log.Fatalf("Error %s\n", err)
+		}
+
+		printNameRecord(record)
+		fmt.Printf("To get the content %s %s\n", White("snfs clone"), White(record.Name))
+		fmt.Println()
+	},
+}
+
+var resolveCmd = &cobra.Command{
+	Use:   "resolve [label@publisher]",
+	Short: "Look up the content a name points at",
+	Args:  cobra.ExactArgs(1),
+	Long:  `Print the latest hash published under a name along with its sequence number`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if _, err := util.ParseName(args[0]); err != nil {
+			log.Fatal(err)
+		}
+
+		record, err := services.NewNamesService().Resolve(args[0])
+		if err != nil {
+			log.Fatalf("Error %s\n", err)
+		}
+
+		printNameRecord(record)
+	},
+}
+
+func printNameRecord(record services.NameRecord) {
+	fmt.Println()
+	fmt.Printf("%s     %s\n", White("Name:"), Green(record.Name))
+	fmt.Printf("%s     %s\n", White("Hash:"), Green(record.Hash))
+	fmt.Printf("%s %d\n", White("Sequence:"), record.Sequence)
+	fmt.Printf("%s  %s\n", White("Updated:"), record.Updated.Local().Format(time.RFC1123))
+	fmt.Println()
+}
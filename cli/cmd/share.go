@@ -1,11 +1,11 @@
 package cmd
 
 import (
-	"compress/gzip"
-	"crypto/sha1"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/alabianca/spin"
@@ -17,6 +17,15 @@ import (
 )
 
 var tag string
+var mtime string
+var excludes []string
+var hashAlgorithm string
+var description string
+var encrypt bool
+var allow []string
+var expires time.Duration
+var maxDownloads int
+var replicas int
 
 const (
 	GB = 1000000000 // 1 Gigabytes
@@ -27,6 +36,15 @@ const (
 func init() {
 	rootCmd.AddCommand(shareCmd)
 	shareCmd.Flags().StringVarP(&tag, "tag", "t", "", "Override default file name that is created")
+	shareCmd.Flags().StringVar(&mtime, "mtime", "", "Stamp every archive entry with this unix timestamp so the same content shared from any machine gets the same hash")
+	shareCmd.Flags().StringVar(&hashAlgorithm, "hash", util.DefaultHashAlgorithm, "Content hash algorithm ("+util.HashSHA256+", "+util.HashBLAKE3+" or "+util.HashSHA1+")")
+	shareCmd.Flags().StringVarP(&description, "description", "d", "", "Describe the share. Peers see it with snfs inspect")
+	shareCmd.Flags().BoolVar(&encrypt, "encrypt", false, "Encrypt the share with a random key. Only holders of the printed capability link can read it")
+	shareCmd.Flags().StringArrayVar(&allow, "allow", nil, "Only serve the share to the peer with this node id (repeatable). Requires SNFS_AUTHORITY_URL")
+	shareCmd.Flags().DurationVar(&expires, "expires", 0, "Stop serving the share after this long (e.g. 1h) and remove it from the network")
+	shareCmd.Flags().IntVar(&maxDownloads, "max-downloads", 0, "Stop serving the share after it was downloaded this many times. The share can then only be cloned whole")
+	shareCmd.Flags().IntVar(&replicas, "replicas", 0, "Keep this many other nodes holding the share, so it stays available while this node is offline")
+	shareCmd.Flags().StringArrayVarP(&excludes, "exclude", "e", nil, "Leave out paths matching this .gitignore style pattern (repeatable). Applied after "+util.IgnoreFileName)
 }
 
 var shareCmd = &cobra.Command{
@@ -43,11 +61,42 @@ var shareCmd = &cobra.Command{
 		uploadCntx := args[0]
 		fname = tag
 
-		runShare(uploadCntx, fname)
+		rules, err := ignoreRules(uploadCntx, excludes)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		opts, err := archiveOptions(mtime)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		manifest := services.ShareManifest{
+			Description: description,
+			Ignore:      rules.Rules(),
+		}
+
+		// nothing about the plaintext is handed to the storing node
+		if encrypt {
+			if description != "" {
+				log.Fatal("--description cannot be used with --encrypt")
+			}
+			manifest = services.ShareManifest{Encrypted: true}
+		}
+
+		if expires < 0 || maxDownloads < 0 || replicas < 0 {
+			log.Fatal("--expires, --max-downloads and --replicas must be positive")
+		}
+
+		if replicas > 0 && (len(allow) > 0 || expires > 0 || maxDownloads > 0) {
+			log.Fatal("--replicas cannot be used with --allow, --expires or --max-downloads")
+		}
+
+		runShare(uploadCntx, fname, manifest, append(opts, util.Ignore(rules))...)
 	},
 }
 
-func runShare(uploadCntx, fname string) error {
+func runShare(uploadCntx, fname string, manifest services.ShareManifest, opts ...util.TarballOption) error {
 	_, err := os.Stat(uploadCntx)
 	if err != nil {
 		return err
@@ -58,7 +107,7 @@ func runShare(uploadCntx, fname string) error {
 	res := make(chan services.StoreResult)
 
 	go initSpinnerWithText(spinner, fmt.Sprintf("Sharing -> %s", uploadCntx))
-	go upload(errChan, res, fname, uploadCntx)
+	go upload(errChan, res, fname, uploadCntx, manifest, opts)
 
 	select {
 	case err := <-errChan:
@@ -78,19 +127,17 @@ func runShare(uploadCntx, fname string) error {
 
 }
 
-func upload(errChan chan error, chanSuccess chan services.StoreResult, fname, uploadCntx string) {
+func upload(errChan chan error, chanSuccess chan services.StoreResult, fname, uploadCntx string, manifest services.ShareManifest, opts []util.TarballOption) {
 	storage := services.NewStroageService()
 
-	if fname == "" {
-		if bts, err := hashContents(uploadCntx); err != nil {
-			errChan <- err
-			return
-		} else {
-			fname = fmt.Sprintf("%x", bts)
-		}
+	policy := services.SharePolicy{
+		Allow:        allow,
+		Expires:      expires,
+		MaxDownloads: maxDownloads,
+		Replicas:     replicas,
 	}
 
-	if resultHash, err := storage.Upload(fname, uploadCntx); err != nil {
+	if resultHash, err := storage.Upload(fname, uploadCntx, hashAlgorithm, manifest, policy, opts...); err != nil {
 		errChan <- err
 	} else {
 		chanSuccess <- resultHash
@@ -98,17 +145,39 @@ func upload(errChan chan error, chanSuccess chan services.StoreResult, fname, up
 
 }
 
-func hashContents(uploadCntxt string) ([]byte, error) {
-	hash := sha1.New()
-	gzw := gzip.NewWriter(hash)
-	if _, err := util.WriteTarball(gzw, uploadCntxt); err != nil {
+// ignoreRules combines the share context's ignore file with the patterns passed on the command line.
+// The command line patterns come last so they take precedence. A single file context has no ignore file
+func ignoreRules(uploadCntx string, excludes []string) (*util.IgnoreRules, error) {
+	info, err := os.Stat(uploadCntx)
+	if err != nil {
 		return nil, err
 	}
 
-	gzw.Close()
+	var lines []string
+	if info.IsDir() {
+		lines, err = util.ReadIgnoreFile(filepath.Join(uploadCntx, util.IgnoreFileName))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return util.NewIgnoreRules(append(lines, excludes...))
+}
 
-	return hash.Sum(nil), nil
+// archiveOptions returns the canonical archive options used for every share.
+// A non empty mtime (unix seconds) pins the modification time of all entries
+func archiveOptions(mtime string) ([]util.TarballOption, error) {
+	opts := []util.TarballOption{util.Canonical()}
+	if mtime == "" {
+		return opts, nil
+	}
+
+	sec, err := strconv.ParseInt(mtime, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid mtime %s", mtime)
+	}
 
+	return append(opts, util.FixedModTime(time.Unix(sec, 0))), nil
 }
 
 func printUploadResult(res services.StoreResult) {
@@ -118,7 +187,24 @@ func printUploadResult(res services.StoreResult) {
 	fmt.Printf("%s           %s\n", White("Hash:"), Green(res.Hash))
 	fmt.Printf("%s  %s (Uncompressed)\n", White("Bytes Written:"), Green(formatBytes(res.BytesWritten)))
 	fmt.Printf("%s           %s\n", White("Took:"), Green(res.Took))
+	if res.ExpiresAt != nil {
+		fmt.Printf("%s        %s\n", White("Expires:"), Green(res.ExpiresAt.Local().Format(time.RFC1123)))
+	}
+	if res.MaxDownloads > 0 {
+		fmt.Printf("%s      %s\n", White("Downloads:"), Green(strconv.Itoa(res.MaxDownloads)))
+	}
+	if res.Replicas > 0 {
+		fmt.Printf("%s       %s\n", White("Replicas:"), Green(strconv.Itoa(res.Replicas)))
+	}
 	fmt.Println()
+	if res.Capability != "" {
+		fmt.Printf("%s     %s\n", White("Capability:"), Green(res.Capability))
+		fmt.Println()
+		fmt.Println("The share is encrypted. Anyone with the capability link can read it, keep it secret")
+		fmt.Printf("To get the content %s '%s'\n", White("snfs clone"), White(res.Capability))
+		fmt.Println()
+		return
+	}
 	fmt.Printf("To get the content %s %s\n", White("snfs clone"), White(res.Hash))
 	fmt.Println()
 }
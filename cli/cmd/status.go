@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alabianca/snfs/cli/services"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Get the status of the daemon",
+	Long:  `Prints the transfer limits of the daemon and the transfers it is running`,
+	Run: func(cmd *cobra.Command, args []string) {
+		status, err := services.NewStatusService().Get()
+		if err != nil {
+			log.Fatalf("Error %s\n", err)
+		}
+
+		limits := status.Transfers.Limits
+		fmt.Printf("%s        %s\n", White("Node ID:"), Green(status.NodeID))
+		fmt.Printf("%s   %t\n", White("Certificates:"), status.Certificates)
+		if status.Relay != nil {
+			if status.Relay.Connected {
+				fmt.Printf("%s          %s (objects %s, dht %s)\n", White("Relay:"), status.Relay.Relay, Green(status.Relay.ObjectAddr), Green(status.Relay.DHTAddr))
+			} else {
+				fmt.Printf("%s          %s (not connected)\n", White("Relay:"), status.Relay.Relay)
+			}
+		}
+		if status.Punch != nil {
+			if status.Punch.Registered {
+				fmt.Printf("%s     %s as %s (observed %s, %d punched, %d failed)\n", White("Rendezvous:"), status.Punch.Rendezvous, Green(status.Punch.Name), status.Punch.Observed, status.Punch.Punched, status.Punch.Failed)
+			} else {
+				fmt.Printf("%s     %s (not registered)\n", White("Rendezvous:"), status.Punch.Rendezvous)
+			}
+		}
+		if status.PortMapping != nil {
+			printPortMapping(status.PortMapping)
+		}
+		fmt.Println()
+		fmt.Printf("%s    %s (%s per peer)\n", White("Upload Rate:"), formatRate(limits.UploadRate), formatRate(limits.PeerUploadRate))
+		fmt.Printf("%s  %s (%s per peer)\n", White("Download Rate:"), formatRate(limits.DownloadRate), formatRate(limits.PeerDownloadRate))
+		fmt.Printf("%s      %s (%s per peer)\n", White("Transfers:"), formatCount(limits.MaxTransfers), formatCount(limits.MaxPeerTransfers))
+		fmt.Printf("%s       %s request, %s idle\n", White("Timeouts:"), limits.RequestTimeout, limits.IdleTimeout)
+		fmt.Println()
+		fmt.Printf("%s     %s\n", White("Bytes Sent:"), formatBytes(status.Transfers.BytesSent))
+		fmt.Printf("%s %s\n", White("Bytes Received:"), formatBytes(status.Transfers.BytesReceived))
+		fmt.Printf("%s       %d\n", White("Rejected:"), status.Transfers.Rejected)
+		fmt.Println()
+
+		if status.Relaying != nil {
+			printRelayedNodes(status.Relaying)
+		}
+
+		if len(status.Replicas) > 0 {
+			printReplicas(status.Replicas)
+		}
+
+		fmt.Printf("Running %d Transfer(s)\n", len(status.Transfers.Transfers))
+		if len(status.Transfers.Transfers) == 0 {
+			fmt.Println()
+			return
+		}
+
+		fmt.Println()
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.Debug)
+		fmt.Fprintln(writer, "Direction\tPeer\tHash\tTransferred\tRate\t")
+		for _, t := range status.Transfers.Transfers {
+			elapsed := time.Since(t.Started).Seconds()
+			rate := int64(0)
+			if elapsed > 0 {
+				rate = int64(float64(t.Bytes) / elapsed)
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t\n", t.Direction, t.Peer, t.Name, formatBytes(t.Bytes), formatBytes(rate)+"/s")
+		}
+		writer.Flush()
+		fmt.Println()
+	},
+}
+
+func printRelayedNodes(nodes []services.RelayedNode) {
+	fmt.Printf("Relaying For %d Node(s)\n", len(nodes))
+	fmt.Println()
+	if len(nodes) == 0 {
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.Debug)
+	fmt.Fprintln(writer, "ID\tObjects\tDHT\tSince\t")
+	for _, n := range nodes {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t\n", n.NodeID, n.ObjectAddr, n.DHTAddr, n.Since.Local().Format(time.RFC1123))
+	}
+	writer.Flush()
+	fmt.Println()
+}
+
+func printReplicas(replicas []services.ReplicaStatus) {
+	fmt.Printf("Holding %d Replicated Share(s)\n", len(replicas))
+	fmt.Println()
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.Debug)
+	fmt.Fprintln(writer, "Hash\tOwn\tSlot\tProviders\tChecked\t")
+	for _, r := range replicas {
+		checked := "never"
+		if !r.Checked.IsZero() {
+			checked = r.Checked.Local().Format(time.RFC1123)
+		}
+		fmt.Fprintf(writer, "%s\t%t\t%d\t%d/%d\t%s\t\n", r.Hash, r.Own, r.Slot, r.Providers, r.Replicas+1, checked)
+	}
+	writer.Flush()
+	fmt.Println()
+}
+
+func printPortMapping(pm *services.PortMappingStatus) {
+	if len(pm.Mappings) == 0 || pm.ExternalIP == "" {
+		reason := "no gateway"
+		if pm.Error != "" {
+			reason = pm.Error
+		}
+		fmt.Printf("%s   %s (not mapped: %s)\n", White("Port Mapping:"), pm.Method, reason)
+		return
+	}
+
+	mappings := make([]string, 0, len(pm.Mappings))
+	for _, m := range pm.Mappings {
+		mappings = append(mappings, fmt.Sprintf("%s %s:%d -> %d", m.Protocol, pm.ExternalIP, m.ExternalPort, m.InternalPort))
+	}
+	fmt.Printf("%s   %s (%s)\n", White("Port Mapping:"), Green(strings.Join(mappings, ", ")), pm.Gateway)
+}
+
+func formatRate(bytesPerSecond int64) string {
+	if bytesPerSecond <= 0 {
+		return "unlimited"
+	}
+
+	return formatBytes(bytesPerSecond) + "/s"
+}
+
+func formatCount(n int) string {
+	if n <= 0 {
+		return "unlimited"
+	}
+
+	return strconv.Itoa(n)
+}
@@ -0,0 +1,207 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/alabianca/snfs/cli/services"
+	"github.com/alabianca/snfs/util"
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/spf13/cobra"
+)
+
+// SyncDelay is how long a synced directory has to be quiet before the change is published
+const SyncDelay = 2 * time.Second
+
+var syncLabel string
+var syncExcludes []string
+var syncHash string
+var syncDescription string
+
+func init() {
+	rootCmd.AddCommand(syncCmd)
+	syncCmd.Flags().StringVarP(&syncLabel, "label", "l", "", "Label the directory is published under (defaults to the directory name)")
+	syncCmd.Flags().StringVar(&syncHash, "hash", util.DefaultHashAlgorithm, "Content hash algorithm ("+util.HashSHA256+", "+util.HashBLAKE3+" or "+util.HashSHA1+")")
+	syncCmd.Flags().StringVarP(&syncDescription, "description", "d", "", "Describe the directory. Peers see it with snfs inspect")
+	syncCmd.Flags().StringArrayVarP(&syncExcludes, "exclude", "e", nil, "Leave out paths matching this .gitignore style pattern (repeatable). Applied after "+util.IgnoreFileName)
+}
+
+var syncCmd = &cobra.Command{
+	Use:   "sync [directory]",
+	Short: "Keep sharing a directory as it changes",
+	Args:  cobra.ExactArgs(1),
+	Long: `Share the directory and publish a new version whenever it changes, until interrupted.
+Peers mirror it with snfs follow [label@publisher]`,
+	Run: func(cmd *cobra.Command, args []string) {
+		dir, err := filepath.Abs(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		info, err := os.Stat(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if !info.IsDir() {
+			log.Fatal("Only directories can be synced")
+		}
+
+		label := syncLabel
+		if label == "" {
+			label = filepath.Base(dir)
+		}
+
+		if err := util.ValidateLabel(label); err != nil {
+			log.Fatal(err)
+		}
+
+		if err := runSync(dir, label); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// runSync publishes dir under label and again every time it changes
+func runSync(dir, label string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	defer watcher.Close()
+
+	rules, err := ignoreRules(dir, syncExcludes)
+	if err != nil {
+		return err
+	}
+
+	if err := watchTree(watcher, dir, dir, rules); err != nil {
+		return err
+	}
+
+	record, err := publishVersion(dir, label)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Syncing %s, follow it with %s %s\n", dir, White("snfs follow"), White(record.Name))
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	// a burst of events is published once the directory is quiet again
+	quiet := time.NewTimer(SyncDelay)
+	quiet.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			if ignoredPath(dir, event.Name, rules) {
+				continue
+			}
+
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+					watchTree(watcher, dir, event.Name, rules)
+				}
+			}
+
+			quiet.Reset(SyncDelay)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Printf("[Error] %s\n", err)
+
+		case <-quiet.C:
+			// the ignore file itself may have changed
+			if rules, err = ignoreRules(dir, syncExcludes); err != nil {
+				fmt.Printf("[Error] %s\n", err)
+				continue
+			}
+
+			if _, err := publishVersion(dir, label); err != nil {
+				fmt.Printf("[Error] %s\n", err)
+			}
+
+		case <-interrupt:
+			return nil
+		}
+	}
+}
+
+// publishVersion shares the current content of dir and points label at it
+func publishVersion(dir, label string) (services.NameRecord, error) {
+	rules, err := ignoreRules(dir, syncExcludes)
+	if err != nil {
+		return services.NameRecord{}, err
+	}
+
+	opts, err := archiveOptions("")
+	if err != nil {
+		return services.NameRecord{}, err
+	}
+
+	manifest := services.ShareManifest{
+		Description: syncDescription,
+		Ignore:      rules.Rules(),
+		Feed:        label,
+	}
+
+	storage := services.NewStroageService()
+	res, err := storage.Upload("", dir, syncHash, manifest, services.SharePolicy{}, append(opts, util.Ignore(rules))...)
+	if err != nil {
+		return services.NameRecord{}, err
+	}
+
+	if res.Name == nil {
+		return services.NameRecord{}, fmt.Errorf("Daemon Did Not Publish %s", label)
+	}
+
+	fmt.Printf("%s %s #%d %s (%s)\n", time.Now().Format("15:04:05"), White(res.Name.Name), res.Name.Sequence, Green(res.Hash), formatBytes(res.BytesWritten))
+	return *res.Name, nil
+}
+
+// watchTree watches root and every directory below it that isn't ignored in the synced dir.
+// inotify watches aren't recursive
+func watchTree(watcher *fsnotify.Watcher, dir, root string, rules *util.IgnoreRules) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		if ignoredPath(dir, path, rules) {
+			return filepath.SkipDir
+		}
+
+		return watcher.Add(path)
+	})
+}
+
+// ignoredPath reports whether path below dir is left out of the share
+func ignoredPath(dir, path string, rules *util.IgnoreRules) bool {
+	name, err := filepath.Rel(dir, path)
+	if err != nil || name == "." {
+		return false
+	}
+
+	info, err := os.Lstat(path)
+	isDir := err == nil && info.IsDir()
+
+	return rules.Match(filepath.ToSlash(name), isDir)
+}
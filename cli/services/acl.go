@@ -0,0 +1,74 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+type aclBody struct {
+	Peers []string `json:"peers"`
+}
+
+type aclResponse struct {
+	Status  int     `json:"status"`
+	Message string  `json:"message"`
+	ACL     aclBody `json:"data"`
+}
+
+// ACLService edits the peers a share is restricted to
+type ACLService struct {
+	api *RestAPI
+}
+
+func NewACLService() *ACLService {
+	return &ACLService{
+		api: NewRestAPI(getBaseURL()),
+	}
+}
+
+// List returns the peers the share with hash is restricted to. An empty list means the share is public
+func (a *ACLService) List(hash string) ([]string, error) {
+	return a.do(a.api.Get("v1/storage/acl/"+hash, nil))
+}
+
+// Set replaces the ACL of the share with hash
+func (a *ACLService) Set(hash string, peers []string) ([]string, error) {
+	bts, err := json.Marshal(&aclBody{Peers: peers})
+	if err != nil {
+		return nil, err
+	}
+
+	return a.do(a.api.Put("v1/storage/acl/"+hash, "application/json", bytes.NewBuffer(bts)))
+}
+
+// Add allows peer to fetch the share with hash
+func (a *ACLService) Add(hash, peer string) ([]string, error) {
+	return a.do(a.api.Post("v1/storage/acl/"+hash+"/"+url.PathEscape(peer), "application/json", nil))
+}
+
+// Remove takes peer off the ACL of the share with hash
+func (a *ACLService) Remove(hash, peer string) ([]string, error) {
+	return a.do(a.api.Delete("v1/storage/acl/" + hash + "/" + url.PathEscape(peer)))
+}
+
+func (a *ACLService) do(res *http.Response, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	var aclRes aclResponse
+	if err := decode(res.Body, &aclRes); err != nil {
+		return nil, err
+	}
+
+	if aclRes.Status != http.StatusOK {
+		return nil, errors.New(aclRes.Message)
+	}
+
+	return aclRes.ACL.Peers, nil
+}
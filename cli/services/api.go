@@ -39,6 +39,26 @@ func (r *RestAPI) Get(url string, body io.Reader) (*http.Response, error) {
 	return r.httpClient.Do(req)
 }
 
+func (r *RestAPI) Put(url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest("PUT", r.getURL(url), body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+
+	return r.httpClient.Do(req)
+}
+
+func (r *RestAPI) Delete(url string) (*http.Response, error) {
+	req, err := http.NewRequest("DELETE", r.getURL(url), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.httpClient.Do(req)
+}
+
 func (r *RestAPI) getURL(url string) string {
 	return r.baseURL + url
 }
@@ -0,0 +1,313 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/alabianca/snfs/util"
+)
+
+// DeltaResult sums up how much of a clone was fetched and how much was reused from local copies
+type DeltaResult struct {
+	// Size is the size of the files written
+	Size int64
+	// Fetched is the size of the content transferred
+	Fetched int64
+	// Reused is the size of the content copied from local files
+	Reused int64
+}
+
+// delta assembles files from the chunks of local copies
+type delta struct {
+	sources []string
+	index   *chunkIndex
+	result  DeltaResult
+}
+
+// chunkIndex locates local files and chunks by hash
+type chunkIndex struct {
+	algorithm string
+	files     map[string]string
+	chunks    map[string]chunkLocation
+}
+
+type chunkLocation struct {
+	path   string
+	offset int64
+}
+
+// DownloadDelta clones the entries of the share with hash that are at or below one of paths into dest.
+// Files and chunks found in the local files below sources (previous copies of the share, or dest itself)
+// are copied instead of fetched. An empty paths selects the whole share
+func (s *StorageService) DownloadDelta(hash, dest string, paths, sources []string, opts ...util.ExtractOption) (DeltaResult, error) {
+	d := &delta{sources: sources}
+	err := s.extractEntries(hash, dest, paths, false, d, opts)
+
+	return d.result, err
+}
+
+// assembleFile writes the content of entry into tmp. Chunks available locally are copied and
+// the missing ones are fetched in one request. Every chunk and the whole file are verified
+func (s *StorageService) assembleFile(tmp *os.File, hash string, entry ManifestEntry, d *delta) (int64, error) {
+	expected, err := util.ParseContentID(entry.Hash)
+	if err != nil {
+		return 0, err
+	}
+
+	index, err := d.lookup(expected.Algorithm)
+	if err != nil {
+		return 0, err
+	}
+
+	if local, ok := index.files[entry.Hash]; ok {
+		if size, err := copyLocal(tmp, local, expected); err == nil {
+			d.result.Size += size
+			d.result.Reused += size
+			return size, nil
+		}
+
+		// the local copy changed since it was indexed
+		if err := resetFile(tmp); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(entry.Chunks) == 0 {
+		size, err := s.fetchFile(tmp, hash, entry)
+		d.result.Size += size
+		d.result.Fetched += size
+		return size, err
+	}
+
+	offsets := make([]int64, len(entry.Chunks))
+	missing := make([]int, 0)
+	var offset, reused int64
+	for i, chunk := range entry.Chunks {
+		offsets[i] = offset
+		offset += chunk.Size
+
+		location, ok := index.chunks[chunk.Hash]
+		if ok && copyChunk(tmp, offsets[i], location, chunk, expected.Algorithm) == nil {
+			reused += chunk.Size
+			continue
+		}
+
+		missing = append(missing, i)
+	}
+
+	if len(missing) > 0 {
+		if err := s.fetchChunks(tmp, hash, entry, missing, offsets, expected.Algorithm); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := verifyFile(tmp, expected); err != nil {
+		return 0, errors.New("Hash does not match for " + entry.Path)
+	}
+
+	d.result.Size += offset
+	d.result.Reused += reused
+	d.result.Fetched += offset - reused
+
+	return offset, nil
+}
+
+// fetchChunks requests the missing chunks of entry and writes each one at its offset in tmp
+func (s *StorageService) fetchChunks(tmp *os.File, hash string, entry ManifestEntry, missing []int, offsets []int64, algorithm string) error {
+	res, err := s.getFile(hash, entry.Path, missing)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	buf := make([]byte, util.MaxChunkSize)
+	for _, i := range missing {
+		chunk := entry.Chunks[i]
+		if chunk.Size > util.MaxChunkSize {
+			return errors.New("Chunk Too Large In " + entry.Path)
+		}
+
+		data := buf[:chunk.Size]
+		if _, err := io.ReadFull(res.Body, data); err != nil {
+			return err
+		}
+
+		if sum, err := hashBytes(algorithm, data); err != nil || sum != chunk.Hash {
+			return errors.New("Hash does not match for a chunk of " + entry.Path)
+		}
+
+		if _, err := tmp.WriteAt(data, offsets[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lookup indexes the sources the first time it is called
+func (d *delta) lookup(algorithm string) (*chunkIndex, error) {
+	if d.index != nil && d.index.algorithm == algorithm {
+		return d.index, nil
+	}
+
+	index, err := indexSources(d.sources, algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	d.index = index
+	return index, nil
+}
+
+// indexSources hashes every regular file below sources and each of its chunks with algorithm.
+// Sources that don't exist and files that can't be read are skipped
+func indexSources(sources []string, algorithm string) (*chunkIndex, error) {
+	if _, err := util.NewHasher(algorithm); err != nil {
+		return nil, err
+	}
+
+	index := &chunkIndex{
+		algorithm: algorithm,
+		files:     make(map[string]string),
+		chunks:    make(map[string]chunkLocation),
+	}
+
+	for _, source := range sources {
+		filepath.Walk(source, func(name string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+				return nil
+			}
+
+			index.add(name)
+			return nil
+		})
+	}
+
+	return index, nil
+}
+
+// add indexes the file at name
+func (c *chunkIndex) add(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	hasher, _ := util.NewHasher(c.algorithm)
+	var offset int64
+	err = util.SplitChunks(file, func(data []byte) error {
+		hasher.Write(data)
+		sum, err := hashBytes(c.algorithm, data)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := c.chunks[sum]; !ok {
+			c.chunks[sum] = chunkLocation{path: name, offset: offset}
+		}
+
+		offset += int64(len(data))
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	id, err := util.NewContentID(c.algorithm, hasher.Sum(nil))
+	if err != nil {
+		return err
+	}
+
+	c.files[id.String()] = name
+	return nil
+}
+
+// copyLocal copies the local file at name into writer and verifies it against expected
+func copyLocal(writer io.Writer, name string, expected util.ContentID) (int64, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	hasher, err := util.NewHasher(expected.Algorithm)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := io.Copy(io.MultiWriter(writer, hasher), file)
+	if err != nil {
+		return 0, err
+	}
+
+	sum, err := util.NewContentID(expected.Algorithm, hasher.Sum(nil))
+	if err != nil || !sum.Equal(expected) {
+		return 0, errors.New("Hash does not match for " + name)
+	}
+
+	return size, nil
+}
+
+// copyChunk copies the chunk at location into tmp at offset after verifying it
+func copyChunk(tmp *os.File, offset int64, location chunkLocation, chunk ManifestChunk, algorithm string) error {
+	if chunk.Size > util.MaxChunkSize {
+		return errors.New("Chunk Too Large")
+	}
+
+	file, err := os.Open(location.path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	data := make([]byte, chunk.Size)
+	if _, err := file.ReadAt(data, location.offset); err != nil {
+		return err
+	}
+
+	if sum, err := hashBytes(algorithm, data); err != nil || sum != chunk.Hash {
+		return errors.New("Hash does not match for " + location.path)
+	}
+
+	_, err = tmp.WriteAt(data, offset)
+	return err
+}
+
+// verifyFile checks the content of file against expected
+func verifyFile(file *os.File, expected util.ContentID) error {
+	_, err := copyLocal(ioutil.Discard, file.Name(), expected)
+	return err
+}
+
+func resetFile(file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+
+	_, err := file.Seek(0, io.SeekStart)
+	return err
+}
+
+func hashBytes(algorithm string, data []byte) (string, error) {
+	hasher, err := util.NewHasher(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	hasher.Write(data)
+	id, err := util.NewContentID(algorithm, hasher.Sum(nil))
+	if err != nil {
+		return "", err
+	}
+
+	return id.String(), nil
+}
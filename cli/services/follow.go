@@ -0,0 +1,248 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alabianca/snfs/util"
+)
+
+// FollowStateFile keeps what snfs follow last mirrored into a directory
+const FollowStateFile = ".snfs-follow"
+
+// FollowState is the version of a name mirrored into a directory and the paths it consists of
+type FollowState struct {
+	Name     string   `json:"name"`
+	Hash     string   `json:"hash"`
+	Sequence uint64   `json:"sequence"`
+	Paths    []string `json:"paths"`
+}
+
+// MirrorResult sums up what bringing a directory up to date with a version took.
+// ReusedBytes is the content of changed files that was copied from their previous versions
+type MirrorResult struct {
+	Fetched      int
+	FetchedBytes int64
+	ReusedBytes  int64
+	Unchanged    int
+	Removed      int
+}
+
+// Mirror brings dest up to date with the share with hash. Only files whose content differs from the
+// local copy are fetched, reusing the chunks of their previous versions and of removed files, and the
+// paths of the previous version that are gone from this one are removed
+func (s *StorageService) Mirror(hash, dest string, previous []string) (FollowState, MirrorResult, error) {
+	var result MirrorResult
+	manifest, err := s.Manifest(hash)
+	if err != nil {
+		return FollowState{}, result, err
+	}
+
+	if manifest.Encrypted {
+		return FollowState{}, result, errors.New("Encrypted Shares Can Not Be Followed")
+	}
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return FollowState{}, result, err
+	}
+
+	state := FollowState{Hash: hash, Paths: make([]string, 0, len(manifest.Files))}
+	current := make(map[string]bool)
+	changed := make([]string, 0)
+	sources := make([]string, 0)
+	for _, entry := range manifest.Files {
+		name := strings.TrimSuffix(entry.Path, "/")
+		target, err := localPath(dest, name)
+		if err != nil {
+			return FollowState{}, result, err
+		}
+
+		state.Paths = append(state.Paths, name)
+		current[name] = true
+
+		switch entry.Type {
+		case "dir":
+			if err := os.MkdirAll(target, entry.Mode.Perm()); err != nil {
+				return FollowState{}, result, err
+			}
+			continue
+
+		case "file":
+			if same, err := sameFile(target, entry); err != nil || !same {
+				changed = append(changed, name)
+				sources = append(sources, target)
+				continue
+			}
+
+			// a mode change doesn't need the content
+			if info, err := os.Lstat(target); err == nil && info.Mode().Perm() != entry.Mode.Perm() {
+				os.Chmod(target, entry.Mode.Perm())
+			}
+
+		case "symlink":
+			if link, err := os.Readlink(target); err != nil || link != filepath.FromSlash(entry.Link) {
+				changed = append(changed, name)
+				continue
+			}
+
+		default:
+			if _, err := os.Lstat(target); err != nil {
+				changed = append(changed, name)
+				continue
+			}
+		}
+
+		result.Unchanged++
+	}
+
+	if len(changed) > 0 {
+		for _, name := range previous {
+			if !current[name] {
+				if target, err := localPath(dest, name); err == nil {
+					sources = append(sources, target)
+				}
+			}
+		}
+
+		delta, err := s.DownloadDelta(hash, dest, changed, sources, util.OnConflict(util.ConflictOverwrite))
+		if err != nil {
+			return FollowState{}, result, err
+		}
+
+		result.FetchedBytes = delta.Fetched
+		result.ReusedBytes = delta.Reused
+	}
+
+	result.Fetched = len(changed)
+	result.Removed = removeStale(dest, previous, current)
+
+	return state, result, nil
+}
+
+// ReadFollowState reads the state snfs follow left in dest. A directory that was never followed has an empty state
+func ReadFollowState(dest string) (FollowState, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(dest, FollowStateFile))
+	if os.IsNotExist(err) {
+		return FollowState{}, nil
+	}
+
+	if err != nil {
+		return FollowState{}, err
+	}
+
+	var state FollowState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return FollowState{}, err
+	}
+
+	return state, nil
+}
+
+// WriteFollowState records in dest which version of the name it mirrors
+func WriteFollowState(dest string, state FollowState) error {
+	raw, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dest, FollowStateFile), raw, 0644)
+}
+
+// sameFile reports whether the file at target has the content entry lists
+func sameFile(target string, entry ManifestEntry) (bool, error) {
+	info, err := os.Lstat(target)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != entry.Size {
+		return false, err
+	}
+
+	expected, err := util.ParseContentID(entry.Hash)
+	if err != nil {
+		return false, err
+	}
+
+	hasher, err := util.NewHasher(expected.Algorithm)
+	if err != nil {
+		return false, err
+	}
+
+	file, err := os.Open(target)
+	if err != nil {
+		return false, err
+	}
+
+	defer file.Close()
+
+	if _, err := io.Copy(hasher, file); err != nil {
+		return false, err
+	}
+
+	sum, err := util.NewContentID(expected.Algorithm, hasher.Sum(nil))
+	if err != nil {
+		return false, err
+	}
+
+	return sum.Equal(expected), nil
+}
+
+// removeStale removes the paths of the previous version that are not in current, deepest first
+// so directories are empty by the time they are removed. Directories that still hold files are kept
+func removeStale(dest string, previous []string, current map[string]bool) int {
+	stale := make([]string, 0)
+	for _, name := range previous {
+		if !current[name] {
+			stale = append(stale, name)
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(stale)))
+
+	removed := 0
+	for _, name := range stale {
+		target, err := localPath(dest, name)
+		if err != nil {
+			continue
+		}
+
+		if err := os.Remove(target); err == nil {
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// localPath maps the share path name onto dest. Like extraction it refuses paths
+// outside of dest and paths below a symlink
+func localPath(dest, name string) (string, error) {
+	name = filepath.FromSlash(name)
+	clean := filepath.Clean(name)
+	if filepath.IsAbs(name) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", errors.New("Invalid Path " + name)
+	}
+
+	current := dest
+	parts := strings.Split(clean, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			break
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", util.ErrSymlinkTraversal
+		}
+	}
+
+	return filepath.Join(dest, clean), nil
+}
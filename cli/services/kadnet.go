@@ -18,8 +18,9 @@ type KadnetStatusResponse struct {
 }
 
 type RoutingTableEntry struct {
-	BucketIndex int        `json:"bucketIndex"`
+	BucketIndex int           `json:"bucketIndex"`
 	Contact     gokad.Contact `json:"contact"`
+	Verified    bool          `json:"verified"`
 }
 
 type KadnetService struct {
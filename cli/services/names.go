@@ -0,0 +1,77 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// NameRecord points a name (<label>@<publisher>) at the latest content published under it
+type NameRecord struct {
+	Name     string    `json:"name"`
+	Hash     string    `json:"hash"`
+	Sequence uint64    `json:"sequence"`
+	Updated  time.Time `json:"updated"`
+}
+
+type nameResponse struct {
+	Status  int        `json:"status"`
+	Message string     `json:"message"`
+	Record  NameRecord `json:"data"`
+}
+
+type NamesService struct {
+	api *RestAPI
+}
+
+func NewNamesService() *NamesService {
+	return &NamesService{
+		api: NewRestAPI(getBaseURL()),
+	}
+}
+
+// Publish points label at the content with hash. The record is signed with the daemon's key,
+// the returned record carries the full name peers resolve
+func (n *NamesService) Publish(label, hash string) (NameRecord, error) {
+	body, err := json.Marshal(map[string]string{"hash": hash})
+	if err != nil {
+		return NameRecord{}, err
+	}
+
+	res, err := n.api.Post("v1/names/"+url.PathEscape(label), "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return NameRecord{}, err
+	}
+
+	defer res.Body.Close()
+
+	return decodeName(res, http.StatusCreated)
+}
+
+// Resolve looks up the content name points at
+func (n *NamesService) Resolve(name string) (NameRecord, error) {
+	res, err := n.api.Get("v1/names/"+url.PathEscape(name), nil)
+	if err != nil {
+		return NameRecord{}, err
+	}
+
+	defer res.Body.Close()
+
+	return decodeName(res, http.StatusOK)
+}
+
+func decodeName(res *http.Response, expected int) (NameRecord, error) {
+	var nameRes nameResponse
+	if err := decode(res.Body, &nameRes); err != nil {
+		return NameRecord{}, err
+	}
+
+	if nameRes.Status != expected {
+		return NameRecord{}, errors.New(nameRes.Message)
+	}
+
+	return nameRes.Record, nil
+}
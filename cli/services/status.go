@@ -0,0 +1,128 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+type TransferLimits struct {
+	UploadRate       int64         `json:"uploadRate"`
+	PeerUploadRate   int64         `json:"peerUploadRate"`
+	DownloadRate     int64         `json:"downloadRate"`
+	PeerDownloadRate int64         `json:"peerDownloadRate"`
+	MaxTransfers     int           `json:"maxTransfers"`
+	MaxPeerTransfers int           `json:"maxPeerTransfers"`
+	RequestTimeout   time.Duration `json:"requestTimeout"`
+	IdleTimeout      time.Duration `json:"idleTimeout"`
+}
+
+type Transfer struct {
+	Direction string    `json:"direction"`
+	Peer      string    `json:"peer"`
+	Name      string    `json:"name"`
+	Bytes     int64     `json:"bytes"`
+	Started   time.Time `json:"started"`
+}
+
+type TransferStatus struct {
+	Limits        TransferLimits `json:"limits"`
+	Transfers     []Transfer     `json:"transfers"`
+	BytesSent     int64          `json:"bytesSent"`
+	BytesReceived int64          `json:"bytesReceived"`
+	Rejected      int64          `json:"rejected"`
+}
+
+type RelayStatus struct {
+	Relay      string `json:"relay"`
+	Connected  bool   `json:"connected"`
+	ObjectAddr string `json:"objectAddr"`
+	DHTAddr    string `json:"dhtAddr"`
+}
+
+type RelayedNode struct {
+	NodeID     string    `json:"nodeId"`
+	ObjectAddr string    `json:"objectAddr"`
+	DHTAddr    string    `json:"dhtAddr"`
+	Since      time.Time `json:"since"`
+}
+
+type PunchStatus struct {
+	Rendezvous string `json:"rendezvous"`
+	Registered bool   `json:"registered"`
+	Name       string `json:"name"`
+	Observed   string `json:"observed"`
+	Punched    int64  `json:"punched"`
+	Failed     int64  `json:"failed"`
+}
+
+type PortMapping struct {
+	Protocol     string `json:"protocol"`
+	InternalPort int    `json:"internalPort"`
+	ExternalPort int    `json:"externalPort"`
+}
+
+type PortMappingStatus struct {
+	Method     string        `json:"method"`
+	Gateway    string        `json:"gateway"`
+	ExternalIP string        `json:"externalIp"`
+	Mappings   []PortMapping `json:"mappings"`
+	Error      string        `json:"error"`
+}
+
+type ReplicaStatus struct {
+	Hash      string    `json:"hash"`
+	Own       bool      `json:"own"`
+	Slot      int       `json:"slot"`
+	Replicas  int       `json:"replicas"`
+	Providers int       `json:"providers"`
+	Checked   time.Time `json:"checked"`
+}
+
+type DaemonStatus struct {
+	NodeID       string             `json:"nodeId"`
+	Certificates bool               `json:"certificates"`
+	Transfers    TransferStatus     `json:"transfers"`
+	Relay        *RelayStatus       `json:"relay"`
+	Relaying     []RelayedNode      `json:"relaying"`
+	Punch        *PunchStatus       `json:"punch"`
+	PortMapping  *PortMappingStatus `json:"portMapping"`
+	Replicas     []ReplicaStatus    `json:"replicas"`
+}
+
+type statusResponse struct {
+	Status  int          `json:"status"`
+	Message string       `json:"message"`
+	Daemon  DaemonStatus `json:"data"`
+}
+
+// StatusService reports the state of the daemon
+type StatusService struct {
+	api *RestAPI
+}
+
+func NewStatusService() *StatusService {
+	return &StatusService{
+		api: NewRestAPI(getBaseURL()),
+	}
+}
+
+func (s *StatusService) Get() (DaemonStatus, error) {
+	res, err := s.api.Get("v1/status", nil)
+	if err != nil {
+		return DaemonStatus{}, err
+	}
+
+	defer res.Body.Close()
+
+	var data statusResponse
+	if err := decode(res.Body, &data); err != nil {
+		return DaemonStatus{}, err
+	}
+
+	if data.Status != http.StatusOK {
+		return DaemonStatus{}, errors.New(data.Message)
+	}
+
+	return data.Daemon, nil
+}
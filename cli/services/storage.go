@@ -1,15 +1,20 @@
 package services
 
 import (
+	"archive/tar"
 	"bytes"
 	"compress/gzip"
-	"crypto/sha1"
+	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/alabianca/snfs/util"
@@ -22,9 +27,65 @@ type storageResponse struct {
 }
 
 type StoreResult struct {
-	Hash         string `json:"hash"`
-	BytesWritten int64  `json:"bytesWritten"`
-	Took         time.Duration
+	Hash         string     `json:"hash"`
+	BytesWritten int64      `json:"bytesWritten"`
+	ExpiresAt    *time.Time `json:"expiresAt"`
+	MaxDownloads int        `json:"maxDownloads"`
+	Replicas     int        `json:"replicas"`
+	// Name is set when the share was published as the latest version of a synced directory
+	Name *NameRecord `json:"name"`
+	Took time.Duration
+	// Capability is the link to an encrypted share. It never leaves the cli
+	Capability string `json:"-"`
+}
+
+// ShareManifest describes a share. The uploader fills in Description and Ignore,
+// the storing node adds the file listing. Encrypted shares have no file listing.
+// Setting Feed publishes the share as the latest version of the synced directory with that label
+type ShareManifest struct {
+	Hash        string          `json:"hash"`
+	Creator     string          `json:"creator"`
+	Description string          `json:"description"`
+	Size        int64           `json:"size"`
+	Files       []ManifestEntry `json:"files"`
+	Ignore      []string        `json:"ignore"`
+	Encrypted   bool            `json:"encrypted"`
+	Feed        string          `json:"feed,omitempty"`
+}
+
+// SharePolicy controls who may fetch a share and for how long. Zero values mean no restriction
+type SharePolicy struct {
+	// Allow restricts the share to these peers (node ids or instance names)
+	Allow []string
+	// Expires is how long the share is served
+	Expires time.Duration
+	// MaxDownloads is how often the share is served
+	MaxDownloads int
+	// Replicas is how many other nodes are kept holding the share
+	Replicas int
+}
+
+type ManifestEntry struct {
+	Path    string          `json:"path"`
+	Type    string          `json:"type"`
+	Size    int64           `json:"size"`
+	Mode    os.FileMode     `json:"mode"`
+	ModTime time.Time       `json:"modTime"`
+	Hash    string          `json:"hash"`
+	Link    string          `json:"link"`
+	Chunks  []ManifestChunk `json:"chunks"`
+}
+
+// ManifestChunk is a content defined chunk of a file, listed for files larger than one chunk
+type ManifestChunk struct {
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+type manifestResponse struct {
+	Status   int           `json:"status"`
+	Message  string        `json:"message"`
+	Manifest ShareManifest `json:"data"`
 }
 
 type StorageService struct {
@@ -37,30 +98,81 @@ func NewStroageService() *StorageService {
 	}
 }
 
-func (s *StorageService) Upload(fname, uploadCntx string) (StoreResult, error) {
-	// 1. create destination writer
+// Upload archives uploadCntx and stores it with the daemon. The archive is hashed with algorithm while it is
+// built, so when fname is empty the content id is used as name without a second pass.
+// When manifest.Encrypted is set the archive is encrypted with a random key before it leaves the cli,
+// the content id names the ciphertext and the result carries the capability link.
+// The storing node enforces policy
+func (s *StorageService) Upload(fname, uploadCntx, algorithm string, manifest ShareManifest, policy SharePolicy, opts ...util.TarballOption) (StoreResult, error) {
+	// 1. create tarball. It is spooled to a temporary file because its hash
+	// names the upload before the body is sent
 	startTime := time.Now()
-	bodyBuf := new(bytes.Buffer)
-	bodyWriter := multipart.NewWriter(bodyBuf)
-	fileWriter, err := bodyWriter.CreateFormFile("upload", fname)
+	archive, err := ioutil.TempFile("", "snfs-share")
+	if err != nil {
+		return StoreResult{}, err
+	}
+
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	hasher, err := util.NewHasher(algorithm)
+	if err != nil {
+		return StoreResult{}, err
+	}
+
+	var key []byte
+	var sink io.WriteCloser = nopWriteCloser{io.MultiWriter(archive, hasher)}
+	if manifest.Encrypted {
+		if key, err = util.NewEncryptionKey(); err != nil {
+			return StoreResult{}, err
+		}
+
+		if sink, err = util.NewEncryptWriter(io.MultiWriter(archive, hasher), key); err != nil {
+			return StoreResult{}, err
+		}
+	}
+
+	gzw := gzip.NewWriter(sink)
+	if _, err := util.WriteTarball(gzw, uploadCntx, opts...); err != nil {
+		return StoreResult{}, err
+	}
+
+	if err := gzw.Close(); err != nil {
+		return StoreResult{}, err
+	}
+
+	if err := sink.Close(); err != nil {
+		return StoreResult{}, err
+	}
+
+	id, err := util.NewContentID(algorithm, hasher.Sum(nil))
 	if err != nil {
 		return StoreResult{}, err
 	}
-	// 2. create tarball
-	gzw := gzip.NewWriter(fileWriter)
-	if _, err := util.WriteTarball(gzw, uploadCntx); err != nil {
+
+	if fname == "" {
+		fname = id.String()
+	}
+
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
 		return StoreResult{}, err
 	}
 
-	gzw.Close()
+	// 2. stream the form to the daemon while it is written
+	body, pw := io.Pipe()
+	defer body.Close()
+
+	bodyWriter := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeUploadForm(bodyWriter, fname, algorithm, manifest, policy, archive))
+	}()
 
 	// 3. Upload the file
 	contentType := bodyWriter.FormDataContentType()
 	url := "v1/storage/fname/" + fname
-	bodyWriter.Close()
 
 	// 4. Read response
-	res, err := s.api.Post(url, contentType, bodyBuf)
+	res, err := s.api.Post(url, contentType, body)
 	if err != nil {
 		return StoreResult{}, err
 	}
@@ -72,46 +184,422 @@ func (s *StorageService) Upload(fname, uploadCntx string) (StoreResult, error) {
 		return StoreResult{}, err
 	}
 
+	if storeRes.Status != http.StatusCreated {
+		return StoreResult{}, errors.New(storeRes.Message)
+	}
+
 	endTime := time.Now()
 	storeRes.Content.Took = endTime.Sub(startTime)
-
+	if manifest.Encrypted {
+		storeRes.Content.Capability = util.Capability{ID: id, Key: key}.String()
+	}
 
 	return storeRes.Content, nil
 
 }
 
-func (s *StorageService) Download(hash string) error {
-	url := "v1/storage/fname/" + hash
-	res, err := s.api.Get(url, nil)
+// writeUploadForm writes the fields of a share and its archive to bodyWriter and closes it
+func writeUploadForm(bodyWriter *multipart.Writer, fname, algorithm string, manifest ShareManifest, policy SharePolicy, archive io.Reader) error {
+	manifestBytes, err := json.Marshal(&manifest)
 	if err != nil {
 		return err
 	}
 
+	if err := bodyWriter.WriteField("manifest", string(manifestBytes)); err != nil {
+		return err
+	}
+
+	if err := bodyWriter.WriteField("algorithm", algorithm); err != nil {
+		return err
+	}
+
+	for _, peer := range policy.Allow {
+		if err := bodyWriter.WriteField("allow", peer); err != nil {
+			return err
+		}
+	}
+
+	if policy.Expires > 0 {
+		if err := bodyWriter.WriteField("expires", policy.Expires.String()); err != nil {
+			return err
+		}
+	}
+
+	if policy.MaxDownloads > 0 {
+		if err := bodyWriter.WriteField("max_downloads", strconv.Itoa(policy.MaxDownloads)); err != nil {
+			return err
+		}
+	}
+
+	if policy.Replicas > 0 {
+		if err := bodyWriter.WriteField("replicas", strconv.Itoa(policy.Replicas)); err != nil {
+			return err
+		}
+	}
+
+	fileWriter, err := bodyWriter.CreateFormFile("upload", fname)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(fileWriter, archive); err != nil {
+		return err
+	}
+
+	return bodyWriter.Close()
+}
+
+// Manifest fetches the manifest of the share with hash. The daemon checks the manifests of remote shares before listing them
+func (s *StorageService) Manifest(hash string) (ShareManifest, error) {
+	res, err := s.api.Get("v1/storage/manifest/"+hash, nil)
+	if err != nil {
+		return ShareManifest{}, err
+	}
+
+	defer res.Body.Close()
+
+	var manifestRes manifestResponse
+	if err := decode(res.Body, &manifestRes); err != nil {
+		return ShareManifest{}, err
+	}
+
+	if manifestRes.Status != http.StatusOK {
+		return ShareManifest{}, errors.New(manifestRes.Message)
+	}
+
+	return manifestRes.Manifest, nil
+}
+
+// Download clones the share with hash into dest
+func (s *StorageService) Download(hash, dest string, opts ...util.ExtractOption) error {
+	id, err := util.ParseContentID(hash)
+	if err != nil {
+		return err
+	}
+
+	bodyBytes, err := s.fetch(id)
+	if err != nil {
+		return err
+	}
+
+	gzr, err := gzip.NewReader(bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		return err
+	}
+
+	return util.ReadTarball(gzr, dest, opts...)
+}
+
+// DownloadEncrypted clones the encrypted share capability grants access to into dest.
+// The ciphertext is verified against the content id before it is decrypted
+func (s *StorageService) DownloadEncrypted(capability util.Capability, dest string, opts ...util.ExtractOption) error {
+	bodyBytes, err := s.fetch(capability.ID)
+	if err != nil {
+		return err
+	}
+
+	plain, err := util.NewDecryptReader(bytes.NewBuffer(bodyBytes), capability.Key)
+	if err != nil {
+		return err
+	}
+
+	gzr, err := gzip.NewReader(plain)
+	if err != nil {
+		return err
+	}
+
+	return util.ReadTarball(gzr, dest, opts...)
+}
+
+// fetch downloads the object with id and verifies its hash
+func (s *StorageService) fetch(id util.ContentID) ([]byte, error) {
+	res, err := s.api.Get("v1/storage/fname/"+id.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return errors.New("Request Failed")
+		return nil, responseError(res, "Request Failed")
 	}
 
 	bodyBytes, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher, err := util.NewHasher(id.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher.Write(bodyBytes)
+	sum, err := util.NewContentID(id.Algorithm, hasher.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	if !sum.Equal(id) {
+		return nil, errors.New("Hash does not match")
+	}
+
+	return bodyBytes, nil
+}
+
+// DownloadPaths clones only the entries of the share with hash that are at or below one of paths into dest.
+// Every file is fetched on its own and verified against the hash listed in the share's manifest
+func (s *StorageService) DownloadPaths(hash, dest string, paths []string, opts ...util.ExtractOption) error {
+	return s.extractEntries(hash, dest, paths, false, nil, opts)
+}
+
+// Plan reports through the util.OnAction option what cloning the share with hash into dest would write.
+// Nothing is written to dest. An empty paths selects the whole share
+func (s *StorageService) Plan(hash, dest string, paths []string, opts ...util.ExtractOption) error {
+	return s.extractEntries(hash, dest, paths, true, nil, append(opts, util.DryRun()))
+}
+
+// extractEntries fetches the selected entries of the share with hash into dest. With delta set
+// file content is assembled from local chunks where possible
+func (s *StorageService) extractEntries(hash, dest string, paths []string, dryRun bool, delta *delta, opts []util.ExtractOption) error {
+	manifest, err := s.Manifest(hash)
 	if err != nil {
 		return err
 	}
 
-	hasher := sha1.New()
-	io.Copy(hasher, bytes.NewBuffer(bodyBytes))
+	if manifest.Encrypted {
+		return errors.New("Encrypted Shares Can Only Be Cloned Whole")
+	}
+
+	entries := manifest.Files
+	if len(paths) > 0 {
+		entries = selectEntries(manifest.Files, paths)
+	}
+
+	if len(entries) == 0 {
+		return errors.New("No Files Match " + strings.Join(paths, ", "))
+	}
+
+	files := make(map[string]ManifestEntry)
+	for _, entry := range manifest.Files {
+		files[entry.Path] = entry
+	}
+
+	pr, pw := io.Pipe()
+	extracted := make(chan error, 1)
+	go func() {
+		err := util.ReadTarball(pr, dest, opts...)
+		pr.CloseWithError(err)
+		extracted <- err
+	}()
+
+	err = s.writeEntries(pw, hash, entries, files, dryRun, delta)
+	pw.CloseWithError(err)
+	if extractErr := <-extracted; err == nil {
+		err = extractErr
+	}
+
+	return err
+}
+
+// writeEntries writes the selected entries as a tarball into writer, fetching file content from the network.
+// A dry run only writes the headers
+func (s *StorageService) writeEntries(writer io.Writer, hash string, entries []ManifestEntry, files map[string]ManifestEntry, dryRun bool, delta *delta) error {
+	tw := tar.NewWriter(writer)
+	selected := make(map[string]bool)
+
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:    entry.Path,
+			Mode:    int64(entry.Mode.Perm()),
+			ModTime: entry.ModTime,
+		}
+
+		switch entry.Type {
+		case "dir":
+			header.Typeflag = tar.TypeDir
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+
+		case "symlink":
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = entry.Link
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+
+		case "hardlink":
+			if selected[entry.Link] || dryRun {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = entry.Link
+				if err := tw.WriteHeader(header); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			// the link target was not selected, so fetch its content as a regular file
+			target, ok := files[entry.Link]
+			if !ok {
+				return errors.New("Hard Link Target Missing " + entry.Link)
+			}
 
-	sum := fmt.Sprintf("%x", hasher.Sum(nil))
-	match := sum == hash
-	if !match {
-		return errors.New("Hash does not match")
+			if err := s.writeFile(tw, hash, header, target, delta); err != nil {
+				return err
+			}
+
+		case "file":
+			if dryRun {
+				header.Typeflag = tar.TypeReg
+				if err := tw.WriteHeader(header); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			if err := s.writeFile(tw, hash, header, entry, delta); err != nil {
+				return err
+			}
+
+			selected[entry.Path] = true
+		}
 	}
 
-	gzr, _ := gzip.NewReader(bytes.NewBuffer(bodyBytes))
-	if err := util.ReadTarball(gzr, hash); err != nil {
+	return tw.Close()
+}
+
+// writeFile fetches the content of entry into a temporary file, verifies it and appends it to tw as header
+func (s *StorageService) writeFile(tw *tar.Writer, hash string, header *tar.Header, entry ManifestEntry, delta *delta) error {
+	tmp, err := ioutil.TempFile("", "snfs-clone")
+	if err != nil {
 		return err
 	}
 
-	return nil
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var size int64
+	if delta != nil {
+		size, err = s.assembleFile(tmp, hash, entry, delta)
+	} else {
+		size, err = s.fetchFile(tmp, hash, entry)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	header.Typeflag = tar.TypeReg
+	header.Size = size
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, tmp)
+
+	return err
+}
+
+// fetchFile writes the content of entry into writer and verifies it against the manifest
+func (s *StorageService) fetchFile(writer io.Writer, hash string, entry ManifestEntry) (int64, error) {
+	expected, err := util.ParseContentID(entry.Hash)
+	if err != nil {
+		return 0, err
+	}
+
+	hasher, err := util.NewHasher(expected.Algorithm)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := s.getFile(hash, entry.Path, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	defer res.Body.Close()
+
+	size, err := io.Copy(io.MultiWriter(writer, hasher), res.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	sum, err := util.NewContentID(expected.Algorithm, hasher.Sum(nil))
+	if err != nil {
+		return 0, err
+	}
+
+	if !sum.Equal(expected) {
+		return 0, errors.New("Hash does not match for " + entry.Path)
+	}
+
+	return size, nil
+}
+
+// getFile requests the content of the file at name of the share with hash, or only the listed chunks of it
+func (s *StorageService) getFile(hash, name string, chunks []int) (*http.Response, error) {
+	query := url.Values{}
+	query.Set("path", name)
+	if len(chunks) > 0 {
+		list := make([]string, len(chunks))
+		for i, chunk := range chunks {
+			list[i] = strconv.Itoa(chunk)
+		}
+
+		query.Set("chunks", strings.Join(list, ","))
+	}
+
+	res, err := s.api.Get("v1/storage/file/"+hash+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, responseError(res, "Request Failed For "+name)
+	}
+
+	return res, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// selectEntries returns the manifest entries at or below one of paths
+func selectEntries(entries []ManifestEntry, paths []string) []ManifestEntry {
+	selected := make([]ManifestEntry, 0)
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Path, "/")
+		for _, p := range paths {
+			p = strings.Trim(path.Clean("/"+p), "/")
+			if p == "" || name == p || strings.HasPrefix(name, p+"/") {
+				selected = append(selected, entry)
+				break
+			}
+		}
+	}
+
+	return selected
+}
+
+// responseError returns the message of a failed request, e.g. an expired share, or fallback without one
+func responseError(res *http.Response, fallback string) error {
+	var body struct {
+		Message string `json:"message"`
+	}
+	if err := decode(res.Body, &body); err != nil || body.Message == "" {
+		return errors.New(fallback)
+	}
 
+	return errors.New(body.Message)
 }
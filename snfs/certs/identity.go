@@ -0,0 +1,111 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"time"
+)
+
+// ErrUnsupportedKey is returned for certificate keys that cannot sign contacts
+const ErrUnsupportedKey = "Unsupported Certificate Key"
+
+// Sign signs data with the private key of this node's certificate
+func (m *Manager) Sign(data []byte) ([]byte, error) {
+	certificate, _, err := m.current()
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := certificate.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New(ErrUnsupportedKey)
+	}
+
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		return signer.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+
+	digest := sha256.Sum256(data)
+	return signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// Chain returns this node's certificate chain, leaf first
+func (m *Manager) Chain() ([][]byte, error) {
+	certificate, _, err := m.current()
+	if err != nil {
+		return nil, err
+	}
+
+	return certificate.Certificate, nil
+}
+
+// Verify checks that chain was issued by the snfs CA and that signature over data
+// was made with the key of its leaf. It returns the node id the leaf is bound to
+func (m *Manager) Verify(chain [][]byte, data, signature []byte) (string, error) {
+	return m.verify(chain, data, signature, false)
+}
+
+// VerifyDocument is Verify for signatures that outlive the signer's certificate, like those
+// of manifests. The chain only has to have been valid when its leaf was issued and must not be revoked
+func (m *Manager) VerifyDocument(chain [][]byte, data, signature []byte) (string, error) {
+	return m.verify(chain, data, signature, true)
+}
+
+func (m *Manager) verify(chain [][]byte, data, signature []byte, atIssuance bool) (string, error) {
+	_, pool, err := m.current()
+	if err != nil {
+		return "", err
+	}
+
+	if len(chain) == 0 {
+		return "", errors.New(ErrUntrustedPeer)
+	}
+
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return "", err
+	}
+
+	var at time.Time
+	if atIssuance {
+		at = leaf.NotBefore
+	}
+
+	if err := verifyChainAt(chain, pool, at); err != nil {
+		return "", err
+	}
+
+	if err := m.checkPeer(chain, !atIssuance); err != nil {
+		return "", err
+	}
+
+	algorithm, err := signatureAlgorithm(leaf.PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	if err := leaf.CheckSignature(algorithm, data, signature); err != nil {
+		return "", err
+	}
+
+	return NodeID(leaf)
+}
+
+func signatureAlgorithm(key crypto.PublicKey) (x509.SignatureAlgorithm, error) {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA, nil
+	case *ecdsa.PublicKey:
+		return x509.ECDSAWithSHA256, nil
+	case ed25519.PublicKey:
+		return x509.PureEd25519, nil
+	default:
+		return 0, errors.New(ErrUnsupportedKey)
+	}
+}
@@ -0,0 +1,450 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alabianca/snfs/snfs/network"
+	"github.com/alabianca/snfs/util"
+)
+
+// TopLevelDomain is the domain every node certificate is issued under
+const TopLevelDomain = ".snfs.com"
+
+// NodeDomain carries the DHT node id as a subject alternative name <id>.node.snfs.com
+const NodeDomain = ".node" + TopLevelDomain
+
+// DefaultTTL is the lifetime requested for node certificates
+const DefaultTTL = "24h"
+
+// Errors
+const ErrNotEnrolled = "Node Has No Certificate"
+const ErrUntrustedPeer = "Peer Certificate Not Issued For " + TopLevelDomain
+const ErrNoNodeID = "Certificate Does Not Name A Node ID"
+const ErrRevokedPeer = "Peer Certificate Has Been Revoked"
+
+type certificateRequest struct {
+	CommonName string `json:"common_name"`
+	TTL        string `json:"ttl"`
+	AltNames   string `json:"alt_names,omitempty"`
+	CSR        string `json:"csr"`
+}
+
+type certificateResponse struct {
+	Data struct {
+		CAChain     []string `json:"ca_chain"`
+		Certificate string   `json:"certificate"`
+		IssuingCA   string   `json:"issuing_ca"`
+	} `json:"data"`
+}
+
+// Manager obtains this node's certificate from authd, or on a private network without
+// authority issues it with the network key, and provides the TLS configurations used between peers
+type Manager struct {
+	authority   string
+	nodeID      string
+	joinToken   string
+	instance    string
+	mtx         sync.RWMutex
+	certificate *tls.Certificate
+	pool        *x509.CertPool
+	revoked     map[string]bool
+	stop        chan struct{}
+	revocation  chan struct{}
+	network     *network.Key
+	key         *ecdsa.PrivateKey
+	id          []byte
+}
+
+// NewManager returns a Manager that enrolls with the authd certificate endpoint at authority.
+// Without authority and network key peers don't talk TLS
+func NewManager(authority string) *Manager {
+	m := &Manager{
+		authority:  authority,
+		revoked:    make(map[string]bool),
+		revocation: make(chan struct{}),
+		id:         make([]byte, 20),
+	}
+
+	util.RandomID(m.id)
+
+	return m
+}
+
+// Enabled reports whether peers talk TLS
+func (m *Manager) Enabled() bool {
+	return m.authority != "" || m.network != nil
+}
+
+// HasAuthority reports whether the certificate is issued by authd, which binds node ids to keys.
+// Certificates issued with a network key name whatever node id their holder picked
+func (m *Manager) HasAuthority() bool {
+	return m.authority != ""
+}
+
+// Revocation is closed once this node's own certificate has been revoked. The certificate
+// is dropped then, so the node can neither serve nor reach peers anymore
+func (m *Manager) Revocation() <-chan struct{} {
+	return m.revocation
+}
+
+// Scheme returns the url scheme used to reach peers
+func (m *Manager) Scheme() string {
+	if m.Enabled() {
+		return "https"
+	}
+
+	return "http"
+}
+
+// SetNodeID binds the certificates requested by Enroll to the DHT node id
+func (m *Manager) SetNodeID(id string) {
+	m.nodeID = id
+}
+
+// SetNetworkKey makes peers prove they are members of a private network. Without
+// authority the network key issues this node's certificate, otherwise a second certificate
+// for the key of the one issued by authd is presented along with it
+func (m *Manager) SetNetworkKey(k *network.Key) {
+	m.network = k
+}
+
+// SetJoinToken sets the pre-shared token authd requires for enrollment
+func (m *Manager) SetJoinToken(token string) {
+	m.joinToken = token
+}
+
+// Enroll requests a certificate for <instance>.snfs.com from authd, or issues it with the
+// network key when no authority is configured. The node id set with SetNodeID is added as
+// <id>.node.snfs.com. The private key is generated locally, authd only signs a CSR for it.
+// Renewals keep the key, authd binds the node id to it
+func (m *Manager) Enroll(instance string) error {
+	if !m.Enabled() {
+		return nil
+	}
+
+	request := certificateRequest{
+		CommonName: instance + TopLevelDomain,
+		TTL:        DefaultTTL,
+	}
+	if m.nodeID != "" {
+		request.AltNames = m.nodeID + NodeDomain
+	}
+
+	key, err := m.privateKey()
+	if err != nil {
+		return err
+	}
+
+	var chain []string
+	var pool *x509.CertPool
+	if m.authority != "" {
+		chain, pool, err = m.requestCertificate(key, request)
+	} else {
+		chain, pool, err = m.issueCertificate(key, request)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certificate, err := tls.X509KeyPair([]byte(strings.Join(chain, "\n")), keyPEM)
+	if err != nil {
+		return err
+	}
+
+	if certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.certificate = &certificate
+	m.pool = pool
+	m.instance = instance
+
+	return nil
+}
+
+// privateKey returns the key of this node's certificates, generating it on first use
+func (m *Manager) privateKey() (*ecdsa.PrivateKey, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.key != nil {
+		return m.key, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	m.key = key
+	return key, nil
+}
+
+// requestCertificate has authd sign a CSR for key. On a private network the certificate
+// that proves membership is appended to the returned chain
+func (m *Manager) requestCertificate(key *ecdsa.PrivateKey, request certificateRequest) ([]string, *x509.CertPool, error) {
+	var err error
+	if request.CSR, err = certificateSigningRequest(key, request); err != nil {
+		return nil, nil, err
+	}
+
+	bts, err := json.Marshal(&request)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequest("POST", m.authority, bytes.NewBuffer(bts))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if m.joinToken != "" {
+		req.Header.Set("Authorization", "Bearer "+m.joinToken)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("Enrollment Failed: %s", body)
+	}
+
+	var cr certificateResponse
+	if err := json.Unmarshal(body, &cr); err != nil {
+		return nil, nil, err
+	}
+
+	pool := x509.NewCertPool()
+	for _, ca := range append(cr.Data.CAChain, cr.Data.IssuingCA) {
+		pool.AppendCertsFromPEM([]byte(ca))
+	}
+
+	chain := []string{cr.Data.Certificate}
+	if m.network == nil {
+		return chain, pool, nil
+	}
+
+	membership, _, err := m.issueCertificate(key, request)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return append(chain, membership...), pool, nil
+}
+
+// issueCertificate issues the certificate for key with the network key
+func (m *Manager) issueCertificate(key *ecdsa.PrivateKey, request certificateRequest) ([]string, *x509.CertPool, error) {
+	ttl, err := time.ParseDuration(request.TTL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := []string{request.CommonName}
+	if request.AltNames != "" {
+		names = append(names, request.AltNames)
+	}
+
+	der, err := m.network.Issue(request.CommonName, names, key.Public(), ttl)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certificate := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	return []string{certificate}, m.network.Pool(), nil
+}
+
+// ServerConfig returns the TLS configuration of the object server.
+// Clients must present a certificate issued by the snfs CA, or on a private
+// network without authority by the network key
+func (m *Manager) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			certificate, _, err := m.current()
+			return certificate, err
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			certificate, pool, err := m.current()
+			if err != nil {
+				return nil, err
+			}
+
+			return &tls.Config{
+				MinVersion:            tls.VersionTLS12,
+				Certificates:          []tls.Certificate{*certificate},
+				ClientCAs:             pool,
+				ClientAuth:            tls.RequireAndVerifyClientCert,
+				VerifyPeerCertificate: m.verifyPeer,
+			}, nil
+		},
+	}
+}
+
+// ClientConfig returns the TLS configuration used to fetch content from peers.
+// Peers are dialed by ip, so instead of the host name the peer certificate must chain
+// to the snfs CA and be issued for a name under .snfs.com
+func (m *Manager) ClientConfig() (*tls.Config, error) {
+	certificate, pool, err := m.current()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		Certificates:       []tls.Certificate{*certificate},
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if err := verifyChain(rawCerts, pool); err != nil {
+				return err
+			}
+
+			return m.verifyPeer(rawCerts, nil)
+		},
+	}, nil
+}
+
+// HTTPClient returns a client for requests to peers
+func (m *Manager) HTTPClient() (*http.Client, error) {
+	if !m.Enabled() {
+		return &http.Client{}, nil
+	}
+
+	config, err := m.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: config,
+		},
+	}, nil
+}
+
+func certificateSigningRequest(key *ecdsa.PrivateKey, request certificateRequest) (string, error) {
+	template := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: request.CommonName},
+		DNSNames: []string{request.CommonName},
+	}
+	if request.AltNames != "" {
+		template.DNSNames = append(template.DNSNames, request.AltNames)
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return "", err
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), nil
+}
+
+func (m *Manager) current() (*tls.Certificate, *x509.CertPool, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	if m.certificate == nil {
+		return nil, nil, errors.New(ErrNotEnrolled)
+	}
+
+	return m.certificate, m.pool, nil
+}
+
+func verifyChain(rawCerts [][]byte, pool *x509.CertPool) error {
+	return verifyChainAt(rawCerts, pool, time.Time{})
+}
+
+// verifyChainAt verifies the chain as of at, the zero time meaning now
+func verifyChainAt(rawCerts [][]byte, pool *x509.CertPool, at time.Time) error {
+	if len(rawCerts) == 0 {
+		return errors.New(ErrUntrustedPeer)
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+
+	return err
+}
+
+// verifyPeerName makes sure the leaf certificate names a node under the snfs domain
+// and is bound to a DHT node id
+func verifyPeerName(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New(ErrUntrustedPeer)
+	}
+
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasSuffix(cert.Subject.CommonName, TopLevelDomain) {
+		return errors.New(ErrUntrustedPeer)
+	}
+
+	_, err = NodeID(cert)
+	return err
+}
+
+// NodeID returns the DHT node id cert is bound to
+func NodeID(cert *x509.Certificate) (string, error) {
+	for _, name := range cert.DNSNames {
+		if id := strings.TrimSuffix(name, NodeDomain); id != name && id != "" && !strings.Contains(id, ".") {
+			return id, nil
+		}
+	}
+
+	return "", errors.New(ErrNoNodeID)
+}
@@ -0,0 +1,239 @@
+package certs
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+)
+
+const ServiceName = "CertificateManager"
+
+// RefreshInterval is how often the certificate is checked for renewal
+// and the revocation list is refreshed
+var RefreshInterval = time.Minute
+
+type revokedResponse struct {
+	Data struct {
+		Serials []string `json:"serials"`
+	} `json:"data"`
+}
+
+// Service interface ID, Name, Run, Shutdown
+
+func (m *Manager) ID() string {
+	return fmt.Sprintf("%x", m.id)
+}
+
+func (m *Manager) Name() string {
+	return ServiceName
+}
+
+// Run renews the certificate once two thirds of its lifetime have passed and keeps the
+// list of revoked peers up to date. TLS configurations pick up a renewed certificate on
+// the next handshake. A revoked certificate is not renewed, Run drops it and returns
+func (m *Manager) Run() error {
+	stop := make(chan struct{})
+	m.mtx.Lock()
+	m.stop = stop
+	m.mtx.Unlock()
+
+	ticker := time.NewTicker(RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if revoked := m.refresh(); revoked {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+func (m *Manager) Shutdown() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+
+	return nil
+}
+
+// refresh renews the certificate when due. It reports whether the certificate has been revoked
+func (m *Manager) refresh() bool {
+	if err := m.refreshRevocations(); err != nil {
+		log.Printf("Could Not Refresh Revocation List: %s\n", err)
+	}
+
+	if serial, revoked := m.dropRevoked(); revoked {
+		log.Printf("Certificate %s Has Been Revoked, Stopped Serving Peers\n", serial)
+		return true
+	}
+
+	instance, renew := m.needsRenewal()
+	if !renew {
+		return false
+	}
+
+	if err := m.Enroll(instance); err != nil {
+		log.Printf("Could Not Renew Certificate: %s\n", err)
+		return false
+	}
+
+	log.Printf("Renewed Certificate For %s%s\n", instance, TopLevelDomain)
+	return false
+}
+
+// dropRevoked drops the certificate and closes the revocation channel once the
+// certificate appears in the revocation list. authd doesn't issue a new one for its key or node id
+func (m *Manager) dropRevoked() (string, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.certificate == nil || m.certificate.Leaf == nil {
+		return "", false
+	}
+
+	serial := formatSerial(m.certificate.Leaf.SerialNumber)
+	if !m.revoked[serial] {
+		return "", false
+	}
+
+	m.certificate = nil
+	select {
+	case <-m.revocation:
+	default:
+		close(m.revocation)
+	}
+
+	return serial, true
+}
+
+func (m *Manager) needsRenewal() (string, bool) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	if m.certificate == nil || m.certificate.Leaf == nil {
+		return "", false
+	}
+
+	leaf := m.certificate.Leaf
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	return m.instance, time.Until(leaf.NotAfter) < lifetime/3
+}
+
+// refreshRevocations fetches the revoked serial numbers from authd.
+// On failure the previous list is kept
+func (m *Manager) refreshRevocations() error {
+	if m.authority == "" {
+		return nil
+	}
+
+	revocationURL, err := m.revocationURL()
+	if err != nil {
+		return err
+	}
+
+	res, err := http.Get(revocationURL)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("authd Returned %d", res.StatusCode)
+	}
+
+	var rr revokedResponse
+	if err := json.NewDecoder(res.Body).Decode(&rr); err != nil {
+		return err
+	}
+
+	revoked := make(map[string]bool, len(rr.Data.Serials))
+	for _, serial := range rr.Data.Serials {
+		revoked[serial] = true
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.revoked = revoked
+
+	return nil
+}
+
+// revocationURL returns the revocation endpoint next to the certificate endpoint of authd
+func (m *Manager) revocationURL() (string, error) {
+	u, err := url.Parse(m.authority)
+	if err != nil {
+		return "", err
+	}
+
+	u.Path = path.Join(path.Dir(u.Path), "revoked")
+	return u.String(), nil
+}
+
+// verifyPeer checks the peer's name and node id, rejects revoked certificates
+// and on a private network peers that are not members
+func (m *Manager) verifyPeer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return m.checkPeer(rawCerts, true)
+}
+
+// verifyPeerAt is verifyPeer that with current unset accepts network certificates that have expired
+func (m *Manager) checkPeer(rawCerts [][]byte, current bool) error {
+	if err := verifyPeerName(rawCerts, nil); err != nil {
+		return err
+	}
+
+	if m.network != nil {
+		member := m.network.Member
+		if !current {
+			member = m.network.Certified
+		}
+
+		if err := member(rawCerts); err != nil {
+			return err
+		}
+	}
+
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	if m.revoked[formatSerial(cert.SerialNumber)] {
+		return errors.New(ErrRevokedPeer)
+	}
+
+	return nil
+}
+
+// formatSerial formats serial as colon separated hex like authd does
+func formatSerial(serial *big.Int) string {
+	bts := serial.Bytes()
+	out := make([]byte, 0, len(bts)*3)
+	for i, b := range bts {
+		if i > 0 {
+			out = append(out, ':')
+		}
+		out = append(out, fmt.Sprintf("%02x", b)...)
+	}
+
+	return string(out)
+}
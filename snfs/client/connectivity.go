@@ -10,31 +10,45 @@ import (
 
 	"github.com/alabianca/snfs/util"
 
+	"github.com/alabianca/snfs/snfs/certs"
 	"github.com/alabianca/snfs/snfs/fs"
 
 	"github.com/alabianca/snfs/snfs/discovery"
 	"github.com/alabianca/snfs/snfs/kad"
+	"github.com/alabianca/snfs/snfs/names"
+	"github.com/alabianca/snfs/snfs/portmap"
+	"github.com/alabianca/snfs/snfs/relay"
 )
 
 const ServiceName = "ClientConnectivityService"
 
 type ConnectivityService struct {
-	Addr       string
-	Port       int
-	discovery  *discovery.Manager
-	httpServer *http.Server
-	storage    *fs.Manager
-	rpc        *kad.RpcManager
-	id         []byte
-	name       string
+	Addr        string
+	Port        int
+	discovery   *discovery.Manager
+	httpServer  *http.Server
+	storage     *fs.Manager
+	rpc         *kad.RpcManager
+	certs       *certs.Manager
+	relayServer *relay.Server
+	relayClient *relay.Client
+	puncher     *kad.Puncher
+	mapper      *portmap.Mapper
+	transport   *peerTransport
+	names       *names.Registry
+	replicator  *Replicator
+	id          []byte
+	name        string
 }
 
-func NewConnectivityService(dManager *discovery.Manager, storage *fs.Manager, rpc *kad.RpcManager) *ConnectivityService {
+func NewConnectivityService(dManager *discovery.Manager, storage *fs.Manager, rpc *kad.RpcManager, certManager *certs.Manager) *ConnectivityService {
 
 	c := &ConnectivityService{
 		discovery: dManager,
 		storage:   storage,
 		rpc:       rpc,
+		certs:     certManager,
+		transport: newPeerTransport(rpc, certManager),
 		id:        make([]byte, 20),
 	}
 
@@ -48,6 +62,38 @@ func (c *ConnectivityService) SetAddr(addr string, port int) {
 	c.Port = port
 }
 
+// SetRelays reports the relay this node runs and the one it is registered with in the daemon status.
+// Either may be nil
+func (c *ConnectivityService) SetRelays(relayServer *relay.Server, relayClient *relay.Client) {
+	c.relayServer = relayServer
+	c.relayClient = relayClient
+}
+
+// SetPuncher reports the rendezvous this node is registered with in the daemon status
+func (c *ConnectivityService) SetPuncher(puncher *kad.Puncher) {
+	c.puncher = puncher
+}
+
+// SetPortMapper reports the port mappings of the router in the daemon status
+func (c *ConnectivityService) SetPortMapper(mapper *portmap.Mapper) {
+	c.mapper = mapper
+}
+
+// SetNames publishes and resolves names with registry
+func (c *ConnectivityService) SetNames(registry *names.Registry) {
+	c.names = registry
+}
+
+// SetReplicator keeps shares uploaded with replicas replicated and reports replicas in the daemon status
+func (c *ConnectivityService) SetReplicator(replicator *Replicator) {
+	c.replicator = replicator
+}
+
+// SetQUIC fetches objects over QUIC from peers that advertise it
+func (c *ConnectivityService) SetQUIC(enabled bool) {
+	c.transport.quic = enabled
+}
+
 func (c *ConnectivityService) REST() error {
 	addr := net.JoinHostPort(c.Addr, strconv.Itoa(c.Port))
 
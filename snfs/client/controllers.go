@@ -2,16 +2,18 @@ package client
 
 import (
 	"bytes"
-	"crypto/sha1"
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/alabianca/snfs/snfs/server"
 
@@ -19,15 +21,21 @@ import (
 
 	"github.com/alabianca/snfs/util"
 
+	"github.com/alabianca/snfs/snfs/certs"
 	"github.com/alabianca/snfs/snfs/fs"
 	"github.com/alabianca/snfs/snfs/kad"
+	"github.com/alabianca/snfs/snfs/names"
+	"github.com/alabianca/snfs/snfs/transfer"
 
 	"github.com/go-chi/chi"
 
 	"github.com/alabianca/snfs/snfs/discovery"
 )
 
-func startMDNSController(d *discovery.Manager) http.HandlerFunc {
+// ErrACLWithoutAuthority is returned when a share is restricted on a node whose certificate doesn't come from authd
+const ErrACLWithoutAuthority = "Restricting Shares Requires SNFS_AUTHORITY_URL"
+
+func startMDNSController(d *discovery.Manager, certManager *certs.Manager) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 
 		if d.MDNSStarted() {
@@ -47,6 +55,11 @@ func startMDNSController(d *discovery.Manager) http.HandlerFunc {
 			return
 		}
 
+		if err := certManager.Enroll(sReq.Instance); err != nil {
+			util.Respond(res, util.Message(http.StatusBadGateway, "Could Not Obtain Certificate: "+err.Error()))
+			return
+		}
+
 		d.SetInstance(sReq.Instance)
 
 		mdns := make(chan server.ResponseCode, 1)
@@ -177,7 +190,7 @@ func getInstancesController(d *discovery.Manager) http.HandlerFunc {
 	}
 }
 
-func storeFileController(storage *fs.Manager, rpc *kad.RpcManager) http.HandlerFunc {
+func storeFileController(storage *fs.Manager, rpc *kad.RpcManager, certManager *certs.Manager, registry *names.Registry, replicator *Replicator) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		req.ParseMultipartForm(100 << 20) // 100mgb
 
@@ -189,13 +202,50 @@ func storeFileController(storage *fs.Manager, rpc *kad.RpcManager) http.HandlerF
 
 		defer file.Close()
 
+		// --allow restricts the share to the named peers
+		allow := req.Form["allow"]
+		if err := fs.ValidatePeers(allow); err != nil {
+			util.Respond(res, util.Message(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		// peers are identified by node ids authd bound to their certificate's key
+		if len(allow) > 0 && !certManager.HasAuthority() {
+			util.Respond(res, util.Message(http.StatusBadRequest, ErrACLWithoutAuthority))
+			return
+		}
+
+		expiry, err := shareExpiry(req)
+		if err != nil {
+			util.Respond(res, util.Message(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		replicas, err := shareReplicas(req, replicator)
+		if err != nil {
+			util.Respond(res, util.Message(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		// replicas neither enforce the peer list nor count downloads across nodes
+		if replicas > 0 && (len(allow) > 0 || expiry != (fs.Expiry{})) {
+			util.Respond(res, util.Message(http.StatusBadRequest, "Replicated Shares Can't Be Restricted Or Expire"))
+			return
+		}
+
 		destFile, err := fs.NewFile(storage.GetRoot(), header.Filename)
 		if err != nil {
 			util.Respond(res, util.Message(http.StatusInternalServerError, "Error Creating Destination File"))
 			return
 		}
 
-		hasher := sha1.New()
+		algorithm := hashAlgorithm(req)
+		hasher, err := util.NewHasher(algorithm)
+		if err != nil {
+			util.Respond(res, util.Message(http.StatusBadRequest, "Unknown Hash Algorithm "+algorithm))
+			return
+		}
+
 		storageWriter := fs.NewWriter(hasher, destFile)
 		defer storageWriter.Close()
 
@@ -208,69 +258,330 @@ func storeFileController(storage *fs.Manager, rpc *kad.RpcManager) http.HandlerF
 
 		storageWriter.Close()
 
-		hashed := fmt.Sprintf("%x", storageWriter.Sum(nil))
-		if err := storage.AddObject(header.Filename, hashed, header.Size); err != nil {
-			util.Respond(res, util.Message(http.StatusInternalServerError, "Error Adding File Object"))
+		var manifest fs.Manifest
+		if raw := req.FormValue("manifest"); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &manifest); err != nil {
+				util.Respond(res, util.Message(http.StatusBadRequest, "Invalid Manifest"))
+				return
+			}
+		}
+
+		// followers diff the file listing, which encrypted shares don't have
+		if manifest.Feed != "" {
+			if err := util.ValidateLabel(manifest.Feed); err != nil || manifest.Encrypted {
+				util.Respond(res, util.Message(http.StatusBadRequest, "Invalid Feed "+manifest.Feed))
+				return
+			}
+		}
+
+		hashed, err := util.NewContentID(algorithm, storageWriter.Sum(nil))
+		if err != nil {
+			util.Respond(res, util.Message(http.StatusInternalServerError, err.Error()))
 			return
 		}
 
-		host := os.Getenv("SNFS_HOST")
-		if host == "" {
-			util.Respond(res, util.Message(http.StatusInternalServerError, "SNFS_HOST Environment Variable Not Set"))
+		if err := buildManifest(&manifest, destFile.Name(), hashed, rpc.ID()); err != nil {
+			util.Respond(res, util.Message(http.StatusInternalServerError, "Error Building Manifest"))
 			return
 		}
-		port, err := strconv.ParseInt(os.Getenv("SNFS_FS_PORT"), 10, 16)
-		if err != nil || port == 0 {
-			util.Respond(res, util.Message(http.StatusInternalServerError, "SNFS_FS_PORT Environment Variable Not Set"))
+
+		if err := signManifest(certManager, &manifest); err != nil {
+			util.Respond(res, util.Message(http.StatusInternalServerError, "Error Signing Manifest"))
 			return
 		}
 
+		// identical content shares one policy, it isn't loosened or tightened by sharing it again
+		if err := storage.Share(header.Filename, hashed, header.Size, &manifest, fs.Policy{ACL: allow, Expiry: expiry}); err != nil {
+			if err.Error() == fs.ErrPolicyConflict {
+				util.Respond(res, util.Message(http.StatusConflict, err.Error()))
+				return
+			}
+
+			util.Respond(res, util.Message(http.StatusInternalServerError, "Error Adding File Object"))
+			return
+		}
+
+		// relayed nodes announce the relay's address
+		ip, port, err := storage.AnnounceAddr()
+		if err != nil {
+			util.Respond(res, util.Message(http.StatusInternalServerError, err.Error()))
+			return
+		}
 
-		if _, err := rpc.Store(hashed, net.ParseIP(host), int(port)); err != nil {
+		if _, err := rpc.Store(hashed, ip, port); err != nil {
 			util.Respond(res, util.Message(http.StatusInternalServerError, err.Error()))
 			return
 		}
 
+		if replicas > 0 {
+			replicator.Track(hashed, replicas)
+		}
+
 		response := util.Message(http.StatusCreated, "OK")
-		response["data"] = StorageResponse{
-			Hash:        hashed,
-			ByteWritten: bytesWritten,
+		storageResponse := StorageResponse{
+			Hash:         hashed.String(),
+			ByteWritten:  bytesWritten,
+			MaxDownloads: expiry.MaxDownloads,
+			Replicas:     replicas,
+		}
+
+		// the synced directory's name moves on and its previous version is collected once followers caught up
+		if manifest.Feed != "" {
+			record, previous, err := publishName(storage, rpc, registry, manifest.Feed, hashed.String())
+			if err != nil {
+				util.Respond(res, util.Message(http.StatusInternalServerError, err.Error()))
+				return
+			}
+
+			if previous != "" && previous != record.Hash {
+				storage.Supersede(previous, time.Now().Add(names.SupersededGrace))
+			}
+
+			storageResponse.Name = &record
+		}
+		if !expiry.ExpiresAt.IsZero() {
+			storageResponse.ExpiresAt = &expiry.ExpiresAt
 		}
 
+		response["data"] = storageResponse
+
 		util.Respond(res, response)
 
 	}
 }
 
-func getFileController(storage *fs.Manager, rpc *kad.RpcManager) http.HandlerFunc {
+func getFileController(storage *fs.Manager, rpc *kad.RpcManager, certManager *certs.Manager, transport *peerTransport) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		fileHash := chi.URLParam(req, "hash")
+		id, err := util.ParseContentID(fileHash)
+		if err != nil {
+			util.Respond(res, util.Message(http.StatusBadRequest, err.Error()))
+			return
+		}
 
-		addr, err := rpc.Resolve(fileHash)
+		addr, err := rpc.Resolve(id)
 		log.Printf("Resolved Address %s\n", addr)
-		log.Printf("Resolved error %s\n", err)
+		if err != nil || addr == nil {
+			util.Respond(res, util.Message(http.StatusNotFound, "Could Not Resolve "+fileHash))
+			return
+		}
 
-		url := "http://" + addr.String() + "/v1/object/" + fileHash
-		request, err := http.NewRequest("GET", url, nil)
+		t, err := startDownload(storage, addr, fileHash)
 		if err != nil {
-			util.Respond(res, util.Message(http.StatusInternalServerError, "Could Not Create a Request"))
+			respondTransferError(res, err)
 			return
 		}
 
-		client := http.Client{}
-		response, err := client.Do(request)
+		defer t.Finish()
+
+		response, err := peerFetch(req.Context(), rpc, certManager, transport, addr, "/v1/object/"+fileHash)
 		if err != nil {
-			util.Respond(res, util.Message(http.StatusInternalServerError, "Could Not Do Request"))
+			respondPeerError(res, err)
 			return
 		}
 
 		defer response.Body.Close()
-		res.Header().Add("Content-Type", "application/octet-stream")
-		res.WriteHeader(http.StatusOK)
-		io.Copy(res, response.Body)
+		res.Header().Add("Content-Type", response.Header.Get("Content-Type"))
+		res.WriteHeader(response.StatusCode)
+		io.Copy(t.Writer(req.Context(), res), response.Body)
+	}
+}
+
+func getObjectFileController(storage *fs.Manager, rpc *kad.RpcManager, certManager *certs.Manager, transport *peerTransport) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		fileHash := chi.URLParam(req, "hash")
+		id, err := util.ParseContentID(fileHash)
+		if err != nil {
+			util.Respond(res, util.Message(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		addr, err := rpc.Resolve(id)
+		if err != nil || addr == nil {
+			util.Respond(res, util.Message(http.StatusNotFound, "Could Not Resolve "+fileHash))
+			return
+		}
+
+		t, err := startDownload(storage, addr, fileHash)
+		if err != nil {
+			respondTransferError(res, err)
+			return
+		}
+
+		defer t.Finish()
+
+		query := url.Values{}
+		query.Set("path", req.URL.Query().Get("path"))
+		if chunks := req.URL.Query().Get("chunks"); chunks != "" {
+			query.Set("chunks", chunks)
+		}
+
+		response, err := peerGet(rpc, certManager, transport, addr, "/v1/object/"+fileHash+"/file?"+query.Encode())
+		if err != nil {
+			respondPeerError(res, err)
+			return
+		}
+
+		defer response.Body.Close()
+		res.Header().Add("Content-Type", response.Header.Get("Content-Type"))
+		res.WriteHeader(response.StatusCode)
+		io.Copy(t.Writer(req.Context(), res), response.Body)
 	}
 }
 
+func getManifestController(storage *fs.Manager, rpc *kad.RpcManager, certManager *certs.Manager, transport *peerTransport) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		fileHash := chi.URLParam(req, "hash")
+		id, err := util.ParseContentID(fileHash)
+		if err != nil {
+			util.Respond(res, util.Message(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		if manifest, err := storage.GetManifest(fileHash); err == nil {
+			response := util.Message(http.StatusOK, "Ok")
+			response["data"] = manifest
+			util.Respond(res, response)
+			return
+		}
+
+		addr, err := rpc.Resolve(id)
+		if err != nil || addr == nil {
+			util.Respond(res, util.Message(http.StatusNotFound, "Could Not Resolve "+fileHash))
+			return
+		}
+
+		manifest, err := peerManifest(rpc, certManager, transport, addr, fileHash)
+		if err != nil {
+			if _, ok := err.(peerIdentityError); ok {
+				respondPeerError(res, err)
+				return
+			}
+
+			util.Respond(res, util.Message(http.StatusNotFound, err.Error()))
+			return
+		}
+
+		// clones trust the per-file hashes, so they are read from a manifest signed by its creator
+		if len(manifest.Signature) > 0 && certManager.Enabled() {
+			if err := checkManifestSignature(certManager, id, manifest); err != nil {
+				util.Respond(res, util.Message(http.StatusBadGateway, err.Error()))
+				return
+			}
+
+			response := util.Message(http.StatusOK, "Ok")
+			response["data"] = manifest
+			util.Respond(res, response)
+			return
+		}
+
+		// or without a signature from content that matches the share's hash
+		t, err := startDownload(storage, addr, fileHash)
+		if err != nil {
+			respondTransferError(res, err)
+			return
+		}
+
+		defer t.Finish()
+
+		if err := verifyManifest(req.Context(), rpc, certManager, transport, t, addr, id, &manifest); err != nil {
+			if _, ok := err.(peerIdentityError); ok {
+				respondPeerError(res, err)
+				return
+			}
+
+			util.Respond(res, util.Message(http.StatusBadGateway, err.Error()))
+			return
+		}
+
+		response := util.Message(http.StatusOK, "Ok")
+		response["data"] = manifest
+		util.Respond(res, response)
+	}
+}
+
+func getACLController(storage *fs.Manager) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		acl, err := storage.ACL(chi.URLParam(req, "hash"))
+		if err != nil {
+			util.Respond(res, util.Message(http.StatusNotFound, err.Error()))
+			return
+		}
+
+		response := util.Message(http.StatusOK, "Ok")
+		response["data"] = ACLRequest{Peers: acl}
+		util.Respond(res, response)
+	}
+}
+
+func setACLController(storage *fs.Manager, certManager *certs.Manager) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		var aclReq ACLRequest
+		if err := json.NewDecoder(req.Body).Decode(&aclReq); err != nil {
+			util.Respond(res, util.Message(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		updateACL(res, storage, certManager, chi.URLParam(req, "hash"), func([]string) []string {
+			return aclReq.Peers
+		})
+	}
+}
+
+func addACLPeerController(storage *fs.Manager, certManager *certs.Manager) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		peer := chi.URLParam(req, "peer")
+		updateACL(res, storage, certManager, chi.URLParam(req, "hash"), func(acl []string) []string {
+			return append(acl, peer)
+		})
+	}
+}
+
+func removeACLPeerController(storage *fs.Manager, certManager *certs.Manager) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		peer := strings.ToLower(chi.URLParam(req, "peer"))
+		updateACL(res, storage, certManager, chi.URLParam(req, "hash"), func(acl []string) []string {
+			kept := make([]string, 0, len(acl))
+			for _, entry := range acl {
+				if entry != peer {
+					kept = append(kept, entry)
+				}
+			}
+			return kept
+		})
+	}
+}
+
+// updateACL replaces the ACL of the object with hash by the result of update and responds with it
+func updateACL(res http.ResponseWriter, storage *fs.Manager, certManager *certs.Manager, hash string, update func([]string) []string) {
+	acl, err := storage.ACL(hash)
+	if err != nil {
+		util.Respond(res, util.Message(http.StatusNotFound, err.Error()))
+		return
+	}
+
+	acl = update(acl)
+	if err := fs.ValidatePeers(acl); err != nil {
+		util.Respond(res, util.Message(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	if len(acl) > 0 && !certManager.HasAuthority() {
+		util.Respond(res, util.Message(http.StatusBadRequest, ErrACLWithoutAuthority))
+		return
+	}
+
+	if err := storage.SetACL(hash, acl); err != nil {
+		util.Respond(res, util.Message(http.StatusInternalServerError, err.Error()))
+		return
+	}
+
+	acl, _ = storage.ACL(hash)
+	response := util.Message(http.StatusOK, "Ok")
+	response["data"] = ACLRequest{Peers: acl}
+	util.Respond(res, response)
+}
+
 func bootstrapController(rpc *kad.RpcManager) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		var br BootstrapRequest
@@ -303,6 +614,287 @@ func kadnetStatusController(rpc *kad.RpcManager) http.HandlerFunc {
 	}
 }
 
+// peerURL returns the url of path on the object server of the peer at addr
+func peerURL(certManager *certs.Manager, addr net.Addr, path string) string {
+	return certManager.Scheme() + "://" + addr.String() + path
+}
+
+// peerIdentityError is returned when a peer cannot prove it is the node it claims to be
+type peerIdentityError struct {
+	err error
+}
+
+func (e peerIdentityError) Error() string {
+	return "Peer Identity Rejected: " + e.err.Error()
+}
+
+// peer is the object server of a peer whose identity was checked
+type peer struct {
+	client      *http.Client
+	certManager *certs.Manager
+	addr        net.Addr
+	contact     *kad.SignedContact
+}
+
+// dialPeer prepares requests to the object server of the peer at addr.
+// With TLS enabled the peer first has to present a contact signed for addr
+func dialPeer(rpc *kad.RpcManager, certManager *certs.Manager, transport *peerTransport, addr net.Addr) (*peer, error) {
+	p := &peer{
+		client:      &http.Client{Transport: transport},
+		certManager: certManager,
+		addr:        addr,
+	}
+
+	if !certManager.Enabled() {
+		return p, nil
+	}
+
+	contact, err := peerContact(rpc, certManager, p.client, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p.contact = &contact
+
+	return p, nil
+}
+
+// get fetches path with the additional header
+func (p *peer) get(ctx context.Context, path string, header http.Header) (*http.Response, error) {
+	return p.do(ctx, http.MethodGet, path, header)
+}
+
+// do sends a request without body to path. With TLS enabled the response
+// has to be served with the certificate that signed the peer's contact
+func (p *peer) do(ctx context.Context, method, path string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, peerURL(p.certManager, p.addr, path), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(ctx)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	response, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.contact == nil {
+		return response, nil
+	}
+
+	if response.TLS == nil || len(response.TLS.PeerCertificates) == 0 ||
+		!bytes.Equal(response.TLS.PeerCertificates[0].Raw, p.contact.Chain[0]) {
+		response.Body.Close()
+		return nil, peerIdentityError{errors.New(kad.ErrIdentityMismatch)}
+	}
+
+	return response, nil
+}
+
+// peerGet fetches path from the object server of the peer at addr
+func peerGet(rpc *kad.RpcManager, certManager *certs.Manager, transport *peerTransport, addr net.Addr, path string) (*http.Response, error) {
+	p, err := dialPeer(rpc, certManager, transport, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.get(context.Background(), path, nil)
+}
+
+// peerContact fetches and verifies the signed contact of the peer at addr
+func peerContact(rpc *kad.RpcManager, certManager *certs.Manager, client *http.Client, addr net.Addr) (kad.SignedContact, error) {
+	response, err := client.Get(peerURL(certManager, addr, "/v1/contact"))
+	if err != nil {
+		return kad.SignedContact{}, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return kad.SignedContact{}, peerIdentityError{errors.New("Peer Has No Signed Contact")}
+	}
+
+	var body struct {
+		Data kad.SignedContact `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return kad.SignedContact{}, err
+	}
+
+	contact := body.Data
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return kad.SignedContact{}, err
+	}
+
+	if contact.IP != host || strconv.Itoa(contact.FilePort) != port {
+		return kad.SignedContact{}, peerIdentityError{errors.New(kad.ErrIdentityMismatch)}
+	}
+
+	if err := rpc.VerifyContact(contact); err != nil {
+		return kad.SignedContact{}, peerIdentityError{err}
+	}
+
+	return contact, nil
+}
+
+// startDownload admits a download of name from the peer at addr
+func startDownload(storage *fs.Manager, addr net.Addr, name string) (*transfer.Transfer, error) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+
+	return storage.Transfers().Start(transfer.Download, host, name)
+}
+
+func respondTransferError(res http.ResponseWriter, err error) {
+	res.Header().Set("Retry-After", fs.RetryAfter)
+	util.Respond(res, util.Message(http.StatusServiceUnavailable, err.Error()))
+}
+
+func statusController(c *ConnectivityService) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		status := StatusResponse{
+			NodeID:       c.rpc.ID(),
+			Certificates: c.certs.Enabled(),
+			Transfers:    c.storage.Transfers().Status(),
+		}
+
+		if c.relayClient != nil {
+			relayStatus := c.relayClient.Status()
+			status.Relay = &relayStatus
+		}
+
+		if c.relayServer != nil {
+			status.Relaying = c.relayServer.Status()
+		}
+
+		if c.puncher != nil {
+			punchStatus := c.puncher.Status()
+			status.Punch = &punchStatus
+		}
+
+		if c.mapper != nil {
+			mapStatus := c.mapper.Status()
+			status.PortMapping = &mapStatus
+		}
+
+		if c.replicator != nil {
+			status.Replicas = c.replicator.Status()
+		}
+
+		response := util.Message(http.StatusOK, "Ok")
+		response["data"] = status
+		util.Respond(res, response)
+	}
+}
+
+func respondPeerError(res http.ResponseWriter, err error) {
+	if _, ok := err.(peerIdentityError); ok {
+		util.Respond(res, util.Message(http.StatusBadGateway, err.Error()))
+		return
+	}
+
+	util.Respond(res, util.Message(http.StatusInternalServerError, "Could Not Do Request"))
+}
+
+// buildManifest lists the stored archive at path into manifest
+func buildManifest(manifest *fs.Manifest, path string, hash util.ContentID, creator string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	manifest.Hash = hash.String()
+	manifest.Creator = creator
+	manifest.Size = info.Size()
+
+	// the content of encrypted shares is opaque to the storing node
+	if manifest.Encrypted {
+		manifest.Files = nil
+		manifest.Ignore = nil
+		return nil
+	}
+
+	entries, err := fs.ReadManifestEntries(file, hash.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	manifest.Files = entries
+
+	return nil
+}
+
+// shareExpiry reads the optional expires (a duration like 1h) and max_downloads form values of an upload
+func shareExpiry(req *http.Request) (fs.Expiry, error) {
+	var expiry fs.Expiry
+	if raw := req.FormValue("expires"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return expiry, errors.New("Invalid Expiry " + raw)
+		}
+
+		expiry.ExpiresAt = time.Now().Add(d)
+	}
+
+	if raw := req.FormValue("max_downloads"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return expiry, errors.New("Invalid Download Limit " + raw)
+		}
+
+		expiry.MaxDownloads = n
+	}
+
+	return expiry, nil
+}
+
+// shareReplicas reads the optional replicas form value of an upload, how many other nodes should hold the share
+func shareReplicas(req *http.Request, replicator *Replicator) (int, error) {
+	raw := req.FormValue("replicas")
+	if raw == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 || n > MaxReplicas {
+		return 0, errors.New("Invalid Replica Count " + raw + ", At Most " + strconv.Itoa(MaxReplicas))
+	}
+
+	if n > 0 && replicator == nil {
+		return 0, errors.New("Replication Is Not Enabled")
+	}
+
+	return n, nil
+}
+
+// hashAlgorithm returns the algorithm requested by the uploader,
+// falling back to SNFS_HASH_ALGORITHM and then to the default algorithm
+func hashAlgorithm(req *http.Request) string {
+	if algorithm := req.FormValue("algorithm"); algorithm != "" {
+		return algorithm
+	}
+
+	if algorithm := os.Getenv("SNFS_HASH_ALGORITHM"); algorithm != "" {
+		return algorithm
+	}
+
+	return util.DefaultHashAlgorithm
+}
+
 func queueServiceRequest(serviceName string, op server.OP, res chan server.ResponseCode) error {
 	service, err := server.ResolveService(serviceName)
 	if err != nil {
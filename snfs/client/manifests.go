@@ -0,0 +1,166 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/alabianca/snfs/snfs/certs"
+	"github.com/alabianca/snfs/snfs/fs"
+	"github.com/alabianca/snfs/snfs/kad"
+	"github.com/alabianca/snfs/snfs/transfer"
+	"github.com/alabianca/snfs/util"
+)
+
+// Errors
+const ErrManifestMismatch = "Share Content Does Not Match Its Hash"
+const ErrUnverifiableManifest = "Unsigned Manifests Of Download Limited Shares Can't Be Verified"
+const ErrManifestSignature = "Manifest Is Not Signed By Its Creator"
+
+// peerManifest fetches the manifest the peer at addr holds for the share with hash.
+// The file listing is the peer's claim until it was checked with checkManifestSignature or verifyManifest
+func peerManifest(rpc *kad.RpcManager, certManager *certs.Manager, transport *peerTransport, addr net.Addr, hash string) (fs.Manifest, error) {
+	response, err := peerGet(rpc, certManager, transport, addr, "/v1/object/"+hash+"/manifest")
+	if err != nil {
+		return fs.Manifest{}, err
+	}
+
+	defer response.Body.Close()
+
+	var body struct {
+		Status  int         `json:"status"`
+		Message string      `json:"message"`
+		Data    fs.Manifest `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return fs.Manifest{}, err
+	}
+
+	if body.Status != http.StatusOK {
+		return fs.Manifest{}, errors.New(body.Message)
+	}
+
+	return body.Data, nil
+}
+
+// signManifest signs manifest with the key of this node's certificate. Without certificates
+// manifests stay unsigned
+func signManifest(certManager *certs.Manager, manifest *fs.Manifest) error {
+	manifest.Signature = nil
+	manifest.Chain = nil
+	if !certManager.Enabled() {
+		return nil
+	}
+
+	data, err := manifest.SignedData()
+	if err != nil {
+		return err
+	}
+
+	signature, err := certManager.Sign(data)
+	if err != nil {
+		return err
+	}
+
+	chain, err := certManager.Chain()
+	if err != nil {
+		return err
+	}
+
+	manifest.Signature = signature
+	manifest.Chain = chain
+
+	return nil
+}
+
+// checkManifestSignature checks that manifest describes the share with id and was signed by the
+// node it names as creator, with a certificate that was issued by the snfs CA and is not revoked
+func checkManifestSignature(certManager *certs.Manager, id util.ContentID, manifest fs.Manifest) error {
+	if manifest.Hash != id.String() {
+		return errors.New(ErrManifestSignature)
+	}
+
+	data, err := manifest.SignedData()
+	if err != nil {
+		return err
+	}
+
+	signer, err := certManager.VerifyDocument(manifest.Chain, data, manifest.Signature)
+	if err != nil || signer != manifest.Creator {
+		return errors.New(ErrManifestSignature)
+	}
+
+	return nil
+}
+
+// verifyManifest replaces the file listing and size of an unsigned manifest with the ones read
+// from the share's content, which is streamed from the peer and checked against id on the way.
+// The content is fetched as a range so it is not counted as a download, at the rate t allows
+func verifyManifest(ctx context.Context, rpc *kad.RpcManager, certManager *certs.Manager, transport *peerTransport, t *transfer.Transfer, addr net.Addr, id util.ContentID, manifest *fs.Manifest) error {
+	p, err := dialPeer(rpc, certManager, transport, addr)
+	if err != nil {
+		return err
+	}
+
+	response, err := p.get(ctx, "/v1/object/"+id.String(), http.Header{"Range": {"bytes=0-"}})
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusForbidden:
+		return errors.New(ErrUnverifiableManifest)
+	default:
+		return errors.New("Peer Responded " + http.StatusText(response.StatusCode))
+	}
+
+	hasher, err := util.NewHasher(id.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	content := &countingReader{reader: io.TeeReader(response.Body, t.Writer(ctx, hasher))}
+
+	// the content of encrypted shares is opaque, only its hash can be checked
+	var entries []fs.ManifestEntry
+	if !manifest.Encrypted {
+		if entries, err = fs.ReadManifestEntries(content, id.Algorithm); err != nil {
+			return err
+		}
+	}
+
+	// the listing ends before the gzip trailer and any padding
+	if _, err := io.Copy(ioutil.Discard, content); err != nil {
+		return err
+	}
+
+	hashed, err := util.NewContentID(id.Algorithm, hasher.Sum(nil))
+	if err != nil || !hashed.Equal(id) {
+		return errors.New(ErrManifestMismatch)
+	}
+
+	manifest.Hash = id.String()
+	manifest.Size = content.n
+	manifest.Files = entries
+
+	return nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
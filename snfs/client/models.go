@@ -1,6 +1,15 @@
 package client
 
-import "net"
+import (
+	"net"
+	"time"
+
+	"github.com/alabianca/snfs/snfs/kad"
+	"github.com/alabianca/snfs/snfs/names"
+	"github.com/alabianca/snfs/snfs/portmap"
+	"github.com/alabianca/snfs/snfs/relay"
+	"github.com/alabianca/snfs/snfs/transfer"
+)
 
 type SubscribeRequest struct {
 	Instance string `json:"instance"`
@@ -39,6 +48,36 @@ type BootstrapRequest struct {
 }
 
 type StorageResponse struct {
+	Hash         string     `json:"hash"`
+	ByteWritten  int64      `json:"bytesWritten"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	MaxDownloads int        `json:"maxDownloads,omitempty"`
+	// Name is the record of the synced directory the share was published as the latest version of
+	Name *names.Record `json:"name,omitempty"`
+	// Replicas is how many other nodes are kept holding the share
+	Replicas int `json:"replicas,omitempty"`
+}
+
+type PublishRequest struct {
 	Hash string `json:"hash"`
-	ByteWritten int64 `json:"bytesWritten"`
+}
+
+type ACLRequest struct {
+	Peers []string `json:"peers"`
+}
+
+type StatusResponse struct {
+	NodeID       string          `json:"nodeId"`
+	Certificates bool            `json:"certificates"`
+	Transfers    transfer.Status `json:"transfers"`
+	// Relay is the relay this node is registered with
+	Relay *relay.ClientStatus `json:"relay,omitempty"`
+	// Relaying lists the nodes this node relays for
+	Relaying []relay.SessionStatus `json:"relaying"`
+	// Punch is the rendezvous this node is registered with for hole punching
+	Punch *kad.PunchStatus `json:"punch,omitempty"`
+	// PortMapping lists the ports forwarded on the router
+	PortMapping *portmap.Status `json:"portMapping,omitempty"`
+	// Replicas lists the replicated content this node holds
+	Replicas []ReplicaStatus `json:"replicas"`
 }
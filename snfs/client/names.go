@@ -0,0 +1,141 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/alabianca/snfs/snfs/certs"
+	"github.com/alabianca/snfs/snfs/fs"
+	"github.com/alabianca/snfs/snfs/kad"
+	"github.com/alabianca/snfs/snfs/names"
+	"github.com/alabianca/snfs/util"
+	"github.com/go-chi/chi"
+)
+
+type nameResponse struct {
+	Status  int          `json:"status"`
+	Message string       `json:"message"`
+	Record  names.Record `json:"data"`
+}
+
+func publishNameController(storage *fs.Manager, rpc *kad.RpcManager, registry *names.Registry) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		var publishReq PublishRequest
+		if err := json.NewDecoder(req.Body).Decode(&publishReq); err != nil {
+			util.Respond(res, util.Message(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		record, _, err := publishName(storage, rpc, registry, chi.URLParam(req, "label"), publishReq.Hash)
+		if err != nil {
+			util.Respond(res, util.Message(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		response := util.Message(http.StatusCreated, "OK")
+		response["data"] = record
+		util.Respond(res, response)
+	}
+}
+
+func resolveNameController(rpc *kad.RpcManager, certManager *certs.Manager, transport *peerTransport, registry *names.Registry) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		name := chi.URLParam(req, "name")
+		if _, err := util.ParseName(name); err != nil {
+			util.Respond(res, util.Message(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		record, err := resolveName(rpc, certManager, transport, registry, name)
+		if err != nil {
+			util.Respond(res, util.Message(http.StatusNotFound, "Could Not Resolve "+name+": "+err.Error()))
+			return
+		}
+
+		response := util.Message(http.StatusOK, "Ok")
+		response["data"] = record
+		util.Respond(res, response)
+	}
+}
+
+// publishName points label at hash and announces that the record is served by our object server
+func publishName(storage *fs.Manager, rpc *kad.RpcManager, registry *names.Registry, label, hash string) (names.Record, string, error) {
+	record, previous, err := registry.Publish(label, hash)
+	if err != nil {
+		return names.Record{}, "", err
+	}
+
+	// relayed nodes announce the relay's address
+	ip, port, err := storage.AnnounceAddr()
+	if err != nil {
+		return names.Record{}, "", err
+	}
+
+	if err := rpc.AnnounceName(record.Name, ip, port); err != nil {
+		return names.Record{}, "", err
+	}
+
+	return record, previous, nil
+}
+
+// resolveName returns the newest verified record of name. The record is fetched from the node the name
+// is announced by; when that node is unreachable or serves an older record the newest one seen is used
+func resolveName(rpc *kad.RpcManager, certManager *certs.Manager, transport *peerTransport, registry *names.Registry, name string) (names.Record, error) {
+	parsed, err := util.ParseName(name)
+	if err != nil {
+		return names.Record{}, err
+	}
+
+	cached, cachedErr := registry.Lookup(name)
+	if parsed.Publisher == registry.Publisher() {
+		return cached, cachedErr
+	}
+
+	record, err := fetchName(rpc, certManager, transport, name)
+	if err == nil {
+		if err = registry.Accept(record); err == nil {
+			return record, nil
+		}
+	}
+
+	if cachedErr != nil {
+		return names.Record{}, err
+	}
+
+	log.Printf("Names [Cached] %s #%d %s\n", name, cached.Sequence, err)
+	return cached, nil
+}
+
+// fetchName fetches the record of name from the node it is announced by
+func fetchName(rpc *kad.RpcManager, certManager *certs.Manager, transport *peerTransport, name string) (names.Record, error) {
+	addr, err := rpc.ResolveName(name)
+	if err != nil {
+		return names.Record{}, err
+	}
+
+	response, err := peerGet(rpc, certManager, transport, addr, "/v1/name/"+url.PathEscape(name))
+	if err != nil {
+		return names.Record{}, err
+	}
+
+	defer response.Body.Close()
+
+	var nameRes nameResponse
+	if err := json.NewDecoder(response.Body).Decode(&nameRes); err != nil {
+		return names.Record{}, err
+	}
+
+	if nameRes.Status != http.StatusOK {
+		return names.Record{}, errors.New(nameRes.Message)
+	}
+
+	// a valid record of another name is no answer
+	if nameRes.Record.Name != name {
+		return names.Record{}, errors.New(names.ErrInvalidSignature)
+	}
+
+	return nameRes.Record, nil
+}
@@ -0,0 +1,198 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alabianca/snfs/snfs/certs"
+	"github.com/alabianca/snfs/snfs/kad"
+)
+
+// RangeSize is the size of the ranges fetched in parallel from peers speaking QUIC
+const RangeSize = 4 * 1024 * 1024
+
+// ParallelRanges is the number of ranges in flight. It stays below the default
+// number of concurrent transfers a peer admits from us
+const ParallelRanges = 3
+
+// rangeTries bounds the attempts of a range the peer turned away as busy
+const rangeTries = 3
+
+// Errors
+const ErrInvalidRange = "Peer Sent An Invalid Range"
+
+// peerFetch fetches the object at path from the peer at addr. Over QUIC the object is fetched
+// as parallel ranges multiplexed on one connection and the response body puts them back in order
+func peerFetch(ctx context.Context, rpc *kad.RpcManager, certManager *certs.Manager, transport *peerTransport, addr net.Addr, path string) (*http.Response, error) {
+	p, err := dialPeer(rpc, certManager, transport, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !transport.speaksQUIC(addr.String()) {
+		return p.get(ctx, path, nil)
+	}
+
+	first, err := p.getRange(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// peers refuse ranges of shares with a download limit
+	if first.StatusCode == http.StatusForbidden {
+		first.Body.Close()
+		return p.get(ctx, path, nil)
+	}
+
+	if first.StatusCode != http.StatusPartialContent {
+		return first, nil
+	}
+
+	_, size, err := contentRange(first)
+	if err != nil {
+		first.Body.Close()
+		return nil, err
+	}
+
+	reader, writer := io.Pipe()
+	go p.fetchRanges(ctx, path, size, first, writer)
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/octet-stream"}},
+		Body:       reader,
+	}, nil
+}
+
+type rangeResult struct {
+	data []byte
+	err  error
+}
+
+// fetchRanges writes first and the ranges after it to w in order, keeping ParallelRanges in flight
+func (p *peer) fetchRanges(ctx context.Context, path string, size int64, first *http.Response, w *io.PipeWriter) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	_, err := io.Copy(w, first.Body)
+	first.Body.Close()
+	if err != nil {
+		w.CloseWithError(err)
+		return
+	}
+
+	count := int((size + RangeSize - 1) / RangeSize)
+	results := make([]chan rangeResult, count)
+	for i := range results {
+		results[i] = make(chan rangeResult, 1)
+	}
+
+	slots := make(chan struct{}, ParallelRanges)
+	go func() {
+		for i := 1; i < count; i++ {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			go func(i int) {
+				data, err := p.fetchRange(ctx, path, int64(i)*RangeSize, size)
+				results[i] <- rangeResult{data: data, err: err}
+			}(i)
+		}
+	}()
+
+	for i := 1; i < count; i++ {
+		var result rangeResult
+		select {
+		case result = <-results[i]:
+		case <-ctx.Done():
+			w.CloseWithError(ctx.Err())
+			return
+		}
+
+		<-slots
+		if result.err != nil {
+			w.CloseWithError(result.err)
+			return
+		}
+
+		if _, err := w.Write(result.data); err != nil {
+			return
+		}
+	}
+
+	w.Close()
+}
+
+// fetchRange reads the range starting at start of the object of size bytes
+func (p *peer) fetchRange(ctx context.Context, path string, start, size int64) ([]byte, error) {
+	for try := 1; ; try++ {
+		res, err := p.getRange(ctx, path, start)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.StatusCode == http.StatusServiceUnavailable && try < rangeTries {
+			res.Body.Close()
+			select {
+			case <-time.After(time.Duration(try) * time.Second):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			continue
+		}
+
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusPartialContent {
+			return nil, fmt.Errorf("Peer Responded %d For Range %d", res.StatusCode, start)
+		}
+
+		from, total, err := contentRange(res)
+		if err != nil || from != start || total != size {
+			return nil, errors.New(ErrInvalidRange)
+		}
+
+		return ioutil.ReadAll(res.Body)
+	}
+}
+
+func (p *peer) getRange(ctx context.Context, path string, start int64) (*http.Response, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+RangeSize-1))
+
+	return p.get(ctx, path, header)
+}
+
+// contentRange parses the start and the complete size of a partial response
+func contentRange(res *http.Response) (int64, int64, error) {
+	// bytes <first>-<last>/<size>
+	value := strings.TrimPrefix(res.Header.Get("Content-Range"), "bytes ")
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 {
+		return 0, 0, errors.New(ErrInvalidRange)
+	}
+
+	bounds := strings.Split(parts[0], "-")
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return 0, 0, errors.New(ErrInvalidRange)
+	}
+
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, errors.New(ErrInvalidRange)
+	}
+
+	return start, size, nil
+}
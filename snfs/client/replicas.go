@@ -0,0 +1,626 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alabianca/snfs/snfs/certs"
+	"github.com/alabianca/snfs/snfs/fs"
+	"github.com/alabianca/snfs/snfs/kad"
+	"github.com/alabianca/snfs/util"
+)
+
+const ReplicatorServiceName = "Replicator"
+
+// MaxReplicas bounds the replication factor of a share
+const MaxReplicas = kad.MaxReplicas
+
+// ReplicaCheckInterval is how often the providers of replicated content are counted
+const ReplicaCheckInterval = time.Minute
+
+// ReplicaPullTimeout is how long a slot a node was asked to fill is left alone before another node is asked
+const ReplicaPullTimeout = 10 * time.Minute
+
+// Errors
+const ErrReplicaQuota = "Replica Quota Exceeded"
+const ErrNoProvider = "No Provider Reachable"
+
+// ReplicaStatus describes replicated content this node holds. Slot is -1 while every slot is taken by other nodes
+type ReplicaStatus struct {
+	Hash      string    `json:"hash"`
+	Own       bool      `json:"own"`
+	Slot      int       `json:"slot"`
+	Replicas  int       `json:"replicas"`
+	Providers int       `json:"providers"`
+	Checked   time.Time `json:"checked"`
+}
+
+type replica struct {
+	id        util.ContentID
+	own       bool
+	slot      int
+	replicas  int
+	size      int64
+	providers int
+	checked   time.Time
+	// requested remembers when a node was asked to fill a slot
+	requested map[int]time.Time
+}
+
+// Replicator keeps replicated content at its replication factor. Every node holding a replica
+// counts the providers of its slots, reclaims its slot when it was lost and, when it holds the
+// lowest slot, asks willing nodes close to the content to pull replicas into the vacant slots.
+// Nodes with a quota accept replicas from others
+type Replicator struct {
+	storage     *fs.Manager
+	rpc         *kad.RpcManager
+	certManager *certs.Manager
+	transport   *peerTransport
+	quota       int64
+	mtx         sync.Mutex
+	held        map[string]*replica
+	// pulling holds the bytes reserved for each replica being pulled
+	pulling  map[string]int64
+	stop     chan struct{}
+	stopOnce sync.Once
+	id       []byte
+}
+
+func NewReplicator(storage *fs.Manager, rpc *kad.RpcManager, certManager *certs.Manager) *Replicator {
+	r := &Replicator{
+		storage:     storage,
+		rpc:         rpc,
+		certManager: certManager,
+		transport:   newPeerTransport(rpc, certManager),
+		held:        make(map[string]*replica),
+		pulling:     make(map[string]int64),
+		stop:        make(chan struct{}),
+		id:          make([]byte, 20),
+	}
+
+	util.RandomID(r.id)
+
+	return r
+}
+
+// SetQuota makes this node accept replicas of other nodes' content up to quota bytes
+func (r *Replicator) SetQuota(quota int64) {
+	r.quota = quota
+}
+
+// SetQUIC pulls replicas over QUIC from peers that advertise it
+func (r *Replicator) SetQUIC(enabled bool) {
+	r.transport.quic = enabled
+}
+
+// Track keeps the content identified by id, shared by this node, at replicas replicas
+func (r *Replicator) Track(id util.ContentID, replicas int) {
+	r.mtx.Lock()
+	r.held[id.String()] = &replica{id: id, own: true, replicas: replicas, requested: make(map[int]time.Time)}
+	r.mtx.Unlock()
+
+	go r.check(id.String())
+}
+
+// Status lists the replicated content this node holds
+func (r *Replicator) Status() []ReplicaStatus {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	status := make([]ReplicaStatus, 0, len(r.held))
+	for hash, rep := range r.held {
+		status = append(status, ReplicaStatus{
+			Hash:      hash,
+			Own:       rep.own,
+			Slot:      rep.slot,
+			Replicas:  rep.replicas,
+			Providers: rep.providers,
+			Checked:   rep.checked,
+		})
+	}
+
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Hash < status[j].Hash
+	})
+
+	return status
+}
+
+// Replicate accepts the request of the node with id requester to hold the content with hash in slot
+// and pulls it in the background. The requester has to be a provider of the content whose signed contact verifies
+func (r *Replicator) Replicate(hash string, slot, replicas int, requester string) error {
+	id, err := util.ParseContentID(hash)
+	if err != nil {
+		return err
+	}
+
+	if r.quota <= 0 {
+		return errors.New(fs.ErrNoReplicas)
+	}
+
+	if replicas > MaxReplicas {
+		return errors.New(fs.ErrInvalidSlot)
+	}
+
+	if !r.verifiedProvider(id, replicas, requester) {
+		return errors.New(fs.ErrUnverifiedPeer)
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, ok := r.held[hash]; ok {
+		return nil
+	}
+
+	if _, ok := r.pulling[hash]; ok {
+		return nil
+	}
+
+	if r.used() >= r.quota {
+		return errors.New(ErrReplicaQuota)
+	}
+
+	r.pulling[hash] = 0
+	go r.pull(id, slot, replicas)
+
+	return nil
+}
+
+// verifiedProvider reports whether the node with id requester provides the content identified by id
+// and presented a verified signed contact for the address it is announced at
+func (r *Replicator) verifiedProvider(id util.ContentID, replicas int, requester string) bool {
+	if !r.certManager.Enabled() {
+		return false
+	}
+
+	for _, addr := range r.rpc.Providers(id, replicas) {
+		if addr == nil {
+			continue
+		}
+
+		p, err := dialPeer(r.rpc, r.certManager, r.transport, addr)
+		if err == nil && p.contact != nil && p.contact.ID == requester {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pull fetches a replica of the content identified by id from one of its providers and announces it in slot
+func (r *Replicator) pull(id util.ContentID, slot, replicas int) {
+	hash := id.String()
+	defer func() {
+		r.mtx.Lock()
+		delete(r.pulling, hash)
+		r.mtx.Unlock()
+	}()
+
+	size, err := r.fetch(id, replicas)
+	if err != nil {
+		log.Printf("Replicas [Pull Error] %s %s\n", hash, err)
+		return
+	}
+
+	if err := r.announce(id, slot); err != nil {
+		log.Printf("Replicas [Announce Error] %s %s\n", hash, err)
+	}
+
+	r.mtx.Lock()
+	r.held[hash] = &replica{id: id, slot: slot, replicas: replicas, size: size, requested: make(map[int]time.Time)}
+	r.mtx.Unlock()
+
+	log.Printf("Replicas [Holding] %s slot %d/%d\n", hash, slot, replicas)
+}
+
+// fetch stores the content identified by id, fetched from the first provider that serves its manifest
+func (r *Replicator) fetch(id util.ContentID, replicas int) (int64, error) {
+	hash := id.String()
+	var manifest fs.Manifest
+	var source net.Addr
+	for _, addr := range r.rpc.Providers(id, replicas) {
+		if addr == nil {
+			continue
+		}
+
+		if fetched, err := r.fetchManifest(addr, hash); err == nil {
+			manifest, source = fetched, addr
+			break
+		}
+	}
+
+	if source == nil {
+		return 0, errors.New(ErrNoProvider)
+	}
+
+	// the space is reserved until the pull ends so concurrent pulls can't overrun the quota together
+	r.mtx.Lock()
+	remaining := r.quota - r.used()
+	if manifest.Size < 0 || manifest.Size > remaining {
+		r.mtx.Unlock()
+		return 0, errors.New(ErrReplicaQuota)
+	}
+	r.pulling[hash] = manifest.Size
+	r.mtx.Unlock()
+
+	t, err := startDownload(r.storage, source, hash)
+	if err != nil {
+		return 0, err
+	}
+
+	defer t.Finish()
+
+	ctx := context.Background()
+	response, err := peerFetch(ctx, r.rpc, r.certManager, r.transport, source, "/v1/object/"+hash)
+	if err != nil {
+		return 0, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s Responded %d", source, response.StatusCode)
+	}
+
+	hasher, err := util.NewHasher(id.Algorithm)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := fs.NewFile(r.storage.GetRoot(), hash)
+	if err != nil {
+		return 0, err
+	}
+
+	// the size in the manifest is the provider's claim, the transfer is cut off at the reservation
+	storageWriter := fs.NewWriter(hasher, file)
+	size, err := io.Copy(t.Writer(ctx, storageWriter), io.LimitReader(response.Body, manifest.Size+1))
+	storageWriter.Close()
+	if err != nil {
+		os.Remove(file.Name())
+		return 0, err
+	}
+
+	if size > manifest.Size {
+		os.Remove(file.Name())
+		return 0, errors.New(ErrReplicaQuota)
+	}
+
+	hashed, err := util.NewContentID(id.Algorithm, storageWriter.Sum(nil))
+	if err != nil || !hashed.Equal(id) {
+		os.Remove(file.Name())
+		return 0, errors.New("Hash does not match")
+	}
+
+	// the file listing is rebuilt from the verified content
+	if err := buildManifest(&manifest, file.Name(), hashed, manifest.Creator); err != nil {
+		os.Remove(file.Name())
+		return 0, err
+	}
+
+	// the creator's signature is served along as long as it covers the rebuilt listing
+	if len(manifest.Signature) > 0 && checkManifestSignature(r.certManager, hashed, manifest) != nil {
+		manifest.Signature = nil
+		manifest.Chain = nil
+	}
+
+	if err := r.storage.AddObject(hash, hashed, size, &manifest); err != nil {
+		os.Remove(file.Name())
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// fetchManifest fetches the manifest of the content with hash from the object server at addr
+func (r *Replicator) fetchManifest(addr net.Addr, hash string) (fs.Manifest, error) {
+	return peerManifest(r.rpc, r.certManager, r.transport, addr, hash)
+}
+
+// check counts the live providers of the content with hash and restores its replication factor
+func (r *Replicator) check(hash string) {
+	r.mtx.Lock()
+	rep, ok := r.held[hash]
+	if !ok {
+		r.mtx.Unlock()
+		return
+	}
+	id, slot, replicas := rep.id, rep.slot, rep.replicas
+	r.mtx.Unlock()
+
+	ip, port, err := r.storage.AnnounceAddr()
+	if err != nil {
+		log.Printf("Replicas [Check Error] %s %s\n", hash, err)
+		return
+	}
+
+	self := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+
+	// holders are the live providers by slot, a provider announced in several slots holds the lowest
+	holders := make([]string, replicas+1)
+	seen := make(map[string]bool)
+	for s, addr := range r.rpc.Providers(id, replicas) {
+		if addr == nil || seen[addr.String()] {
+			continue
+		}
+
+		if addr.String() != self {
+			if _, err := r.fetchManifest(addr, hash); err != nil {
+				continue
+			}
+		}
+
+		holders[s] = addr.String()
+		seen[addr.String()] = true
+	}
+
+	// reclaim a lost slot or take a vacant one
+	if !seen[self] {
+		if slot < 0 || slot > replicas || holders[slot] != "" {
+			slot = vacantSlot(holders, nil)
+		}
+
+		if slot >= 0 {
+			if err := r.announce(id, slot); err != nil {
+				log.Printf("Replicas [Announce Error] %s %s\n", hash, err)
+			}
+			holders[slot] = self
+		}
+	}
+
+	slot = -1
+	for s, holder := range holders {
+		if holder == self {
+			slot = s
+			break
+		}
+	}
+
+	// the lowest live slot coordinates, and takes over slot 0 content is resolved by
+	coordinator := false
+	for _, holder := range holders {
+		if holder != "" {
+			coordinator = holder == self
+			break
+		}
+	}
+
+	if coordinator && holders[0] == "" {
+		if err := r.announce(id, 0); err == nil {
+			holders[slot] = ""
+			holders[0] = self
+			slot = 0
+		}
+	}
+
+	providers := 0
+	for _, holder := range holders {
+		if holder != "" {
+			providers++
+		}
+	}
+
+	if coordinator && providers < replicas+1 {
+		r.recruit(id, replicas, holders, self)
+	}
+
+	r.mtx.Lock()
+	if rep, ok := r.held[hash]; ok {
+		rep.slot = slot
+		rep.providers = providers
+		rep.checked = time.Now()
+	}
+	r.mtx.Unlock()
+
+	if providers < replicas+1 {
+		log.Printf("Replicas [Providers] %s %d/%d\n", hash, providers, replicas+1)
+	}
+}
+
+// recruit asks willing nodes closest to the content identified by id to pull replicas into the vacant slots
+func (r *Replicator) recruit(id util.ContentID, replicas int, holders []string, self string) {
+	hash := id.String()
+
+	r.mtx.Lock()
+	rep, ok := r.held[hash]
+	if !ok {
+		r.mtx.Unlock()
+		return
+	}
+
+	now := time.Now()
+	pending := make(map[int]bool)
+	for s, at := range rep.requested {
+		if now.Sub(at) < ReplicaPullTimeout {
+			pending[s] = true
+		}
+	}
+	r.mtx.Unlock()
+
+	taken := make(map[string]bool)
+	for _, holder := range holders {
+		taken[holder] = true
+	}
+	taken[self] = true
+
+	slot := vacantSlot(holders, pending)
+	for _, node := range r.rpc.Closest(id) {
+		if slot < 0 {
+			return
+		}
+
+		addr, err := r.rpc.ResolveNode(node)
+		if err != nil || taken[addr.String()] {
+			continue
+		}
+
+		if err := r.request(addr, hash, slot, replicas); err != nil {
+			log.Printf("Replicas [Declined] %s %s %s\n", hash, addr, err)
+			continue
+		}
+
+		log.Printf("Replicas [Requested] %s slot %d from %s\n", hash, slot, addr)
+		taken[addr.String()] = true
+		pending[slot] = true
+
+		r.mtx.Lock()
+		rep.requested[slot] = now
+		r.mtx.Unlock()
+
+		slot = vacantSlot(holders, pending)
+	}
+}
+
+// request asks the object server at addr to pull the content with hash into slot
+func (r *Replicator) request(addr net.Addr, hash string, slot, replicas int) error {
+	p, err := dialPeer(r.rpc, r.certManager, r.transport, addr)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("slot", strconv.Itoa(slot))
+	query.Set("replicas", strconv.Itoa(replicas))
+	response, err := p.do(context.Background(), http.MethodPost, "/v1/replicate/"+hash+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusAccepted {
+		var body struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(response.Body).Decode(&body)
+		return errors.New(body.Message)
+	}
+
+	return nil
+}
+
+// announce announces this node as the provider of slot of the content identified by id
+func (r *Replicator) announce(id util.ContentID, slot int) error {
+	ip, port, err := r.storage.AnnounceAddr()
+	if err != nil {
+		return err
+	}
+
+	return r.rpc.AnnounceReplica(id, slot, ip, port)
+}
+
+// used is the size of the replicas held for other nodes and the space reserved by pulls in flight. The caller holds mtx
+func (r *Replicator) used() int64 {
+	var used int64
+	for _, rep := range r.held {
+		if !rep.own {
+			used += rep.size
+		}
+	}
+
+	for _, reserved := range r.pulling {
+		used += reserved
+	}
+
+	return used
+}
+
+// checkAll checks every replicated content this node still stores
+func (r *Replicator) checkAll() {
+	r.mtx.Lock()
+	hashes := make([]string, 0, len(r.held))
+	for hash := range r.held {
+		hashes = append(hashes, hash)
+	}
+	r.mtx.Unlock()
+
+	for _, hash := range hashes {
+		if _, err := r.storage.GetObjectPath(hash); err != nil {
+			r.mtx.Lock()
+			delete(r.held, hash)
+			r.mtx.Unlock()
+			continue
+		}
+
+		r.check(hash)
+	}
+}
+
+// announceNode announces this node to the nodes looking for replica holders while it has room
+func (r *Replicator) announceNode() {
+	r.mtx.Lock()
+	full := r.used() >= r.quota
+	r.mtx.Unlock()
+
+	if r.quota <= 0 || full {
+		return
+	}
+
+	ip, port, err := r.storage.AnnounceAddr()
+	if err == nil {
+		err = r.rpc.AnnounceNode(ip, port)
+	}
+
+	if err != nil {
+		log.Printf("Replicas [Announce Error] %s\n", err)
+	}
+}
+
+// vacantSlot returns the first slot above 0 without a holder or pending request, or -1
+func vacantSlot(holders []string, pending map[int]bool) int {
+	for s := 1; s < len(holders); s++ {
+		if holders[s] == "" && !pending[s] {
+			return s
+		}
+	}
+
+	return -1
+}
+
+// Service interface ID, Name, Run, Shutdown
+
+func (r *Replicator) ID() string {
+	return fmt.Sprintf("%x", r.id)
+}
+
+func (r *Replicator) Name() string {
+	return ReplicatorServiceName
+}
+
+func (r *Replicator) Run() error {
+	r.announceNode()
+
+	ticker := time.NewTicker(ReplicaCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.announceNode()
+			r.checkAll()
+		case <-r.stop:
+			return nil
+		}
+	}
+}
+
+func (r *Replicator) Shutdown() error {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+
+	return nil
+}
@@ -1,9 +1,11 @@
 package client
 
 import (
+	"github.com/alabianca/snfs/snfs/certs"
 	"github.com/alabianca/snfs/snfs/discovery"
 	"github.com/alabianca/snfs/snfs/fs"
 	"github.com/alabianca/snfs/snfs/kad"
+	"github.com/alabianca/snfs/snfs/names"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/render"
@@ -21,18 +23,20 @@ func restAPIRoutes(c *ConnectivityService) *chi.Mux {
 	)
 
 	router.Route("/api/v1", func(r chi.Router) {
-		r.Mount("/mdns", mdnsRoutes(c.discovery))
-		r.Mount("/storage", storageRoutes(c.storage, c.rpc))
+		r.Mount("/mdns", mdnsRoutes(c.discovery, c.certs))
+		r.Mount("/storage", storageRoutes(c.storage, c.rpc, c.certs, c.transport, c.names, c.replicator))
+		r.Mount("/names", nameRoutes(c.storage, c.rpc, c.certs, c.transport, c.names))
 		r.Mount("/kad", kadnetRoutes(c.rpc))
+		r.Get("/status", statusController(c))
 	})
 
 	return router
 }
 
-func mdnsRoutes(d *discovery.Manager) *chi.Mux {
+func mdnsRoutes(d *discovery.Manager, certManager *certs.Manager) *chi.Mux {
 	router := chi.NewRouter()
 
-	router.Post("/subscribe", startMDNSController(d))
+	router.Post("/subscribe", startMDNSController(d, certManager))
 	router.Post("/unsubscribe", stopMDNSController(d))
 	router.Get("/instance/{instance}", lookupMDNSController(d))
 	router.Get("/instance", getInstancesController(d))
@@ -40,11 +44,26 @@ func mdnsRoutes(d *discovery.Manager) *chi.Mux {
 	return router
 }
 
-func storageRoutes(storage *fs.Manager, rpc *kad.RpcManager) *chi.Mux {
+func storageRoutes(storage *fs.Manager, rpc *kad.RpcManager, certManager *certs.Manager, transport *peerTransport, registry *names.Registry, replicator *Replicator) *chi.Mux {
 	router := chi.NewRouter()
 
-	router.Post("/fname/{name}", storeFileController(storage, rpc))
-	router.Get("/fname/{hash}", getFileController(storage, rpc))
+	router.Post("/fname/{name}", storeFileController(storage, rpc, certManager, registry, replicator))
+	router.Get("/fname/{hash}", getFileController(storage, rpc, certManager, transport))
+	router.Get("/manifest/{hash}", getManifestController(storage, rpc, certManager, transport))
+	router.Get("/file/{hash}", getObjectFileController(storage, rpc, certManager, transport))
+	router.Get("/acl/{hash}", getACLController(storage))
+	router.Put("/acl/{hash}", setACLController(storage, certManager))
+	router.Post("/acl/{hash}/{peer}", addACLPeerController(storage, certManager))
+	router.Delete("/acl/{hash}/{peer}", removeACLPeerController(storage, certManager))
+
+	return router
+}
+
+func nameRoutes(storage *fs.Manager, rpc *kad.RpcManager, certManager *certs.Manager, transport *peerTransport, registry *names.Registry) *chi.Mux {
+	router := chi.NewRouter()
+
+	router.Post("/{label}", publishNameController(storage, rpc, registry))
+	router.Get("/{name}", resolveNameController(rpc, certManager, transport, registry))
 
 	return router
 }
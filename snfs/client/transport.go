@@ -0,0 +1,229 @@
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alabianca/snfs/snfs/certs"
+	"github.com/alabianca/snfs/snfs/kad"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// QUICRetry is how long a peer whose QUIC endpoint failed is only fetched from over HTTP/1.1
+const QUICRetry = 10 * time.Minute
+
+// quicPeer is what we learned about the QUIC endpoint of a peer
+type quicPeer struct {
+	port        int
+	expires     time.Time
+	failedUntil time.Time
+}
+
+// peerTransport carries the requests to the object servers of peers. Connections are shared
+// between requests, nodes behind NAT are punched through and peers advertising QUIC
+// (Alt-Svc h3) are fetched from over HTTP/3, falling back to HTTP/1.1 when QUIC fails
+type peerTransport struct {
+	rpc         *kad.RpcManager
+	certManager *certs.Manager
+	quic        bool
+	mtx         sync.Mutex
+	leaf        []byte
+	tcp         *http.Transport
+	h3          *http3.Transport
+	peers       map[string]*quicPeer
+}
+
+func newPeerTransport(rpc *kad.RpcManager, certManager *certs.Manager) *peerTransport {
+	return &peerTransport{
+		rpc:         rpc,
+		certManager: certManager,
+		peers:       make(map[string]*quicPeer),
+	}
+}
+
+func (t *peerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tcp, h3, err := t.transports()
+	if err != nil {
+		return nil, err
+	}
+
+	if h3 != nil {
+		if port, ok := t.quicPort(req.URL.Host); ok {
+			res, err := h3.RoundTrip(quicRequest(req, port))
+			if err == nil {
+				return res, nil
+			}
+
+			t.quicFailed(req.URL.Host, err)
+		}
+	}
+
+	res, err := tcp.RoundTrip(req)
+	if err == nil && h3 != nil {
+		t.learn(req.URL.Host, res.Header.Get("Alt-Svc"))
+	}
+
+	return res, err
+}
+
+// speaksQUIC reports whether requests to the peer at host go over QUIC
+func (t *peerTransport) speaksQUIC(host string) bool {
+	if !t.quic {
+		return false
+	}
+
+	_, ok := t.quicPort(host)
+	return ok
+}
+
+// transports returns the HTTP/1.1 and, when enabled, the HTTP/3 transport. They are
+// replaced once the certificate presented to peers was renewed
+func (t *peerTransport) transports() (*http.Transport, *http3.Transport, error) {
+	var config *tls.Config
+	if t.certManager.Enabled() {
+		var err error
+		if config, err = t.certManager.ClientConfig(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var leaf []byte
+	if config != nil && len(config.Certificates) > 0 && len(config.Certificates[0].Certificate) > 0 {
+		leaf = config.Certificates[0].Certificate[0]
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.tcp != nil && bytes.Equal(leaf, t.leaf) {
+		return t.tcp, t.h3, nil
+	}
+
+	if t.tcp != nil {
+		t.tcp.CloseIdleConnections()
+	}
+	if t.h3 != nil {
+		t.h3.Close()
+	}
+
+	t.leaf = leaf
+	t.tcp = http.DefaultTransport.(*http.Transport).Clone()
+	t.tcp.TLSClientConfig = config
+	t.tcp.DialContext = t.rpc.DialContext
+	t.h3 = nil
+
+	if t.quic {
+		// without TLS peers serve QUIC with a throwaway certificate, there is nothing to verify
+		quicConfig := &tls.Config{InsecureSkipVerify: true}
+		if config != nil {
+			quicConfig = config.Clone()
+		}
+		quicConfig.MinVersion = tls.VersionTLS13
+
+		t.h3 = &http3.Transport{TLSClientConfig: quicConfig}
+	}
+
+	return t.tcp, t.h3, nil
+}
+
+func (t *peerTransport) quicPort(host string) (int, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	peer, ok := t.peers[host]
+	if !ok {
+		return 0, false
+	}
+
+	now := time.Now()
+	if now.After(peer.expires) {
+		delete(t.peers, host)
+		return 0, false
+	}
+
+	return peer.port, now.After(peer.failedUntil)
+}
+
+func (t *peerTransport) quicFailed(host string, err error) {
+	log.Printf("QUIC [Failed] %s %s, falling back to HTTP/1.1\n", host, err)
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if peer, ok := t.peers[host]; ok {
+		peer.failedUntil = time.Now().Add(QUICRetry)
+	}
+}
+
+// learn remembers the QUIC endpoint the peer at host advertised in altSvc
+func (t *peerTransport) learn(host, altSvc string) {
+	port, maxAge, ok := parseAltSvc(altSvc)
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if !ok {
+		delete(t.peers, host)
+		return
+	}
+
+	peer, known := t.peers[host]
+	if !known || peer.port != port {
+		peer = &quicPeer{port: port}
+		t.peers[host] = peer
+	}
+	peer.expires = time.Now().Add(maxAge)
+}
+
+// parseAltSvc finds the h3 alternative on the same host in an Alt-Svc header
+func parseAltSvc(altSvc string) (int, time.Duration, bool) {
+	for _, alternative := range strings.Split(altSvc, ",") {
+		params := strings.Split(alternative, ";")
+		protocol := strings.SplitN(strings.TrimSpace(params[0]), "=", 2)
+		if len(protocol) != 2 || protocol[0] != "h3" {
+			continue
+		}
+
+		authority := strings.Trim(protocol[1], `"`)
+		if !strings.HasPrefix(authority, ":") {
+			continue
+		}
+
+		port, err := strconv.Atoi(authority[1:])
+		if err != nil {
+			continue
+		}
+
+		// 24 hours unless the peer said otherwise
+		maxAge := 24 * time.Hour
+		for _, param := range params[1:] {
+			if value := strings.TrimPrefix(strings.TrimSpace(param), "ma="); value != strings.TrimSpace(param) {
+				if seconds, err := strconv.Atoi(value); err == nil {
+					maxAge = time.Duration(seconds) * time.Second
+				}
+			}
+		}
+
+		return port, maxAge, true
+	}
+
+	return 0, 0, false
+}
+
+// quicRequest addresses req to the QUIC endpoint on port of the same host
+func quicRequest(req *http.Request, port int) *http.Request {
+	r := req.Clone(req.Context())
+	r.URL.Scheme = "https"
+	if host, _, err := net.SplitHostPort(req.URL.Host); err == nil {
+		r.URL.Host = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+
+	return r
+}
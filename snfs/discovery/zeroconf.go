@@ -6,6 +6,8 @@ import (
 	"net"
 	"time"
 
+	"github.com/alabianca/snfs/snfs/network"
+
 	"github.com/grandcat/zeroconf"
 )
 
@@ -26,6 +28,7 @@ type MdnsService struct {
 	service      string
 	domain       string
 	isStarted    bool
+	network      *network.Key
 }
 
 // Option is a variadic configuration function to be passed to Server(option)
@@ -56,6 +59,15 @@ func service(o ...Option) *MdnsService {
 // Register registers the MdnsService in the local network
 // at this point the service is disoverable under the "_snfs._tcp" service
 func (mdns *MdnsService) Register(instance string) error {
+	text := mdns.text
+	if mdns.network != nil {
+		sealed, err := mdns.network.Seal(text)
+		if err != nil {
+			return err
+		}
+		text = sealed
+	}
+
 	var err error
 	mdns.instanceName = instance
 	mdns.server, err = zeroconf.Register(
@@ -63,7 +75,7 @@ func (mdns *MdnsService) Register(instance string) error {
 		mdns.service,
 		mdns.domain,
 		mdns.port,
-		mdns.text,
+		text,
 		mdns.ifaces,
 	)
 
@@ -95,7 +107,9 @@ func (mdns *MdnsService) BrowseFor(duration time.Duration) ([]*zeroconf.ServiceE
 	out := make([]*zeroconf.ServiceEntry, 0)
 	go func(res <-chan *zeroconf.ServiceEntry) {
 		for entry := range res {
-			out = append(out, entry)
+			if mdns.open(entry) {
+				out = append(out, entry)
+			}
 		}
 	}(entries)
 
@@ -103,7 +117,7 @@ func (mdns *MdnsService) BrowseFor(duration time.Duration) ([]*zeroconf.ServiceE
 
 	defer cancel()
 
-	err = resolver.Browse(ctx, ZeroConfService, ZeroConfDomain, entries)
+	err = resolver.Browse(ctx, mdns.service, mdns.domain, entries)
 	if err != nil {
 		return nil, err
 	}
@@ -127,7 +141,7 @@ func (mdns *MdnsService) Lookup(ctx context.Context, instance string) ([]net.IP,
 	results := make(chan *zeroconf.ServiceEntry)
 	go func(res chan *zeroconf.ServiceEntry) {
 		for s := range res {
-			if s.Instance == instance {
+			if s.Instance == instance && mdns.open(s) {
 				entry = s
 				cancel()
 			}
@@ -137,7 +151,7 @@ func (mdns *MdnsService) Lookup(ctx context.Context, instance string) ([]net.IP,
 
 	log.Printf("MDNS [Lookup]: %s\n", instance)
 
-	resolver.Lookup(childCtx, instance, ZeroConfService, ZeroConfDomain, results)
+	resolver.Lookup(childCtx, instance, mdns.service, mdns.domain, results)
 
 	<-childCtx.Done()
 
@@ -148,6 +162,22 @@ func (mdns *MdnsService) Lookup(ctx context.Context, instance string) ([]net.IP,
 	return nil, nil
 }
 
+// open replaces the sealed text of entry with its plain text records.
+// It reports false for entries that were not sealed with our network key
+func (mdns *MdnsService) open(entry *zeroconf.ServiceEntry) bool {
+	if mdns.network == nil {
+		return true
+	}
+
+	text, err := mdns.network.Open(entry.Text)
+	if err != nil {
+		return false
+	}
+
+	entry.Text = text
+	return true
+}
+
 func (mdns *MdnsService) Text() []string {
 	return mdns.text
 }
@@ -199,3 +229,10 @@ func (mdns *MdnsService) SetService(s string) {
 func (mdns *MdnsService) IsStarted() bool {
 	return mdns.isStarted
 }
+
+// SetNetworkKey moves the service into the namespace of a private network
+// and seals its text records with the network key
+func (mdns *MdnsService) SetNetworkKey(k *network.Key) {
+	mdns.network = k
+	mdns.service = k.ServiceName(ZeroConfService)
+}
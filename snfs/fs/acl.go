@@ -0,0 +1,144 @@
+package fs
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/alabianca/snfs/snfs/certs"
+	"github.com/alabianca/snfs/util"
+	"github.com/go-chi/chi"
+)
+
+// Errors
+const ErrAccessDenied = "Access Denied"
+const ErrInvalidPeer = "Invalid Peer, Expected A Node ID"
+
+// Peer is the authenticated identity of a node requesting an object, taken from its client
+// certificate. Only the node id is bound to the certificate's key, by authd
+type Peer struct {
+	NodeID string
+}
+
+// SetACL restricts the content with id hash to peers, each given as node id.
+// An empty list makes the content public again
+func (m *Manager) SetACL(hash string, peers []string) error {
+	obj, err := m.findObject(hash)
+	if err != nil {
+		return err
+	}
+
+	acl := normalizeACL(peers)
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	key := obj.hash.String()
+	p, ok := m.policies[key]
+	if !ok {
+		p = &policy{}
+		m.policies[key] = p
+	}
+	p.acl = acl
+
+	return nil
+}
+
+// ACL returns the peers the content with id hash is restricted to
+func (m *Manager) ACL(hash string) ([]string, error) {
+	if _, err := m.findObject(hash); err != nil {
+		return nil, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	p := m.policyOf(hash)
+	if p == nil {
+		return []string{}, nil
+	}
+
+	return append([]string{}, p.acl...), nil
+}
+
+// Allowed reports whether peer may fetch the content with id hash.
+// Content without ACL is public, restricted objects are never served to anonymous peers
+func (m *Manager) Allowed(hash string, peer *Peer) bool {
+	acl, err := m.ACL(hash)
+	if err != nil || len(acl) == 0 {
+		return true
+	}
+
+	if peer == nil {
+		return false
+	}
+
+	for _, entry := range acl {
+		if entry == peer.NodeID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// peerFromRequest returns the identity of the peer's client certificate, or nil without one
+func peerFromRequest(req *http.Request) *Peer {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+
+	id, err := certs.NodeID(req.TLS.PeerCertificates[0])
+	if err != nil {
+		return nil
+	}
+
+	return &Peer{NodeID: id}
+}
+
+// restricted only passes requests for objects whose ACL admits the requesting peer
+func restricted(fs *Manager, next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if !fs.Allowed(chi.URLParam(req, "hash"), peerFromRequest(req)) {
+			util.Respond(res, util.Message(http.StatusForbidden, ErrAccessDenied))
+			return
+		}
+
+		next(res, req)
+	}
+}
+
+// normalizeACL normalizes peers and drops duplicates
+func normalizeACL(peers []string) []string {
+	acl := make([]string, 0, len(peers))
+	seen := make(map[string]bool)
+	for _, peer := range peers {
+		peer = normalizePeer(peer)
+		if peer == "" || seen[peer] {
+			continue
+		}
+
+		seen[peer] = true
+		acl = append(acl, peer)
+	}
+
+	return acl
+}
+
+// normalizePeer accepts node ids in either case
+func normalizePeer(peer string) string {
+	return strings.ToLower(strings.TrimSpace(peer))
+}
+
+// ValidatePeers checks that every peer is a node id, the hex encoded 20 byte DHT id
+func ValidatePeers(peers []string) error {
+	for _, peer := range peers {
+		id, err := hex.DecodeString(normalizePeer(peer))
+		if err != nil || len(id) != 20 {
+			return errors.New(ErrInvalidPeer + " " + peer)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package fs
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Errors
+const ErrNotChunked = "File Has No Chunks"
+const ErrInvalidChunks = "Invalid Chunk List"
+
+// entryReader streams a single entry out of a stored archive
+type entryReader struct {
+	io.Reader
+	file *os.File
+	gzr  *gzip.Reader
+}
+
+func (e *entryReader) Close() error {
+	e.gzr.Close()
+	return e.file.Close()
+}
+
+// OpenObjectEntry returns a reader over the content of the regular file name
+// inside the archive of the object with content id hash, along with its size.
+// Entries of encrypted objects cannot be read
+func (m *Manager) OpenObjectEntry(hash, name string) (io.ReadCloser, int64, error) {
+	if manifest, err := m.GetManifest(hash); err == nil && manifest.Encrypted {
+		return nil, 0, errors.New("Object Is Encrypted")
+	}
+
+	objectPath, err := m.GetObjectPath(hash)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	file, err := os.Open(objectPath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	name = strings.TrimPrefix(name, "/")
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			err = errors.New("Entry Not Found")
+		}
+
+		if err != nil {
+			gzr.Close()
+			file.Close()
+			return nil, 0, err
+		}
+
+		if header.Typeflag == tar.TypeReg && header.Name == name {
+			return &entryReader{Reader: tr, file: file, gzr: gzr}, header.Size, nil
+		}
+	}
+}
+
+// chunkSelection reads the wanted chunks of an entry and skips the others
+type chunkSelection struct {
+	io.ReadCloser
+	chunks    []ManifestChunk
+	wanted    map[int]bool
+	next      int
+	remaining int64
+}
+
+func (c *chunkSelection) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.next >= len(c.chunks) {
+			return 0, io.EOF
+		}
+
+		chunk := c.chunks[c.next]
+		wanted := c.wanted[c.next]
+		c.next++
+
+		if !wanted {
+			if _, err := io.CopyN(ioutil.Discard, c.ReadCloser, chunk.Size); err != nil {
+				return 0, err
+			}
+
+			continue
+		}
+
+		c.remaining = chunk.Size
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+
+	n, err := c.ReadCloser.Read(p)
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		err = nil
+		if c.remaining > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+
+	return n, err
+}
+
+// OpenObjectChunks returns a reader over the chunks of the regular file name listed in wanted,
+// in the order they appear in the file, along with their combined size
+func (m *Manager) OpenObjectChunks(hash, name string, wanted []int) (io.ReadCloser, int64, error) {
+	manifest, err := m.GetManifest(hash)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var chunks []ManifestChunk
+	name = strings.TrimPrefix(name, "/")
+	for _, entry := range manifest.Files {
+		if entry.Type == EntryFile && entry.Path == name {
+			chunks = entry.Chunks
+			break
+		}
+	}
+
+	if len(chunks) == 0 {
+		return nil, 0, errors.New(ErrNotChunked)
+	}
+
+	selected := make(map[int]bool)
+	var size int64
+	for _, i := range wanted {
+		if i < 0 || i >= len(chunks) || selected[i] {
+			return nil, 0, errors.New(ErrInvalidChunks)
+		}
+
+		selected[i] = true
+		size += chunks[i].Size
+	}
+
+	entry, _, err := m.OpenObjectEntry(hash, name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &chunkSelection{ReadCloser: entry, chunks: chunks, wanted: selected}, size, nil
+}
@@ -0,0 +1,180 @@
+package fs
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/alabianca/snfs/util"
+	"github.com/go-chi/chi"
+)
+
+// GCInterval is how often expired objects are collected
+const GCInterval = time.Minute
+
+// Errors
+const ErrShareExpired = "Share Expired"
+const ErrWholeShareOnly = "Shares With A Download Limit Can Only Be Fetched Whole"
+
+// Withdrawer drops this node's object server from the DHT providers of content
+type Withdrawer interface {
+	Withdraw(id util.ContentID, ip net.IP, port int) error
+}
+
+// SetWithdrawer makes the garbage collector withdraw expired content from the DHT
+func (m *Manager) SetWithdrawer(withdrawer Withdrawer) {
+	m.withdrawer = withdrawer
+}
+
+// Expiry limits how long and how often an object is served. Zero values mean no limit
+type Expiry struct {
+	ExpiresAt    time.Time
+	MaxDownloads int
+}
+
+// Supersede makes the content with id hash expire at at, unless it is shared again before.
+// Previous versions of a feed are collected like this
+func (m *Manager) Supersede(hash string, at time.Time) error {
+	obj, err := m.findObject(hash)
+	if err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	key := obj.hash.String()
+	p, ok := m.policies[key]
+	if !ok {
+		p = &policy{}
+		m.policies[key] = p
+	}
+	p.expiry.ExpiresAt = at
+	p.superseded = true
+
+	return nil
+}
+
+// Expired reports whether the content with id hash is no longer served
+func (m *Manager) Expired(hash string) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.policyOf(hash).expired(time.Now())
+}
+
+// downloadLimited reports whether the content with id hash may only be downloaded a limited number of times
+func (m *Manager) downloadLimited(hash string) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	p := m.policyOf(hash)
+	return p != nil && p.expiry.MaxDownloads > 0
+}
+
+// claimDownload counts a download of the content with id hash.
+// It fails once the content expired or ran out of downloads
+func (m *Manager) claimDownload(hash string) error {
+	if _, err := m.findObject(hash); err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	p := m.policyOf(hash)
+	if p.expired(time.Now()) {
+		return errors.New(ErrShareExpired)
+	}
+
+	if p != nil {
+		p.downloads++
+	}
+
+	return nil
+}
+
+// collect deletes the objects holding expired content and withdraws this node's announcements of it.
+// The DHT keys are shared by every node providing the same content, so the others' announcements stay
+func (m *Manager) collect() {
+	now := time.Now()
+	expired := make([]util.ContentID, 0)
+
+	m.mtx.Lock()
+	for name, obj := range m.objects {
+		if !m.policies[obj.hash.String()].expired(now) {
+			continue
+		}
+
+		if err := m.delete(name); err != nil {
+			log.Printf("GC [Error] %s %s\n", name, err)
+			continue
+		}
+
+		if !m.holds(obj.hash) {
+			expired = append(expired, obj.hash)
+		}
+	}
+	m.mtx.Unlock()
+
+	if len(expired) == 0 {
+		return
+	}
+
+	ip, port, addrErr := m.AnnounceAddr()
+	for _, id := range expired {
+		log.Printf("GC [Expired] %s\n", id)
+		if m.withdrawer == nil {
+			continue
+		}
+
+		err := addrErr
+		if err == nil {
+			err = m.withdrawer.Withdraw(id, ip, port)
+		}
+
+		if err != nil {
+			log.Printf("GC [Withdraw Error] %s %s\n", id, err)
+		}
+	}
+}
+
+func (m *Manager) gc(stop chan struct{}) {
+	ticker := time.NewTicker(GCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.collect()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// available refuses requests for expired objects
+func available(fs *Manager, next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if fs.Expired(chi.URLParam(req, "hash")) {
+			util.Respond(res, util.Message(http.StatusGone, ErrShareExpired))
+			return
+		}
+
+		next(res, req)
+	}
+}
+
+// whole refuses partial fetches of objects with a download limit, they could not be counted
+func whole(fs *Manager, next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if fs.downloadLimited(chi.URLParam(req, "hash")) {
+			util.Respond(res, util.Message(http.StatusForbidden, ErrWholeShareOnly))
+			return
+		}
+
+		next(res, req)
+	}
+}
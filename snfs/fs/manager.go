@@ -2,14 +2,18 @@ package fs
 
 import (
 	"archive/tar"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
+	"sync"
 
+	"github.com/alabianca/snfs/snfs/transfer"
 	"github.com/alabianca/snfs/util"
 
 	"github.com/mitchellh/go-homedir"
@@ -20,17 +24,32 @@ const ServiceName = "StorageManager"
 // Manager maintains a list of files that are currently
 // shared in the local network
 type Manager struct {
-	root    string
-	objects map[string]*object
+	root       string
+	objects    map[string]*object
+	policies   map[string]*policy
+	records    NameLookup
 	fileServer *server
-	id      []byte
+	tlsConfig  *tls.Config
+	signer     ContactSigner
+	mtx        sync.Mutex
+	stop       chan struct{}
+	transfers  *transfer.Scheduler
+	relay      Relay
+	puncher    net.Listener
+	mapper     PortMapper
+	quic       bool
+	replicator Replicator
+	withdrawer Withdrawer
+	id         []byte
 }
 
 // NewManager returns a Manager with zero files
 func NewManager() *Manager {
 	m := &Manager{
-		objects: make(map[string]*object),
-		id:      make([]byte, 20),
+		objects:   make(map[string]*object),
+		policies:  make(map[string]*policy),
+		transfers: transfer.NewScheduler(transfer.DefaultLimits()),
+		id:        make([]byte, 20),
 	}
 
 	util.RandomID(m.id)
@@ -49,6 +68,63 @@ func (m *Manager) SetRoot(dir string) {
 
 }
 
+// SetTLSConfig makes the file server serve objects over TLS using config
+func (m *Manager) SetTLSConfig(config *tls.Config) {
+	m.tlsConfig = config
+}
+
+// SetRelay makes the file server accept connections forwarded by a relay
+// and announce objects at the relay's address
+func (m *Manager) SetRelay(relay Relay) {
+	m.relay = relay
+}
+
+// SetPuncher makes the file server accept connections punched through the NAT
+func (m *Manager) SetPuncher(puncher net.Listener) {
+	m.puncher = puncher
+}
+
+// SetPortMapper makes objects announced at the router's address once the file port is forwarded
+func (m *Manager) SetPortMapper(mapper PortMapper) {
+	m.mapper = mapper
+}
+
+// AnnounceAddr returns the address peers fetch objects from, the relay's when the node is relayed
+// and the router's when the file port is forwarded
+func (m *Manager) AnnounceAddr() (net.IP, int, error) {
+	if m.relay != nil {
+		addr, err := m.relay.ObjectAddr()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return addr.IP, addr.Port, nil
+	}
+
+	if m.mapper != nil {
+		if addr, err := m.mapper.ObjectAddr(); err == nil {
+			return addr.IP, addr.Port, nil
+		}
+	}
+
+	host := os.Getenv("SNFS_HOST")
+	if host == "" {
+		return nil, 0, errors.New("SNFS_HOST Environment Variable Not Set")
+	}
+
+	port, err := strconv.ParseInt(os.Getenv("SNFS_FS_PORT"), 10, 16)
+	if err != nil || port == 0 {
+		return nil, 0, errors.New("SNFS_FS_PORT Environment Variable Not Set")
+	}
+
+	return net.ParseIP(host), int(port), nil
+}
+
+// SetContactSigner makes the file server serve this node's signed contact
+func (m *Manager) SetContactSigner(signer ContactSigner) {
+	m.signer = signer
+}
+
 // CreateRootDir creates the root dir if it does not yet exist
 // calling CreateRootDir before calling SetRoot results in a "Root Unset" error
 func (m *Manager) CreateRootDir() error {
@@ -65,45 +141,176 @@ func (m *Manager) CreateRootDir() error {
 	return nil
 }
 
-// AddObject adds a file object to manager's memory
-// if the object with specified name already exists, the manager attempts to delete it
-// if there is an error it is of type PathError as a result of a failed deletion
-func (m *Manager) AddObject(name, hash string, size int64) error {
-	_, ok := m.objects[name]
-	if ok {
-		if err := m.delete(name); err != nil {
-			return err
+// AddObject adds a file object along with its manifest to manager's memory.
+// The file at name is written by the caller, so an existing object with that name
+// is never deleted. If it holds the same content it is kept as is, otherwise it is replaced.
+// Content that is already held keeps its policy, new content is public
+func (m *Manager) AddObject(name string, hash util.ContentID, size int64, manifest *Manifest) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.add(name, hash, size, manifest)
+
+	return nil
+}
+
+// Share adds the object like AddObject and shares its content with p. Content that is already
+// held keeps its policy, sharing it again with another one fails with ErrPolicyConflict. The file at
+// name is removed then, unless it belongs to an object holding the same content
+func (m *Manager) Share(name string, hash util.ContentID, size int64, manifest *Manifest, p Policy) error {
+	acl := normalizeACL(p.ACL)
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	key := hash.String()
+	current := m.policies[key]
+	if m.holds(hash) {
+		// a previous version of a feed is current again once shared again, only its ACL has to match
+		held := current
+		if current != nil && current.superseded {
+			held = &policy{acl: current.acl, expiry: p.Expiry}
+		}
+
+		if !held.same(acl, p.Expiry) {
+			if obj, ok := m.objects[name]; !ok {
+				os.Remove(path.Join(m.root, name))
+			} else if !obj.hash.Equal(hash) {
+				// the object's file was overwritten with the new content already
+				m.delete(name)
+			}
+
+			return errors.New(ErrPolicyConflict)
+		}
+
+		if current == nil || !current.superseded {
+			m.add(name, hash, size, manifest)
+			return nil
 		}
 	}
 
-	m.objects[name] = &object{
-		name: name,
-		hash: hash,
-		size: size,
+	m.add(name, hash, size, manifest)
+	if len(acl) == 0 && p.Expiry == (Expiry{}) {
+		delete(m.policies, key)
+		return nil
 	}
 
+	m.policies[key] = &policy{acl: acl, expiry: p.Expiry}
+
 	return nil
 }
 
-func (m *Manager) GetObjectPath(name string) (string, error) {
-	obj, ok := m.objects[name]
-	if !ok {
-		return "", errors.New("Object Not Found")
+// add indexes the object. The caller holds mtx
+func (m *Manager) add(name string, hash util.ContentID, size int64, manifest *Manifest) {
+	if obj, ok := m.objects[name]; ok {
+		if obj.hash.Equal(hash) {
+			return
+		}
+
+		m.forget(obj)
+	}
+
+	m.objects[name] = &object{
+		name:     name,
+		hash:     hash,
+		size:     size,
+		manifest: manifest,
+	}
+}
+
+// holds reports whether an object holds the content with id. The caller holds mtx
+func (m *Manager) holds(id util.ContentID) bool {
+	for _, obj := range m.objects {
+		if obj.hash.Equal(id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetObjectPath returns the storage path of the object with content id hash.
+// Legacy SHA-1 hashes without an algorithm prefix are accepted
+func (m *Manager) GetObjectPath(hash string) (string, error) {
+	obj, err := m.findObject(hash)
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(m.root, obj.name), nil
+}
+
+// GetManifest returns the manifest of the object with content id hash
+func (m *Manager) GetManifest(hash string) (*Manifest, error) {
+	obj, err := m.findObject(hash)
+	if err != nil {
+		return nil, err
 	}
 
-	return path.Join(m.root, obj.hash), nil
+	if obj.manifest == nil {
+		return nil, errors.New("Manifest Not Found")
+	}
+
+	return obj.manifest, nil
 }
 
+// findObject returns the object holding the content with id hash. When several names hold
+// it, the first name in order is picked
+func (m *Manager) findObject(hash string) (*object, error) {
+	id, err := util.ParseContentID(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var found *object
+	for _, obj := range m.objects {
+		if obj.hash.Equal(id) && (found == nil || obj.name < found.name) {
+			found = obj
+		}
+	}
+
+	if found == nil {
+		return nil, errors.New("Object Not Found")
+	}
+
+	return found, nil
+}
+
+// policyOf returns the policy of the content with id hash, nil for public content. The caller holds mtx
+func (m *Manager) policyOf(hash string) *policy {
+	id, err := util.ParseContentID(hash)
+	if err != nil {
+		return nil
+	}
+
+	return m.policies[id.String()]
+}
+
+// delete removes the object called name from disk and the index. The caller holds mtx
 func (m *Manager) delete(name string) error {
 	if err := os.Remove(path.Join(m.root, name)); err != nil {
 		return err
 	}
 
-	delete(m.objects, name)
+	if obj, ok := m.objects[name]; ok {
+		m.forget(obj)
+	}
 
 	return nil
 }
 
+// forget drops obj from the index, and the policy of its content once no other object holds it.
+// The caller holds mtx
+func (m *Manager) forget(obj *object) {
+	delete(m.objects, obj.name)
+	if !m.holds(obj.hash) {
+		delete(m.policies, obj.hash.String())
+	}
+}
+
 // Service
 
 func (m *Manager) Run() error {
@@ -121,10 +328,18 @@ func (m *Manager) Run() error {
 		return err
 	}
 	m.fileServer = &server{
-		addr: os.Getenv("SNFS_HOST"),
-		port: int(port),
+		addr:      os.Getenv("SNFS_HOST"),
+		port:      int(port),
+		tlsConfig: m.tlsConfig,
+		limits:    m.transfers.Limits(),
+		relay:     m.relay,
+		puncher:   m.puncher,
+		quic:      m.quic,
 	}
 
+	m.stop = make(chan struct{})
+	go m.gc(m.stop)
+
 	return m.fileServer.listen(m)
 }
 
@@ -133,6 +348,14 @@ func (m *Manager) ID() string {
 }
 
 func (m *Manager) Shutdown() error {
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
 	for k, _ := range m.objects {
 		m.delete(k)
 	}
@@ -0,0 +1,181 @@
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/alabianca/snfs/util"
+)
+
+// Manifest entry types
+const (
+	EntryFile     = "file"
+	EntryDir      = "dir"
+	EntrySymlink  = "symlink"
+	EntryHardLink = "hardlink"
+)
+
+// Manifest describes a share so peers can browse it before cloning.
+// Size is the size of the compressed archive, Ignore lists the effective
+// ignore rules (.snfsignore followed by --exclude patterns).
+// Encrypted shares are stored as ciphertext and have no file listing.
+// Feed is the label a synced directory's versions are published under.
+// Signature is made by the creator over SignedData with the key of the certificate in Chain
+type Manifest struct {
+	Hash        string          `json:"hash"`
+	Creator     string          `json:"creator"`
+	Description string          `json:"description"`
+	Size        int64           `json:"size"`
+	Files       []ManifestEntry `json:"files"`
+	Ignore      []string        `json:"ignore"`
+	Encrypted   bool            `json:"encrypted"`
+	Feed        string          `json:"feed,omitempty"`
+	Signature   []byte          `json:"signature,omitempty"`
+	Chain       [][]byte        `json:"chain,omitempty"`
+}
+
+// SignedData returns the bytes the creator signs: the manifest without its signature and chain.
+// Modification times are in UTC, so a listing rebuilt in another time zone signs the same
+func (m Manifest) SignedData() ([]byte, error) {
+	m.Signature = nil
+	m.Chain = nil
+
+	files := make([]ManifestEntry, len(m.Files))
+	for i, entry := range m.Files {
+		entry.ModTime = entry.ModTime.UTC()
+		files[i] = entry
+	}
+	m.Files = files
+
+	bts, err := json.Marshal(&m)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte("snfs-manifest|"), bts...), nil
+}
+
+// ManifestEntry is a single entry of a share's archive.
+// Chunks lists the content defined chunks of files larger than one chunk
+type ManifestEntry struct {
+	Path    string          `json:"path"`
+	Type    string          `json:"type"`
+	Size    int64           `json:"size"`
+	Mode    os.FileMode     `json:"mode"`
+	ModTime time.Time       `json:"modTime"`
+	Hash    string          `json:"hash,omitempty"`
+	Link    string          `json:"link,omitempty"`
+	Chunks  []ManifestChunk `json:"chunks,omitempty"`
+}
+
+// ManifestChunk is a chunk of a file, so a clone can reuse the chunks it already has
+type ManifestChunk struct {
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+// ReadManifestEntries lists the entries of the gzipped tarball in reader.
+// Regular files are hashed and chunked with algorithm
+func ReadManifestEntries(reader io.Reader, algorithm string) ([]ManifestEntry, error) {
+	gzr, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	defer gzr.Close()
+
+	entries := make([]ManifestEntry, 0)
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		entry := ManifestEntry{
+			Path:    header.Name,
+			Size:    header.Size,
+			Mode:    header.FileInfo().Mode().Perm(),
+			ModTime: header.ModTime,
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			entry.Type = EntryDir
+
+		case tar.TypeSymlink:
+			entry.Type = EntrySymlink
+			entry.Link = header.Linkname
+
+		case tar.TypeLink:
+			entry.Type = EntryHardLink
+			entry.Link = header.Linkname
+
+		case tar.TypeReg:
+			entry.Type = EntryFile
+			id, chunks, err := chunkReader(tr, algorithm)
+			if err != nil {
+				return nil, err
+			}
+
+			entry.Hash = id.String()
+			if len(chunks) > 1 {
+				entry.Chunks = chunks
+			}
+
+		default:
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+}
+
+func hashReader(reader io.Reader, algorithm string) (util.ContentID, error) {
+	hasher, err := util.NewHasher(algorithm)
+	if err != nil {
+		return util.ContentID{}, err
+	}
+
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return util.ContentID{}, err
+	}
+
+	return util.NewContentID(algorithm, hasher.Sum(nil))
+}
+
+// chunkReader hashes the content of reader along with each of its chunks
+func chunkReader(reader io.Reader, algorithm string) (util.ContentID, []ManifestChunk, error) {
+	hasher, err := util.NewHasher(algorithm)
+	if err != nil {
+		return util.ContentID{}, nil, err
+	}
+
+	chunks := make([]ManifestChunk, 0)
+	err = util.SplitChunks(reader, func(data []byte) error {
+		hasher.Write(data)
+		id, err := hashReader(bytes.NewReader(data), algorithm)
+		if err != nil {
+			return err
+		}
+
+		chunks = append(chunks, ManifestChunk{Size: int64(len(data)), Hash: id.String()})
+		return nil
+	})
+
+	if err != nil {
+		return util.ContentID{}, nil, err
+	}
+
+	id, err := util.NewContentID(algorithm, hasher.Sum(nil))
+	return id, chunks, err
+}
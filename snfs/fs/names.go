@@ -0,0 +1,38 @@
+package fs
+
+import (
+	"net/http"
+
+	"github.com/alabianca/snfs/snfs/names"
+	"github.com/alabianca/snfs/util"
+	"github.com/go-chi/chi"
+)
+
+// NameLookup hands out the name records this node holds. It is implemented by names.Registry
+type NameLookup interface {
+	Lookup(name string) (names.Record, error)
+}
+
+// SetNames makes the object server hand out the records of names published by or seen by this node
+func (m *Manager) SetNames(records NameLookup) {
+	m.records = records
+}
+
+func getName(fs *Manager) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if fs.records == nil {
+			util.Respond(res, util.Message(http.StatusNotFound, names.ErrNameNotFound))
+			return
+		}
+
+		record, err := fs.records.Lookup(chi.URLParam(req, "name"))
+		if err != nil {
+			util.Respond(res, util.Message(http.StatusNotFound, names.ErrNameNotFound))
+			return
+		}
+
+		response := util.Message(http.StatusOK, "Ok")
+		response["data"] = record
+		util.Respond(res, response)
+	}
+}
@@ -1,7 +1,74 @@
 package fs
 
+import (
+	"sort"
+	"time"
+
+	"github.com/alabianca/snfs/util"
+)
+
+// ErrPolicyConflict is returned when content that is already held is shared with another policy
+const ErrPolicyConflict = "Content Is Already Shared With Another ACL Or Expiry"
+
+// object is an entry of the manager's index
 type object struct {
-	name string
-	hash string
-	size int64
+	name     string
+	hash     util.ContentID
+	size     int64
+	manifest *Manifest
+}
+
+// Policy restricts who may fetch content and for how long. The zero Policy shares content publicly
+type Policy struct {
+	ACL    []string
+	Expiry Expiry
+}
+
+// policy is the Policy of content along with its downloads. Policies are kept per content id,
+// since the same content may be stored under several names. Guarded by the manager's mtx
+type policy struct {
+	acl       []string
+	expiry    Expiry
+	downloads int
+	// superseded is set for previous versions of a feed, which expire unless shared again
+	superseded bool
+}
+
+// same reports whether p shares content like acl and expiry do. A nil p shares it publicly
+func (p *policy) same(acl []string, expiry Expiry) bool {
+	var current []string
+	var currentExpiry Expiry
+	if p != nil {
+		current, currentExpiry = p.acl, p.expiry
+	}
+
+	if len(current) != len(acl) || !currentExpiry.ExpiresAt.Equal(expiry.ExpiresAt) || currentExpiry.MaxDownloads != expiry.MaxDownloads {
+		return false
+	}
+
+	// ACLs hold every peer once
+	want := append([]string{}, acl...)
+	have := append([]string{}, current...)
+	sort.Strings(want)
+	sort.Strings(have)
+	for i := range want {
+		if want[i] != have[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// expired reports whether p passed its deadline or used up its downloads
+func (p *policy) expired(now time.Time) bool {
+	if p == nil {
+		return false
+	}
+
+	if !p.expiry.ExpiresAt.IsZero() && now.After(p.expiry.ExpiresAt) {
+		return true
+	}
+
+	return p.expiry.MaxDownloads > 0 && p.downloads >= p.expiry.MaxDownloads
 }
@@ -0,0 +1,101 @@
+package fs
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// AltSvcMaxAge is how long peers may remember that this node speaks QUIC, in seconds
+const AltSvcMaxAge = 3600
+
+// SetQUIC makes the file server serve objects over QUIC (HTTP/3) as well,
+// on the UDP port with the number of the file port
+func (m *Manager) SetQUIC(enabled bool) {
+	m.quic = enabled
+}
+
+// advertisesQUIC reports whether peers reach the QUIC endpoint at the address they fetched from.
+// Relays and routers only forward the TCP port of the file server
+func (m *Manager) advertisesQUIC() bool {
+	if !m.quic || m.relay != nil {
+		return false
+	}
+
+	if m.mapper != nil {
+		if _, err := m.mapper.ObjectAddr(); err == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// serveQUIC serves the object routes over HTTP/3. Nodes without TLS use a throwaway
+// certificate, QUIC can't do without one
+func (s *server) serveQUIC() {
+	config := s.tlsConfig
+	if config == nil {
+		var err error
+		if config, err = ephemeralTLSConfig(); err != nil {
+			log.Printf("QUIC [Error] %s\n", err)
+			return
+		}
+	}
+
+	quicServer := &http3.Server{
+		Addr:        s.server.Addr,
+		Handler:     s.server.Handler,
+		TLSConfig:   http3.ConfigureTLSConfig(config),
+		IdleTimeout: s.limits.IdleTimeout,
+	}
+
+	log.Printf("QUIC [Listening] %s\n", s.server.Addr)
+	err := quicServer.ListenAndServe()
+	log.Printf("QUIC [Stopped Serving] %s\n", err)
+}
+
+// advertiseQUIC tells peers fetching over HTTP/1.1 where the QUIC endpoint is
+func advertiseQUIC(fs *Manager, port int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if req.ProtoMajor < 3 && fs.advertisesQUIC() {
+				res.Header().Set("Alt-Svc", fmt.Sprintf(`h3=":%d"; ma=%d`, port, AltSvcMaxAge))
+			}
+
+			next.ServeHTTP(res, req)
+		})
+	}
+}
+
+func ephemeralTLSConfig() (*tls.Config, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "snfs"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, public, private)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: private}},
+	}, nil
+}
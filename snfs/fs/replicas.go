@@ -0,0 +1,67 @@
+package fs
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/alabianca/snfs/util"
+	"github.com/go-chi/chi"
+)
+
+// Errors
+const ErrNoReplicas = "Node Does Not Accept Replicas"
+const ErrInvalidSlot = "Invalid Replica Slot"
+const ErrUnverifiedPeer = "Replicas Are Only Pulled For Verified Peers"
+
+// Replicator pulls replicas of content other nodes ask this node to hold
+type Replicator interface {
+	// Replicate starts fetching the content with hash to serve it in slot of its replicas slots
+	// for the node with id requester. It fails when the node doesn't take the replica
+	Replicate(hash string, slot, replicas int, requester string) error
+}
+
+// SetReplicator makes the object server accept replication requests
+func (m *Manager) SetReplicator(replicator Replicator) {
+	m.replicator = replicator
+}
+
+func replicate(fs *Manager) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		hash := chi.URLParam(req, "hash")
+		if _, err := util.ParseContentID(hash); err != nil {
+			util.Respond(res, util.Message(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		slot, err := strconv.Atoi(req.URL.Query().Get("slot"))
+		if err != nil {
+			util.Respond(res, util.Message(http.StatusBadRequest, ErrInvalidSlot))
+			return
+		}
+
+		replicas, err := strconv.Atoi(req.URL.Query().Get("replicas"))
+		if err != nil || slot < 1 || slot > replicas {
+			util.Respond(res, util.Message(http.StatusBadRequest, ErrInvalidSlot))
+			return
+		}
+
+		if fs.replicator == nil {
+			util.Respond(res, util.Message(http.StatusForbidden, ErrNoReplicas))
+			return
+		}
+
+		// only nodes that presented a certificate bound to their node id may ask
+		peer := peerFromRequest(req)
+		if peer == nil {
+			util.Respond(res, util.Message(http.StatusForbidden, ErrUnverifiedPeer))
+			return
+		}
+
+		if err := fs.replicator.Replicate(hash, slot, replicas, peer.NodeID); err != nil {
+			util.Respond(res, util.Message(http.StatusForbidden, err.Error()))
+			return
+		}
+
+		util.Respond(res, util.Message(http.StatusAccepted, "Accepted"))
+	}
+}
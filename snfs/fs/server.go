@@ -1,46 +1,111 @@
 package fs
 
 import (
+	"crypto/tls"
+	"errors"
+	"github.com/alabianca/snfs/snfs/kad"
+	"github.com/alabianca/snfs/snfs/transfer"
 	"github.com/alabianca/snfs/util"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// ContactSigner signs the contact of the node serving objects on filePort
+type ContactSigner interface {
+	SignContact(filePort int) (kad.SignedContact, error)
+}
+
+// Relay accepts the connections a relay forwards to this node
+type Relay interface {
+	net.Listener
+	// ObjectAddr is the address peers reach the object server at through the relay
+	ObjectAddr() (*net.TCPAddr, error)
+}
+
+// PortMapper forwards the file port on the router
+type PortMapper interface {
+	// ObjectAddr is the address peers reach the object server at through the router
+	ObjectAddr() (*net.TCPAddr, error)
+}
+
 type server struct {
-	addr string
-	port int
-	server *http.Server
+	addr      string
+	port      int
+	server    *http.Server
+	tlsConfig *tls.Config
+	limits    transfer.Limits
+	relay     Relay
+	puncher   net.Listener
+	quic      bool
 }
 
 func (s *server) listen(fs *Manager) error {
 	addr := net.JoinHostPort(s.addr, strconv.Itoa(s.port))
 	s.server = &http.Server{
 		Addr:              addr,
-		Handler:           routes(fs),
-		//TLSConfig:         nil,
-		//ReadTimeout:       0,
-		//ReadHeaderTimeout: 0,
-		//WriteTimeout:      0,
-		//IdleTimeout:       0,
+		Handler:           routes(fs, s.port),
+		TLSConfig:         s.tlsConfig,
+		ReadTimeout:       s.limits.RequestTimeout,
+		ReadHeaderTimeout: s.limits.RequestTimeout,
+		IdleTimeout:       s.limits.IdleTimeout,
+		// no WriteTimeout, throttled transfers take as long as the rate limits make them
 		//MaxHeaderBytes:    0,
 		//TLSNextProto:      nil,
 		//ConnState:         nil,
 		//ErrorLog:          nil,
 	}
 
+	if s.relay != nil {
+		go s.serveListener("Relay", s.relay)
+	}
+
+	if s.puncher != nil {
+		go s.serveListener("Punch", s.puncher)
+	}
+
+	if s.quic {
+		go s.serveQUIC()
+	}
+
+	if s.tlsConfig != nil {
+		// certificates come from the TLSConfig
+		return s.server.ListenAndServeTLS("", "")
+	}
+
 	return s.server.ListenAndServe()
 }
 
-func routes(fs *Manager) *chi.Mux {
+// serveListener serves the connections peers open through a relay or a hole punch
+func (s *server) serveListener(name string, listener net.Listener) {
+	var err error
+	if s.tlsConfig != nil {
+		err = s.server.ServeTLS(listener, "", "")
+	} else {
+		err = s.server.Serve(listener)
+	}
+
+	log.Printf("%s [Stopped Serving] %s\n", name, err)
+}
+
+func routes(fs *Manager, port int) *chi.Mux {
 	router := chi.NewRouter()
 
 	router.Use(middleware.Logger)
-	router.Get("/v1/object/{hash}", getFile(fs))
+	router.Use(advertiseQUIC(fs, port))
+	router.Get("/v1/contact", getContact(fs))
+	router.Get("/v1/name/{name}", getName(fs))
+	router.Get("/v1/object/{hash}", restricted(fs, available(fs, throttled(fs, getFile(fs)))))
+	router.Get("/v1/object/{hash}/manifest", restricted(fs, available(fs, getManifest(fs))))
+	router.Get("/v1/object/{hash}/file", restricted(fs, available(fs, whole(fs, throttled(fs, getObjectEntry(fs))))))
+	router.Post("/v1/replicate/{hash}", replicate(fs))
 
 	return router
 }
@@ -49,7 +114,7 @@ func getFile(fs *Manager) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		hash := chi.URLParam(req, "hash")
 		if hash == "" {
-			util.Respond(res, util.Message(http.StatusBadRequest,"File Hash Is Required"))
+			util.Respond(res, util.Message(http.StatusBadRequest, "File Hash Is Required"))
 			return
 		}
 
@@ -67,8 +132,125 @@ func getFile(fs *Manager) http.HandlerFunc {
 
 		defer file.Close()
 
+		// peers fetch ranges in parallel over QUIC. They can't be counted as downloads
+		if req.Header.Get("Range") != "" {
+			if fs.downloadLimited(hash) {
+				util.Respond(res, util.Message(http.StatusForbidden, ErrWholeShareOnly))
+				return
+			}
+
+			res.Header().Set("Content-Type", "application/octet-stream")
+			http.ServeContent(res, req, "", time.Time{}, file)
+			return
+		}
+
+		// the open file outlives the object when this download uses up its last slot
+		if err := fs.claimDownload(hash); err != nil {
+			util.Respond(res, util.Message(http.StatusGone, ErrShareExpired))
+			return
+		}
+
+		if fs.Expired(hash) {
+			defer fs.collect()
+		}
+
 		res.WriteHeader(http.StatusOK)
 		res.Header().Add("Content-Type", "application/octet-stream")
 		io.Copy(res, file)
 	}
 }
+
+func getContact(fs *Manager) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if fs.signer == nil {
+			util.Respond(res, util.Message(http.StatusNotFound, "Contact Not Signed"))
+			return
+		}
+
+		_, port, err := fs.AnnounceAddr()
+		if err != nil {
+			util.Respond(res, util.Message(http.StatusServiceUnavailable, err.Error()))
+			return
+		}
+
+		contact, err := fs.signer.SignContact(port)
+		if err != nil {
+			util.Respond(res, util.Message(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		response := util.Message(http.StatusOK, "Ok")
+		response["data"] = contact
+		util.Respond(res, response)
+	}
+}
+
+func getManifest(fs *Manager) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		hash := chi.URLParam(req, "hash")
+
+		manifest, err := fs.GetManifest(hash)
+		if err != nil {
+			util.Respond(res, util.Message(http.StatusNotFound, "Manifest Not Found"))
+			return
+		}
+
+		response := util.Message(http.StatusOK, "Ok")
+		response["data"] = manifest
+		util.Respond(res, response)
+	}
+}
+
+func getObjectEntry(fs *Manager) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		hash := chi.URLParam(req, "hash")
+		name := req.URL.Query().Get("path")
+		if name == "" {
+			util.Respond(res, util.Message(http.StatusBadRequest, "File Path Is Required"))
+			return
+		}
+
+		var entry io.ReadCloser
+		var size int64
+		var err error
+		if raw := req.URL.Query().Get("chunks"); raw != "" {
+			wanted, parseErr := parseChunkList(raw)
+			if parseErr != nil {
+				util.Respond(res, util.Message(http.StatusBadRequest, parseErr.Error()))
+				return
+			}
+
+			entry, size, err = fs.OpenObjectChunks(hash, name, wanted)
+		} else {
+			entry, size, err = fs.OpenObjectEntry(hash, name)
+		}
+
+		if err != nil {
+			util.Respond(res, util.Message(http.StatusNotFound, "File Not Found"))
+			return
+		}
+
+		defer entry.Close()
+
+		res.Header().Add("Content-Type", "application/octet-stream")
+		res.Header().Add("Content-Length", strconv.FormatInt(size, 10))
+		res.WriteHeader(http.StatusOK)
+		io.Copy(res, entry)
+	}
+}
+
+// parseChunkList parses a comma separated list of chunk indexes
+func parseChunkList(raw string) ([]int, error) {
+	parts := strings.Split(raw, ",")
+	wanted := make([]int, 0, len(parts))
+	for _, part := range parts {
+		i, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, errors.New(ErrInvalidChunks)
+		}
+
+		wanted = append(wanted, i)
+	}
+
+	return wanted, nil
+}
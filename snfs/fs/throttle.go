@@ -0,0 +1,55 @@
+package fs
+
+import (
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/alabianca/snfs/snfs/transfer"
+	"github.com/alabianca/snfs/util"
+	"github.com/go-chi/chi"
+)
+
+// RetryAfter is the number of seconds peers are asked to wait when all transfer slots are taken
+const RetryAfter = "5"
+
+// SetLimits configures bandwidth, concurrency and timeouts of transfers
+func (m *Manager) SetLimits(limits transfer.Limits) {
+	m.transfers = transfer.NewScheduler(limits)
+}
+
+// Transfers returns the scheduler uploads and downloads of this node go through
+func (m *Manager) Transfers() *transfer.Scheduler {
+	return m.transfers
+}
+
+// throttledWriter paces the body of a response
+type throttledWriter struct {
+	http.ResponseWriter
+	body io.Writer
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+// throttled admits the upload to the requesting peer and paces its response
+func throttled(fs *Manager, next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+
+		t, err := fs.transfers.Start(transfer.Upload, host, chi.URLParam(req, "hash"))
+		if err != nil {
+			res.Header().Set("Retry-After", RetryAfter)
+			util.Respond(res, util.Message(http.StatusServiceUnavailable, err.Error()))
+			return
+		}
+
+		defer t.Finish()
+
+		next(&throttledWriter{ResponseWriter: res, body: t.Writer(req.Context(), res)}, req)
+	}
+}
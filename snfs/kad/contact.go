@@ -0,0 +1,137 @@
+package kad
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Errors
+const ErrNoIdentity = "Node Has No Identity"
+const ErrIdentityMismatch = "Contact Does Not Match Its Certificate"
+
+// Identity signs this node's contact and verifies the contacts of peers.
+// It is implemented by certs.Manager
+type Identity interface {
+	Sign(data []byte) ([]byte, error)
+	Chain() ([][]byte, error)
+	// Verify checks signature over data against the leaf of chain
+	// and returns the node id the leaf is bound to
+	Verify(chain [][]byte, data, signature []byte) (string, error)
+}
+
+// SignedContact is a node's contact signed with the key of its certificate.
+// Port is the DHT port, FilePort the port of the object server
+type SignedContact struct {
+	ID        string   `json:"id"`
+	IP        string   `json:"ip"`
+	Port      int      `json:"port"`
+	FilePort  int      `json:"filePort"`
+	Chain     [][]byte `json:"chain"`
+	Signature []byte   `json:"signature"`
+}
+
+func (c SignedContact) payload() []byte {
+	return []byte(fmt.Sprintf("snfs-contact|%s|%s|%d|%d", c.ID, c.IP, c.Port, c.FilePort))
+}
+
+// Relay is the relay forwarding DHT rpcs to this node
+type Relay interface {
+	DHTAddr() (*net.UDPAddr, error)
+}
+
+// SetRelay makes signed contacts advertise the relay's address instead of our own
+func (rpc *RpcManager) SetRelay(relay Relay) {
+	rpc.relay = relay
+}
+
+// PortMapper forwards the DHT port on the router
+type PortMapper interface {
+	DHTAddr() (*net.UDPAddr, error)
+}
+
+// SetPortMapper makes signed contacts advertise the router's address once the DHT port is forwarded
+func (rpc *RpcManager) SetPortMapper(mapper PortMapper) {
+	rpc.mapper = mapper
+}
+
+// SetIdentity enables signed contacts
+func (rpc *RpcManager) SetIdentity(identity Identity) {
+	rpc.identity = identity
+}
+
+// SignContact returns this node's contact served by the object server on filePort
+func (rpc *RpcManager) SignContact(filePort int) (SignedContact, error) {
+	if rpc.identity == nil {
+		return SignedContact{}, errors.New(ErrNoIdentity)
+	}
+
+	chain, err := rpc.identity.Chain()
+	if err != nil {
+		return SignedContact{}, err
+	}
+
+	contact := SignedContact{
+		ID:       rpc.ID(),
+		IP:       rpc.node.Host,
+		Port:     rpc.node.Port,
+		FilePort: filePort,
+		Chain:    chain,
+	}
+
+	if rpc.relay != nil {
+		addr, err := rpc.relay.DHTAddr()
+		if err != nil {
+			return SignedContact{}, err
+		}
+
+		contact.IP = addr.IP.String()
+		contact.Port = addr.Port
+	} else if rpc.mapper != nil {
+		if addr, err := rpc.mapper.DHTAddr(); err == nil {
+			contact.IP = addr.IP.String()
+			contact.Port = addr.Port
+		}
+	}
+
+	if contact.Signature, err = rpc.identity.Sign(contact.payload()); err != nil {
+		return SignedContact{}, err
+	}
+
+	return contact, nil
+}
+
+// VerifyContact checks the signature of contact and that its node id is the one
+// its certificate was issued for. Verified contacts are reported by Status
+func (rpc *RpcManager) VerifyContact(contact SignedContact) error {
+	if rpc.identity == nil {
+		return errors.New(ErrNoIdentity)
+	}
+
+	if len(contact.Chain) == 0 {
+		return errors.New(ErrIdentityMismatch)
+	}
+
+	id, err := rpc.identity.Verify(contact.Chain, contact.payload(), contact.Signature)
+	if err != nil {
+		return err
+	}
+
+	if id != contact.ID {
+		return errors.New(ErrIdentityMismatch)
+	}
+
+	rpc.mtx.Lock()
+	defer rpc.mtx.Unlock()
+	rpc.verified[contact.ID] = contact
+
+	return nil
+}
+
+func (rpc *RpcManager) isVerified(id, ip string) bool {
+	rpc.mtx.Lock()
+	defer rpc.mtx.Unlock()
+
+	contact, ok := rpc.verified[id]
+	return ok && contact.IP == ip
+}
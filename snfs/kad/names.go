@@ -0,0 +1,43 @@
+package kad
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"net"
+)
+
+// Errors
+const ErrNameNotAnnounced = "Name Is Not Announced"
+
+// AnnounceName announces that the record of name is served by the object server at ip:port.
+// kadnet only stores addresses, the signed record itself is fetched from that object server
+func (rpc *RpcManager) AnnounceName(name string, ip net.IP, port int) error {
+	_, err := rpc.node.Store(rpc.nameKey(name), ip, port)
+	return err
+}
+
+// ResolveName looks up an object server serving the record of name
+func (rpc *RpcManager) ResolveName(name string) (net.Addr, error) {
+	resolver, err := rpc.node.NewResolver()
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := resolver.Resolve(rpc.nameKey(name))
+	if err != nil {
+		return nil, err
+	}
+
+	if addr == nil {
+		return nil, errors.New(ErrNameNotAnnounced)
+	}
+
+	return addr, nil
+}
+
+// nameKey returns the DHT key the record of name is announced under
+func (rpc *RpcManager) nameKey(name string) string {
+	sum := sha1.Sum([]byte("snfs-name|" + name))
+	return rpc.namespace(hex.EncodeToString(sum[:]))
+}
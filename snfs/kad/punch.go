@@ -0,0 +1,489 @@
+package kad
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alabianca/snfs/util"
+)
+
+const PuncherServiceName = "HolePuncher"
+
+// PunchRetry is how long the puncher waits before registering again after losing its rendezvous
+const PunchRetry = 5 * time.Second
+
+// RendezvousCacheTTL is how long looked up rendezvous records are remembered
+const RendezvousCacheTTL = 5 * time.Minute
+
+// punchInterval is the pause between two dials of a hole punch
+const punchInterval = 200 * time.Millisecond
+
+// PunchStatus describes the registration of this node with its rendezvous
+type PunchStatus struct {
+	Rendezvous string `json:"rendezvous"`
+	Registered bool   `json:"registered"`
+	Name       string `json:"name"`
+	Observed   string `json:"observed"`
+	Punched    int64  `json:"punched"`
+	Failed     int64  `json:"failed"`
+}
+
+// Puncher keeps this node registered with a rendezvous and announces the rendezvous
+// in the DHT. It is the net.Listener the object server accepts punched connections on
+type Puncher struct {
+	rpc        *RpcManager
+	rendezvous string
+	name       func() (string, error)
+	conns      chan net.Conn
+	mtx        sync.Mutex
+	control    net.Conn
+	registered string
+	observed   string
+	punched    int64
+	failed     int64
+	stop       chan struct{}
+	stopOnce   sync.Once
+	id         []byte
+}
+
+// NewPuncher returns a puncher registering this node with the rendezvous at host:port.
+// name returns the object address peers resolve this node's content to
+func NewPuncher(rpc *RpcManager, rendezvous string, name func() (string, error)) *Puncher {
+	p := &Puncher{
+		rpc:        rpc,
+		rendezvous: rendezvous,
+		name:       name,
+		conns:      make(chan net.Conn),
+		stop:       make(chan struct{}),
+		id:         make([]byte, 20),
+	}
+
+	util.RandomID(p.id)
+
+	return p
+}
+
+// Status reports the rendezvous and how many punches succeeded
+func (p *Puncher) Status() PunchStatus {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return PunchStatus{
+		Rendezvous: p.rendezvous,
+		Registered: p.control != nil,
+		Name:       p.registered,
+		Observed:   p.observed,
+		Punched:    atomic.LoadInt64(&p.punched),
+		Failed:     atomic.LoadInt64(&p.failed),
+	}
+}
+
+// net.Listener
+
+// Accept returns the next connection punched through to this node
+func (p *Puncher) Accept() (net.Conn, error) {
+	select {
+	case conn := <-p.conns:
+		return conn, nil
+	case <-p.stop:
+		return nil, errors.New(ErrNotPunched)
+	}
+}
+
+func (p *Puncher) Close() error {
+	return p.Shutdown()
+}
+
+func (p *Puncher) Addr() net.Addr {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.control != nil {
+		return p.control.LocalAddr()
+	}
+
+	return &net.TCPAddr{}
+}
+
+// Service interface ID, Name, Run, Shutdown
+
+func (p *Puncher) ID() string {
+	return fmt.Sprintf("%x", p.id)
+}
+
+func (p *Puncher) Name() string {
+	return PuncherServiceName
+}
+
+// Run registers with the rendezvous and registers again whenever the connection is lost
+func (p *Puncher) Run() error {
+	for {
+		err := p.session()
+
+		select {
+		case <-p.stop:
+			return nil
+		default:
+		}
+
+		log.Printf("Punch [Unregistered] %s %s\n", p.rendezvous, err)
+
+		select {
+		case <-time.After(PunchRetry):
+		case <-p.stop:
+			return nil
+		}
+	}
+}
+
+func (p *Puncher) Shutdown() error {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.control != nil {
+		return p.control.Close()
+	}
+
+	return nil
+}
+
+func (p *Puncher) session() error {
+	name, err := p.name()
+	if err != nil {
+		return err
+	}
+
+	control, err := dialFrom(context.Background(), nil, p.rendezvous)
+	if err != nil {
+		return err
+	}
+
+	defer control.Close()
+
+	reader := bufio.NewReader(control)
+	control.SetDeadline(time.Now().Add(rendezvousTimeout))
+	if err := writeLine(control, "REGISTER", name); err != nil {
+		return err
+	}
+
+	words, err := readLine(reader)
+	if err != nil {
+		return err
+	}
+
+	if words[0] == "CHALLENGE" && len(words) == 2 {
+		if err := p.prove(control, name, words[1]); err != nil {
+			return err
+		}
+
+		if words, err = readLine(reader); err != nil {
+			return err
+		}
+	}
+
+	if words[0] != "OK" || len(words) != 2 {
+		return errors.New(strings.Join(words[1:], " "))
+	}
+
+	control.SetDeadline(time.Time{})
+	p.mtx.Lock()
+	p.control = control
+	p.registered = name
+	p.observed = words[1]
+	p.mtx.Unlock()
+
+	defer p.reset()
+
+	log.Printf("Punch [Registered] %s as %s at %s\n", p.rendezvous, name, words[1])
+
+	if err := p.rpc.AnnounceRendezvous(name, control.RemoteAddr().(*net.TCPAddr)); err != nil {
+		log.Printf("Punch [Announce Error] %s\n", err)
+	}
+
+	go p.keepAlive(control, name)
+
+	for {
+		control.SetReadDeadline(time.Now().Add(2 * PunchKeepAlive))
+		words, err := readLine(reader)
+		if err != nil {
+			return err
+		}
+
+		if words[0] == "PUNCH" && len(words) == 2 {
+			go p.punch(control.LocalAddr(), words[1])
+		}
+	}
+}
+
+// prove answers the challenge of the rendezvous with our certificate chain and signature
+func (p *Puncher) prove(control net.Conn, name, nonce string) error {
+	if p.rpc.identity == nil {
+		return errors.New(ErrNoIdentity)
+	}
+
+	chain, err := p.rpc.identity.Chain()
+	if err != nil {
+		return err
+	}
+
+	signature, err := p.rpc.identity.Sign(registrationPayload(name, nonce))
+	if err != nil {
+		return err
+	}
+
+	proof, err := json.Marshal(&registrationProof{Chain: chain, Signature: signature})
+	if err != nil {
+		return err
+	}
+
+	return writeLine(control, "PROOF", base64.StdEncoding.EncodeToString(proof))
+}
+
+// keepAlive pings the rendezvous and drops the registration once the
+// object address changes, e.g. when the relay assigned a new one
+func (p *Puncher) keepAlive(control net.Conn, name string) {
+	ticker := time.NewTicker(PunchKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if current, err := p.name(); err != nil || current != name {
+				control.Close()
+				return
+			}
+
+			control.SetWriteDeadline(time.Now().Add(rendezvousTimeout))
+			if err := writeLine(control, "PING"); err != nil {
+				control.Close()
+				return
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *Puncher) reset() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.control = nil
+	p.registered = ""
+	p.observed = ""
+}
+
+// punch dials the peer at remote from the port the rendezvous observed for us
+func (p *Puncher) punch(local net.Addr, remote string) {
+	conn, err := simultaneousOpen(context.Background(), local, remote)
+	if err != nil {
+		atomic.AddInt64(&p.failed, 1)
+		log.Printf("Punch [Failed] %s %s\n", remote, err)
+		return
+	}
+
+	atomic.AddInt64(&p.punched, 1)
+	log.Printf("Punch [Direct] %s\n", remote)
+
+	select {
+	case p.conns <- conn:
+	case <-p.stop:
+		conn.Close()
+	}
+}
+
+type rendezvousRecord struct {
+	addr    net.Addr
+	expires time.Time
+}
+
+// AnnounceRendezvous announces the rendezvous peers reach the node serving objects at name through
+func (rpc *RpcManager) AnnounceRendezvous(name string, rendezvous *net.TCPAddr) error {
+	_, err := rpc.node.Store(rpc.rendezvousKey(name), rendezvous.IP, rendezvous.Port)
+	return err
+}
+
+// ResolveRendezvous looks up the rendezvous of the node serving objects at name
+func (rpc *RpcManager) ResolveRendezvous(name string) (net.Addr, error) {
+	rpc.mtx.Lock()
+	record, ok := rpc.rendezvous[name]
+	rpc.mtx.Unlock()
+
+	if ok && time.Now().Before(record.expires) {
+		if record.addr == nil {
+			return nil, errors.New(ErrNoRendezvous)
+		}
+		return record.addr, nil
+	}
+
+	addr, err := rpc.resolveRendezvous(name)
+
+	rpc.mtx.Lock()
+	rpc.rendezvous[name] = rendezvousRecord{addr: addr, expires: time.Now().Add(RendezvousCacheTTL)}
+	rpc.mtx.Unlock()
+
+	return addr, err
+}
+
+func (rpc *RpcManager) resolveRendezvous(name string) (net.Addr, error) {
+	resolver, err := rpc.node.NewResolver()
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := resolver.Resolve(rpc.rendezvousKey(name))
+	if err != nil {
+		return nil, err
+	}
+
+	if addr == nil {
+		return nil, errors.New(ErrNoRendezvous)
+	}
+
+	return addr, nil
+}
+
+// DialContext connects to the object server at addr. When the node behind it announced a
+// rendezvous a direct connection is punched, otherwise or when punching fails addr is dialed
+func (rpc *RpcManager) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if rendezvous, err := rpc.ResolveRendezvous(addr); err == nil {
+		conn, err := punchVia(ctx, rendezvous.String(), addr)
+		if err == nil {
+			log.Printf("Punch [Direct] %s\n", addr)
+			return conn, nil
+		}
+
+		log.Printf("Punch [Failed] %s %s, dialing %s\n", rendezvous, err, addr)
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// rendezvousKey returns the DHT key the rendezvous of the node at name is announced under
+func (rpc *RpcManager) rendezvousKey(name string) string {
+	sum := sha1.Sum([]byte("snfs-rendezvous|" + name))
+	return rpc.namespace(hex.EncodeToString(sum[:]))
+}
+
+// punchVia asks the rendezvous to introduce us to the node registered as name and punches through to it
+func punchVia(ctx context.Context, rendezvous, name string) (net.Conn, error) {
+	control, err := dialFrom(ctx, nil, rendezvous)
+	if err != nil {
+		return nil, err
+	}
+
+	// keeps our NAT mapping open until the punch is done
+	defer control.Close()
+
+	control.SetDeadline(time.Now().Add(rendezvousTimeout))
+	if err := writeLine(control, "CONNECT", name); err != nil {
+		return nil, err
+	}
+
+	words, err := readLine(bufio.NewReader(control))
+	if err != nil {
+		return nil, err
+	}
+
+	if words[0] != "PEER" || len(words) != 2 {
+		return nil, errors.New(strings.Join(words[1:], " "))
+	}
+
+	return simultaneousOpen(ctx, control.LocalAddr(), words[1])
+}
+
+// simultaneousOpen connects local and remote. Both sides dial each other until their dials
+// opened both NATs; a side without NAT accepts the other's dial on the punched port instead
+func simultaneousOpen(ctx context.Context, local net.Addr, remote string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, PunchTimeout)
+	defer cancel()
+
+	punched := make(chan net.Conn)
+	config := net.ListenConfig{Control: reuse}
+	if listener, err := config.Listen(ctx, "tcp", local.String()); err == nil {
+		defer listener.Close()
+		go acceptFrom(ctx, listener, remote, punched)
+	}
+
+	go dialUntil(ctx, local, remote, punched)
+
+	select {
+	case conn := <-punched:
+		return conn, nil
+	case <-ctx.Done():
+		return nil, errors.New(ErrNotPunched)
+	}
+}
+
+func acceptFrom(ctx context.Context, listener net.Listener, remote string, punched chan net.Conn) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		if conn.RemoteAddr().String() != remote {
+			conn.Close()
+			continue
+		}
+
+		deliver(ctx, conn, punched)
+		return
+	}
+}
+
+func dialUntil(ctx context.Context, local net.Addr, remote string, punched chan net.Conn) {
+	for {
+		if conn, err := dialFrom(ctx, local, remote); err == nil {
+			deliver(ctx, conn, punched)
+			return
+		}
+
+		select {
+		case <-time.After(punchInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver hands conn to the waiting punch, or closes it when the punch is over
+func deliver(ctx context.Context, conn net.Conn, punched chan net.Conn) {
+	select {
+	case punched <- conn:
+	case <-ctx.Done():
+		conn.Close()
+	}
+}
+
+// dialFrom dials remote from local, any port when local is nil, with a socket that shares its port
+func dialFrom(ctx context.Context, local net.Addr, remote string) (net.Conn, error) {
+	dialer := net.Dialer{
+		LocalAddr: local,
+		Timeout:   time.Second,
+		Control:   reuse,
+	}
+
+	if local == nil {
+		dialer.Timeout = rendezvousTimeout
+	}
+
+	return dialer.DialContext(ctx, "tcp", remote)
+}
@@ -0,0 +1,334 @@
+package kad
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alabianca/snfs/util"
+)
+
+// A node that can't accept inbound connections keeps a connection open to a
+// rendezvous node both sides can reach:
+//
+//	node -> rendezvous  REGISTER <object addr>\n
+//	rendezvous -> node  CHALLENGE <nonce>\n
+//	node -> rendezvous  PROOF <proof>\n
+//	rendezvous -> node  OK <observed endpoint>\n   or   ERR <message>\n
+//
+// On networks with certificates the proof is the node's certificate chain and its signature over
+// the object address and the nonce. A name is only handed to another registration of the same node.
+// Rendezvous without certificates skip the challenge and register names first come, first served
+//
+// A peer that wants to fetch from the node asks the rendezvous to introduce them
+//
+//	peer -> rendezvous  CONNECT <object addr>\n
+//	rendezvous -> node  PUNCH <peer's observed endpoint>\n
+//	rendezvous -> peer  PEER <node's observed endpoint>\n
+//
+// after which both dial each other from the ports the rendezvous observed (TCP simultaneous open)
+
+const RendezvousServiceName = "RendezvousService"
+
+// PunchKeepAlive is how often registered nodes ping their rendezvous, keeping their NAT mapping open
+const PunchKeepAlive = 20 * time.Second
+
+// PunchTimeout bounds an attempt to open a direct connection
+const PunchTimeout = 5 * time.Second
+
+// rendezvousTimeout bounds the exchanges with the rendezvous
+const rendezvousTimeout = 10 * time.Second
+
+// Errors
+const ErrNameTaken = "Name Is Registered By Another Node"
+const ErrNoRendezvous = "No Rendezvous Announced"
+const ErrNotPunched = "Could Not Punch A Direct Connection"
+const ErrInvalidRendezvous = "Invalid Rendezvous Message"
+const ErrRegistrationRejected = "Registration Not Signed By A Node Of This Network"
+
+// RendezvousServer introduces peers to nodes behind NAT by exchanging the endpoints it observes
+type RendezvousServer struct {
+	addr     string
+	port     int
+	identity Identity
+	listener net.Listener
+	mtx      sync.Mutex
+	nodes    map[string]*registration
+	id       []byte
+}
+
+type registration struct {
+	conn     net.Conn
+	observed string
+	// nodeID is the node that proved it registered, empty without certificates
+	nodeID   string
+	writeMtx sync.Mutex
+}
+
+// registrationProof is the certificate chain of a registering node and its signature over the challenge
+type registrationProof struct {
+	Chain     [][]byte `json:"chain"`
+	Signature []byte   `json:"signature"`
+}
+
+func registrationPayload(name, nonce string) []byte {
+	return []byte("snfs-rendezvous|" + name + "|" + nonce)
+}
+
+func (r *registration) send(words ...string) error {
+	r.writeMtx.Lock()
+	defer r.writeMtx.Unlock()
+
+	r.conn.SetWriteDeadline(time.Now().Add(rendezvousTimeout))
+	return writeLine(r.conn, words...)
+}
+
+// NewRendezvousServer returns a rendezvous accepting nodes and peers on addr:port
+func NewRendezvousServer(addr string, port int) *RendezvousServer {
+	r := &RendezvousServer{
+		addr:  addr,
+		port:  port,
+		nodes: make(map[string]*registration),
+		id:    make([]byte, 20),
+	}
+
+	util.RandomID(r.id)
+
+	return r
+}
+
+// SetIdentity makes registering nodes prove their identity with a certificate of the network
+func (r *RendezvousServer) SetIdentity(identity Identity) {
+	r.identity = identity
+}
+
+// Registered returns the number of nodes registered with the rendezvous
+func (r *RendezvousServer) Registered() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return len(r.nodes)
+}
+
+// Service interface ID, Name, Run, Shutdown
+
+func (r *RendezvousServer) ID() string {
+	return fmt.Sprintf("%x", r.id)
+}
+
+func (r *RendezvousServer) Name() string {
+	return RendezvousServiceName
+}
+
+func (r *RendezvousServer) Run() error {
+	listener, err := net.Listen("tcp", net.JoinHostPort(r.addr, strconv.Itoa(r.port)))
+	if err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	r.listener = listener
+	r.mtx.Unlock()
+
+	log.Printf("Rendezvous [Listening] %s\n", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go r.handle(conn)
+	}
+}
+
+func (r *RendezvousServer) Shutdown() error {
+	r.mtx.Lock()
+	listener := r.listener
+	for _, reg := range r.nodes {
+		reg.conn.Close()
+	}
+	r.mtx.Unlock()
+
+	if listener != nil {
+		return listener.Close()
+	}
+
+	return nil
+}
+
+func (r *RendezvousServer) handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(rendezvousTimeout))
+	reader := bufio.NewReader(conn)
+
+	words, err := readLine(reader)
+	if err != nil || len(words) != 2 {
+		conn.Close()
+		return
+	}
+
+	switch words[0] {
+	case "REGISTER":
+		r.register(conn, reader, words[1])
+	case "CONNECT":
+		r.connect(conn, words[1])
+	default:
+		conn.Close()
+	}
+}
+
+// register keeps the registration of the node at conn until it stops pinging
+func (r *RendezvousServer) register(conn net.Conn, reader *bufio.Reader, name string) {
+	defer conn.Close()
+
+	reg := &registration{conn: conn, observed: conn.RemoteAddr().String()}
+	if r.identity != nil {
+		nodeID, err := r.challenge(conn, reader, name)
+		if err != nil {
+			writeLine(conn, "ERR", ErrRegistrationRejected)
+			return
+		}
+
+		reg.nodeID = nodeID
+	}
+
+	r.mtx.Lock()
+	old, taken := r.nodes[name]
+	// a node registering again replaces its lost registration
+	if taken && reg.nodeID != "" && old.nodeID == reg.nodeID {
+		old.conn.Close()
+		taken = false
+	}
+	if !taken {
+		r.nodes[name] = reg
+	}
+	r.mtx.Unlock()
+
+	if taken {
+		writeLine(conn, "ERR", ErrNameTaken)
+		return
+	}
+
+	defer func() {
+		r.mtx.Lock()
+		current := r.nodes[name] == reg
+		if current {
+			delete(r.nodes, name)
+		}
+		r.mtx.Unlock()
+
+		if current {
+			log.Printf("Rendezvous [Unregistered] %s\n", name)
+		}
+	}()
+
+	if err := reg.send("OK", reg.observed); err != nil {
+		return
+	}
+
+	log.Printf("Rendezvous [Registered] %s at %s\n", name, reg.observed)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * PunchKeepAlive))
+		words, err := readLine(reader)
+		if err != nil {
+			return
+		}
+
+		if words[0] == "PING" {
+			if err := reg.send("PONG"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// challenge has the node registering name sign a nonce and returns its node id
+func (r *RendezvousServer) challenge(conn net.Conn, reader *bufio.Reader, name string) (string, error) {
+	// the nonce is all that keeps a recorded proof from being replayed
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	if err := writeLine(conn, "CHALLENGE", hex.EncodeToString(nonce)); err != nil {
+		return "", err
+	}
+
+	words, err := readLine(reader)
+	if err != nil {
+		return "", err
+	}
+
+	if words[0] != "PROOF" || len(words) != 2 {
+		return "", errors.New(ErrInvalidRendezvous)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(words[1])
+	if err != nil {
+		return "", err
+	}
+
+	var proof registrationProof
+	if err := json.Unmarshal(raw, &proof); err != nil {
+		return "", err
+	}
+
+	return r.identity.Verify(proof.Chain, registrationPayload(name, hex.EncodeToString(nonce)), proof.Signature)
+}
+
+// connect tells the node registered as name and the peer at conn each other's endpoint
+func (r *RendezvousServer) connect(conn net.Conn, name string) {
+	defer conn.Close()
+
+	r.mtx.Lock()
+	reg, ok := r.nodes[name]
+	r.mtx.Unlock()
+
+	if !ok {
+		writeLine(conn, "ERR", ErrNoRendezvous)
+		return
+	}
+
+	if err := reg.send("PUNCH", conn.RemoteAddr().String()); err != nil {
+		writeLine(conn, "ERR", err.Error())
+		return
+	}
+
+	// the peer hangs up once it punched through, its NAT mapping has to live until then
+	if err := writeLine(conn, "PEER", reg.observed); err == nil {
+		conn.SetReadDeadline(time.Now().Add(2 * PunchTimeout))
+		io.Copy(ioutil.Discard, conn)
+	}
+}
+
+func writeLine(w io.Writer, words ...string) error {
+	_, err := fmt.Fprintf(w, "%s\n", strings.Join(words, " "))
+	return err
+}
+
+func readLine(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		return nil, errors.New(ErrInvalidRendezvous)
+	}
+
+	return words, nil
+}
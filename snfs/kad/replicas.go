@@ -0,0 +1,173 @@
+package kad
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/alabianca/gokad"
+	"github.com/alabianca/snfs/util"
+)
+
+// MaxReplicas bounds the replication factor of content, providers announce in slots 0 to MaxReplicas
+const MaxReplicas = 8
+
+// Errors
+const ErrNodeNotAnnounced = "Node Does Not Accept Replicas"
+
+// AnnounceReplica announces that the object server at ip:port holds a replica of the content identified by id.
+// kadnet keeps one address per key, so every provider of replicated content announces under its own slot.
+// Slot 0 is the key content is resolved by
+func (rpc *RpcManager) AnnounceReplica(id util.ContentID, slot int, ip net.IP, port int) error {
+	_, err := rpc.node.Store(rpc.replicaKey(id, slot), ip, port)
+	return err
+}
+
+// Providers resolves the slots 0 to replicas of the content identified by id.
+// Slots nobody announced are nil
+func (rpc *RpcManager) Providers(id util.ContentID, replicas int) []net.Addr {
+	providers := make([]net.Addr, replicas+1)
+	for slot := range providers {
+		resolver, err := rpc.node.NewResolver()
+		if err != nil {
+			continue
+		}
+
+		addr, err := resolver.Resolve(rpc.replicaKey(id, slot))
+		if err != nil || addr == nil || withdrawn(addr) {
+			continue
+		}
+
+		providers[slot] = addr
+	}
+
+	return providers
+}
+
+// Withdraw drops the object server at ip:port from the providers of the content identified by id.
+// kadnet has no delete rpc and keeps one address per key, so only slots that announce ip:port are
+// overwritten: slot 0 with another provider of the content if there is one, the others with a
+// tombstone resolving nodes treat as not found. Slots announcing other providers are left alone
+func (rpc *RpcManager) Withdraw(id util.ContentID, ip net.IP, port int) error {
+	self := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	providers := rpc.Providers(id, MaxReplicas)
+
+	var successor *net.TCPAddr
+	for _, addr := range providers {
+		if addr == nil || addr.String() == self {
+			continue
+		}
+
+		if successor, _ = net.ResolveTCPAddr("tcp", addr.String()); successor != nil {
+			break
+		}
+	}
+
+	var err error
+	for slot, addr := range providers {
+		if addr == nil || addr.String() != self {
+			continue
+		}
+
+		tombstone := &net.TCPAddr{IP: ip, Port: 0}
+		if slot == 0 && successor != nil {
+			tombstone = successor
+		}
+
+		if _, storeErr := rpc.node.Store(rpc.replicaKey(id, slot), tombstone.IP, tombstone.Port); storeErr != nil {
+			err = storeErr
+		}
+	}
+
+	return err
+}
+
+// withdrawn reports whether addr is the tombstone of a withdrawn announcement
+func withdrawn(addr net.Addr) bool {
+	_, port, err := net.SplitHostPort(addr.String())
+	return err == nil && port == "0"
+}
+
+// AnnounceNode announces that this node accepts replicas at the object server at ip:port
+func (rpc *RpcManager) AnnounceNode(ip net.IP, port int) error {
+	_, err := rpc.node.Store(rpc.nodeKey(rpc.ID()), ip, port)
+	return err
+}
+
+// ResolveNode looks up the object server of the node with id, if it accepts replicas
+func (rpc *RpcManager) ResolveNode(id string) (net.Addr, error) {
+	resolver, err := rpc.node.NewResolver()
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := resolver.Resolve(rpc.nodeKey(id))
+	if err != nil {
+		return nil, err
+	}
+
+	if addr == nil {
+		return nil, errors.New(ErrNodeNotAnnounced)
+	}
+
+	return addr, nil
+}
+
+// Closest returns the ids of the nodes in the routing table ordered by their distance to the
+// content identified by id, closest first
+func (rpc *RpcManager) Closest(id util.ContentID) []string {
+	key, _ := hex.DecodeString(id.DHTKey())
+	self := rpc.ID()
+
+	contacts := make([]gokad.Contact, 0)
+	rpc.node.Walk(func(index int, c gokad.Contact) {
+		if c.ID.String() != self {
+			contacts = append(contacts, c)
+		}
+	})
+
+	sort.Slice(contacts, func(i, j int) bool {
+		return bytes.Compare(distance(contacts[i].ID, key), distance(contacts[j].ID, key)) < 0
+	})
+
+	ids := make([]string, len(contacts))
+	for i, c := range contacts {
+		ids[i] = c.ID.String()
+	}
+
+	return ids
+}
+
+// distance is the XOR metric between a node id and a key
+func distance(id gokad.ID, key []byte) []byte {
+	d := make([]byte, len(key))
+	for i := range d {
+		if i < len(id) {
+			d[i] = id[i] ^ key[i]
+		} else {
+			d[i] = key[i]
+		}
+	}
+
+	return d
+}
+
+// replicaKey returns the DHT key of slot of the content identified by id
+func (rpc *RpcManager) replicaKey(id util.ContentID, slot int) string {
+	if slot == 0 {
+		return rpc.dhtKey(id)
+	}
+
+	sum := sha1.Sum([]byte("snfs-replica|" + id.DHTKey() + "|" + strconv.Itoa(slot)))
+	return rpc.namespace(hex.EncodeToString(sum[:]))
+}
+
+// nodeKey returns the DHT key the object server of the node with id is announced under
+func (rpc *RpcManager) nodeKey(id string) string {
+	sum := sha1.Sum([]byte("snfs-node|" + id))
+	return rpc.namespace(hex.EncodeToString(sum[:]))
+}
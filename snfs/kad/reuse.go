@@ -0,0 +1,25 @@
+//go:build !windows
+
+package kad
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reuse lets the sockets of a hole punch share the local port the rendezvous observed
+func reuse(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); sockErr != nil {
+			return
+		}
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
@@ -0,0 +1,18 @@
+package kad
+
+import (
+	"syscall"
+)
+
+// reuse lets the sockets of a hole punch share the local port the rendezvous observed
+func reuse(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
@@ -3,7 +3,10 @@ package kad
 import (
 	"github.com/alabianca/gokad"
 	"github.com/alabianca/kadnet"
+	"github.com/alabianca/snfs/snfs/network"
+	"github.com/alabianca/snfs/util"
 	"net"
+	"sync"
 )
 
 const ServiceName = "RPCManager"
@@ -11,6 +14,8 @@ const ServiceName = "RPCManager"
 type RoutingTableEntry struct {
 	BucketIndex int `json:"bucketIndex"`
 	Contact gokad.Contact `json:"contact"`
+	// Verified is set once the contact presented a certificate bound to its node id
+	Verified bool `json:"verified"`
 }
 
 
@@ -22,7 +27,15 @@ type Manager interface {
 }
 
 type RpcManager struct {
-	node *kadnet.Node
+	node     *kadnet.Node
+	identity Identity
+	network  *network.Key
+	relay    Relay
+	mapper   PortMapper
+	mtx      sync.Mutex
+	verified map[string]SignedContact
+	// rendezvous caches the rendezvous records looked up by DialContext
+	rendezvous map[string]rendezvousRecord
 }
 
 func NewRPCManager(dht *gokad.DHT, address string, port int) *RpcManager {
@@ -32,11 +45,18 @@ func NewRPCManager(dht *gokad.DHT, address string, port int) *RpcManager {
 	})
 
 	return &RpcManager{
-		node: node,
+		node:       node,
+		verified:   make(map[string]SignedContact),
+		rendezvous: make(map[string]rendezvousRecord),
 	}
 }
 
 
+// SetNetworkKey confines the content announced and resolved by this node to a private network
+func (rpc *RpcManager) SetNetworkKey(k *network.Key) {
+	rpc.network = k
+}
+
 func (rpc *RpcManager) Bootstrap(port int, ip string) error {
 	return rpc.node.Bootstrap(port, ip)
 }
@@ -46,23 +66,49 @@ func (rpc *RpcManager) Status() []RoutingTableEntry {
 	rt := make([]RoutingTableEntry, 0)
 
 	rpc.node.Walk(func(index int, c gokad.Contact) {
-		rt = append(rt, RoutingTableEntry{index, c})
+		rt = append(rt, RoutingTableEntry{
+			BucketIndex: index,
+			Contact:     c,
+			Verified:    rpc.isVerified(c.ID.String(), c.IP.String()),
+		})
 	})
 
 	return rt
 }
 
-func (rpc *RpcManager) Store(key string, ip net.IP, port int) (int, error) {
-	return rpc.node.Store(key, ip, port)
+// Store announces that the content identified by id is served at ip:port
+func (rpc *RpcManager) Store(id util.ContentID, ip net.IP, port int) (int, error) {
+	return rpc.node.Store(rpc.dhtKey(id), ip, port)
 }
 
-func (rpc *RpcManager) Resolve(hash string) (net.Addr, error) {
+// Resolve looks up the address of a node serving the content identified by id. Withdrawn content resolves to nil
+func (rpc *RpcManager) Resolve(id util.ContentID) (net.Addr, error) {
 	resolver, err := rpc.node.NewResolver()
 	if err != nil {
 		return nil, err
 	}
 
-	return resolver.Resolve(hash)
+	addr, err := resolver.Resolve(rpc.dhtKey(id))
+	if err != nil || addr == nil || withdrawn(addr) {
+		return nil, err
+	}
+
+	return addr, nil
+}
+
+// dhtKey returns the key id is stored under. On a private network keys are
+// authenticated with the network key, so STORE and FIND_VALUE rpcs of other
+// networks never meet ours
+func (rpc *RpcManager) dhtKey(id util.ContentID) string {
+	return rpc.namespace(id.DHTKey())
+}
+
+func (rpc *RpcManager) namespace(key string) string {
+	if rpc.network == nil {
+		return key
+	}
+
+	return rpc.network.DHTKey(key)
 }
 
 // Manager starts here
@@ -78,7 +124,12 @@ func (rpc *RpcManager) Name() string {
 }
 
 func (rpc *RpcManager) Run() error {
-	if err := rpc.node.Listen(nil); err != nil {
+	conn, err := rpc.listen()
+	if err != nil {
+		return err
+	}
+
+	if err := rpc.node.Listen(conn); err != nil {
 		return err
 	}
 
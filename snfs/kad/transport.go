@@ -0,0 +1,193 @@
+package kad
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/alabianca/snfs/snfs/network"
+)
+
+// maxDatagramSize bounds the datagrams read from the DHT socket
+const maxDatagramSize = 64 * 1024
+
+// kadnet messages start with their type, followed by the id of the sending node
+const (
+	senderOffset = 1
+	senderSize   = 20
+)
+
+// Errors
+const ErrInvalidDatagram = "Invalid DHT Datagram"
+
+// rpcConn is the socket kadnet sends and receives its rpcs on.
+// With an identity every datagram is signed with the key of this node's certificate and
+// a datagram is only accepted when its certificate names the node id of the sender.
+// On a private network every datagram is sealed with the network key as well, so nodes
+// without the key can neither read our rpcs nor get an answer to theirs. Datagrams
+// failing either check are dropped
+type rpcConn struct {
+	net.PacketConn
+	network  *network.Key
+	identity Identity
+}
+
+// listen opens the DHT socket on host:port
+func (rpc *RpcManager) listen() (net.PacketConn, error) {
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(rpc.node.Host, strconv.Itoa(rpc.node.Port)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &rpcConn{PacketConn: conn, network: rpc.network, identity: rpc.identity}, nil
+}
+
+func (c *rpcConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, addr, err
+		}
+
+		message, err := c.open(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		return copy(p, message), addr, nil
+	}
+}
+
+func (c *rpcConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	packet, err := c.seal(p)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := c.PacketConn.WriteTo(packet, addr); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *rpcConn) seal(message []byte) ([]byte, error) {
+	packet := message
+	if c.identity != nil {
+		var err error
+		if packet, err = c.sign(message); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.network == nil {
+		return packet, nil
+	}
+
+	return c.network.SealPacket(packet)
+}
+
+func (c *rpcConn) open(packet []byte) ([]byte, error) {
+	if c.network != nil {
+		var err error
+		if packet, err = c.network.OpenPacket(packet); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.identity == nil {
+		return packet, nil
+	}
+
+	return c.verify(packet)
+}
+
+// sign prepends this node's certificate chain and its signature over message:
+//
+//	<count> (<length> <certificate>)... <length> <signature> <message>
+//
+// with one byte count and two byte big endian lengths
+func (c *rpcConn) sign(message []byte) ([]byte, error) {
+	chain, err := c.identity.Chain()
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := c.identity.Sign(message)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(chain) > 255 {
+		return nil, errors.New(ErrInvalidDatagram)
+	}
+
+	packet := []byte{byte(len(chain))}
+	for _, cert := range chain {
+		packet = appendField(packet, cert)
+	}
+
+	packet = appendField(packet, signature)
+
+	return append(packet, message...), nil
+}
+
+// verify checks the signature of packet and that the certificate it was made with
+// is bound to the sender id of the message. It returns the message
+func (c *rpcConn) verify(packet []byte) ([]byte, error) {
+	if len(packet) == 0 {
+		return nil, errors.New(ErrInvalidDatagram)
+	}
+
+	chain := make([][]byte, packet[0])
+	rest := packet[1:]
+	var err error
+	for i := range chain {
+		if chain[i], rest, err = readField(rest); err != nil {
+			return nil, err
+		}
+	}
+
+	signature, message, err := readField(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(message) < senderOffset+senderSize {
+		return nil, errors.New(ErrInvalidDatagram)
+	}
+
+	id, err := c.identity.Verify(chain, message, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	if id != hex.EncodeToString(message[senderOffset:senderOffset+senderSize]) {
+		return nil, errors.New(ErrIdentityMismatch)
+	}
+
+	return message, nil
+}
+
+func appendField(packet, field []byte) []byte {
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(field)))
+
+	return append(append(packet, length...), field...)
+}
+
+func readField(packet []byte) ([]byte, []byte, error) {
+	if len(packet) < 2 {
+		return nil, nil, errors.New(ErrInvalidDatagram)
+	}
+
+	length := int(binary.BigEndian.Uint16(packet))
+	if len(packet) < 2+length {
+		return nil, nil, errors.New(ErrInvalidDatagram)
+	}
+
+	return packet[2 : 2+length], packet[2+length:], nil
+}
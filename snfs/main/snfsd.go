@@ -5,13 +5,22 @@ import (
 	"fmt"
 	"github.com/alabianca/gokad"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"path"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/alabianca/snfs/snfs/certs"
 	"github.com/alabianca/snfs/snfs/kad"
+	"github.com/alabianca/snfs/snfs/names"
+	"github.com/alabianca/snfs/snfs/network"
+	"github.com/alabianca/snfs/snfs/portmap"
+	"github.com/alabianca/snfs/snfs/relay"
+	"github.com/alabianca/snfs/snfs/transfer"
 
 	"github.com/alabianca/snfs/snfs/client"
 
@@ -22,6 +31,8 @@ import (
 	"github.com/alabianca/snfs/snfs/discovery"
 
 	"github.com/alabianca/snfs/snfs/server"
+
+	"github.com/mitchellh/go-homedir"
 )
 
 const topLevelDomain = ".snfs.com"
@@ -72,10 +83,45 @@ func main() {
 	cc, _ := services[client.ServiceName]
 	startService(cc)
 
+	// keep replicated shares at their replication factor
+	rp, _ := services[client.ReplicatorServiceName]
+	startService(rp)
+
+	// renew certificates and refresh revoked peers in the background
+	var revocation <-chan struct{}
+	if cm, ok := services[certs.ServiceName]; ok {
+		revocation = cm.(*certs.Manager).Revocation()
+		startService(cm)
+	}
+
+	// relay for nodes behind NAT, or register with a relay
+	if rs, ok := services[relay.ServiceName]; ok {
+		startService(rs)
+	}
+	if rc, ok := services[relay.ClientServiceName]; ok {
+		startService(rc)
+	}
+
+	// forward the discovery and file ports on the router
+	if pm, ok := services[portmap.ServiceName]; ok {
+		startService(pm)
+	}
+
+	// introduce nodes behind NAT to their peers, or punch through our own NAT
+	if rv, ok := services[kad.RendezvousServiceName]; ok {
+		startService(rv)
+	}
+	if p, ok := services[kad.PuncherServiceName]; ok {
+		startService(p)
+	}
+
 	select {
 	case <-done:
 		log.Println("Server Stopped...")
 		srv.Shutdown()
+	case <-revocation:
+		log.Println("Certificate Revoked, Server Stopped...")
+		srv.Shutdown()
 	case <-serverExit:
 		os.Exit(0)
 	}
@@ -94,23 +140,346 @@ func startService(s server.Service) {
 }
 
 func resolveServices(s *server.Server) map[string]server.Service {
+	networkKey, err := networkKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	rpc := kad.NewRPCManager(gokad.NewDHT(), s.Addr, s.Port)
+	// SNFS_AUTHORITY_URL: authd certificate endpoint. When set, peers talk mutual TLS
+	certManager := certs.NewManager(os.Getenv("SNFS_AUTHORITY_URL"))
+	certManager.SetNodeID(rpc.ID())
+	// SNFS_JOIN_TOKEN: pre-shared token authd requires to issue certificates
+	certManager.SetJoinToken(os.Getenv("SNFS_JOIN_TOKEN"))
+	limits, err := transferLimits()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	storage := fs.NewManager()
-	dm := discovery.NewManager(discovery.MdnsStrategy(configureMDNS(s.Port, s.Addr, rpc.ID())))
-	cc := client.NewConnectivityService(dm, storage, rpc)
+	storage.SetLimits(limits)
+	mdnsOptions := []discovery.Option{configureMDNS(s.Port, s.Addr, rpc.ID())}
+	if networkKey != nil {
+		log.Printf("Network [Private] %s\n", networkKey.Tag())
+		certManager.SetNetworkKey(networkKey)
+		rpc.SetNetworkKey(networkKey)
+		mdnsOptions = append(mdnsOptions, func(m *discovery.MdnsService) {
+			m.SetNetworkKey(networkKey)
+		})
+	}
+
+	if certManager.Enabled() {
+		storage.SetTLSConfig(certManager.ServerConfig())
+		rpc.SetIdentity(certManager)
+		storage.SetContactSigner(rpc)
+	}
+
+	relayServer, relayClient, err := relays(s, rpc.ID())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if relayServer != nil && certManager.Enabled() {
+		relayServer.SetTLSConfig(certManager.ServerConfig())
+	}
+
+	if relayClient != nil {
+		if certManager.Enabled() {
+			relayClient.SetTLSConfig(certManager.ClientConfig)
+		}
+		storage.SetRelay(relayClient)
+		rpc.SetRelay(relayClient)
+	}
+
+	mapper, err := portMapper(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if mapper != nil {
+		storage.SetPortMapper(mapper)
+		rpc.SetPortMapper(mapper)
+	}
+
+	quic, err := quicEnabled()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	storage.SetQUIC(quic)
+
+	rendezvousServer, puncher, err := rendezvous(rpc, storage, certManager)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if puncher != nil {
+		storage.SetPuncher(puncher)
+	}
+
+	registry, err := nameRegistry()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	storage.SetNames(registry)
+
+	quota, err := replicaQuota()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	replicator := client.NewReplicator(storage, rpc, certManager)
+	replicator.SetQuota(quota)
+	replicator.SetQUIC(quic)
+	storage.SetReplicator(replicator)
+	storage.SetWithdrawer(rpc)
+
+	dm := discovery.NewManager(discovery.MdnsStrategy(mdnsOptions...))
+	cc := client.NewConnectivityService(dm, storage, rpc, certManager)
 	cc.SetAddr("", cport)
+	cc.SetRelays(relayServer, relayClient)
+	cc.SetQUIC(quic)
+	cc.SetNames(registry)
+	cc.SetReplicator(replicator)
+	if puncher != nil {
+		cc.SetPuncher(puncher)
+	}
+	if mapper != nil {
+		cc.SetPortMapper(mapper)
+	}
 
 	services := map[string]server.Service{
-		rpc.Name():     rpc,
-		storage.Name(): storage,
-		dm.Name():      dm,
-		cc.Name():      cc,
+		rpc.Name():        rpc,
+		storage.Name():    storage,
+		dm.Name():         dm,
+		cc.Name():         cc,
+		replicator.Name(): replicator,
+	}
+
+	if certManager.Enabled() {
+		services[certManager.Name()] = certManager
+	}
+
+	if relayServer != nil {
+		services[relayServer.Name()] = relayServer
+	}
+
+	if relayClient != nil {
+		services[relayClient.Name()] = relayClient
+	}
+
+	if rendezvousServer != nil {
+		services[rendezvousServer.Name()] = rendezvousServer
+	}
+
+	if puncher != nil {
+		services[puncher.Name()] = puncher
+	}
+
+	if mapper != nil {
+		services[mapper.Name()] = mapper
 	}
 
 	return services
 
 }
 
+// networkKey reads the key of the private network this node joins.
+// SNFS_NETWORK_KEY: hex encoded 32 byte key, SNFS_NETWORK_KEY_FILE: file holding it.
+// Without either the node joins the public network
+func networkKey() (*network.Key, error) {
+	if key := os.Getenv("SNFS_NETWORK_KEY"); key != "" {
+		return network.ParseKey(key)
+	}
+
+	if path := os.Getenv("SNFS_NETWORK_KEY_FILE"); path != "" {
+		return network.ReadKey(path)
+	}
+
+	return nil, nil
+}
+
+// relays reads the relay configuration.
+// SNFS_RELAY_PORT: relay for nodes behind NAT on this port, reachable at SNFS_RELAY_HOST (default SNFS_HOST).
+// SNFS_RELAY_ADDR: host:port of the relay this node registers with because it can't accept connections
+func relays(s *server.Server, nodeID string) (*relay.Server, *relay.Client, error) {
+	var relayServer *relay.Server
+	if port := getPort("SNFS_RELAY", 0); port != 0 {
+		host := os.Getenv("SNFS_RELAY_HOST")
+		if host == "" {
+			host = s.Addr
+		}
+
+		relayServer = relay.NewServer("", port, host)
+		if value := os.Getenv("SNFS_RELAY_MAX_NODES"); value != "" {
+			max, err := strconv.Atoi(value)
+			if err != nil || max < 0 {
+				return nil, nil, fmt.Errorf("SNFS_RELAY_MAX_NODES: Invalid Count %s", value)
+			}
+			relayServer.SetMaxNodes(max)
+		}
+	}
+
+	var relayClient *relay.Client
+	if addr := os.Getenv("SNFS_RELAY_ADDR"); addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, nil, fmt.Errorf("SNFS_RELAY_ADDR: %s", err)
+		}
+
+		relayClient = relay.NewClient(addr, nodeID, net.JoinHostPort(s.Addr, strconv.Itoa(s.Port)))
+	}
+
+	return relayServer, relayClient, nil
+}
+
+// portMapper reads the port mapping configuration.
+// SNFS_PORTMAP: auto, upnp or natpmp forwards the discovery (UDP) and file (TCP) ports on the router.
+// SNFS_PORTMAP_GATEWAY: UPnP device description url or NAT-PMP gateway address, skips discovering the gateway
+func portMapper(s *server.Server) (*portmap.Mapper, error) {
+	method := os.Getenv("SNFS_PORTMAP")
+	if method == "" {
+		return nil, nil
+	}
+
+	fsPort := getPort("SNFS_FS", 0)
+	if fsPort == 0 {
+		return nil, fmt.Errorf("SNFS_PORTMAP: SNFS_FS_PORT Not Set")
+	}
+
+	mapper := portmap.NewMapper(s.Addr, s.Port, fsPort)
+	if err := mapper.SetMethod(method); err != nil {
+		return nil, fmt.Errorf("SNFS_PORTMAP: %s", err)
+	}
+	mapper.SetGateway(os.Getenv("SNFS_PORTMAP_GATEWAY"))
+
+	return mapper, nil
+}
+
+// rendezvous reads the hole punching configuration.
+// SNFS_RENDEZVOUS_PORT: introduce nodes behind NAT to their peers on this port.
+// SNFS_RENDEZVOUS_ADDR: host:port of the rendezvous this node registers with so peers can punch through to it
+func rendezvous(rpc *kad.RpcManager, storage *fs.Manager, certManager *certs.Manager) (*kad.RendezvousServer, *kad.Puncher, error) {
+	var rendezvousServer *kad.RendezvousServer
+	if port := getPort("SNFS_RENDEZVOUS", 0); port != 0 {
+		rendezvousServer = kad.NewRendezvousServer("", port)
+		if certManager.Enabled() {
+			rendezvousServer.SetIdentity(certManager)
+		}
+	}
+
+	var puncher *kad.Puncher
+	if addr := os.Getenv("SNFS_RENDEZVOUS_ADDR"); addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, nil, fmt.Errorf("SNFS_RENDEZVOUS_ADDR: %s", err)
+		}
+
+		puncher = kad.NewPuncher(rpc, addr, func() (string, error) {
+			ip, port, err := storage.AnnounceAddr()
+			if err != nil {
+				return "", err
+			}
+
+			return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+		})
+	}
+
+	return rendezvousServer, puncher, nil
+}
+
+// nameRegistry loads the key names are signed with from the snfs directory in the home directory,
+// next to the shared objects
+func nameRegistry() (*names.Registry, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return nil, err
+	}
+
+	return names.NewRegistry(path.Join(home, "snfs"))
+}
+
+// SNFS_REPLICA_QUOTA: accept up to this many bytes (e.g. 500M, 10G) of replicas of other nodes' shares.
+// Without it the node only replicates its own shares
+func replicaQuota() (int64, error) {
+	value := os.Getenv("SNFS_REPLICA_QUOTA")
+	if value == "" {
+		return 0, nil
+	}
+
+	quota, err := transfer.ParseRate(value)
+	if err != nil {
+		return 0, fmt.Errorf("SNFS_REPLICA_QUOTA: Invalid Size %s", value)
+	}
+
+	return quota, nil
+}
+
+// SNFS_QUIC: true also serves objects over QUIC and fetches them over QUIC from peers advertising it
+func quicEnabled() (bool, error) {
+	value := os.Getenv("SNFS_QUIC")
+	if value == "" {
+		return false, nil
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("SNFS_QUIC: Invalid Value %s", value)
+	}
+
+	return enabled, nil
+}
+
+// transferLimits reads the bandwidth, concurrency and timeout settings of transfers.
+// Rates are bytes per second (e.g. 500K, 10M), unset values keep transfer.DefaultLimits
+func transferLimits() (transfer.Limits, error) {
+	limits := transfer.DefaultLimits()
+	rates := map[string]*int64{
+		"SNFS_UPLOAD_RATE":        &limits.UploadRate,
+		"SNFS_PEER_UPLOAD_RATE":   &limits.PeerUploadRate,
+		"SNFS_DOWNLOAD_RATE":      &limits.DownloadRate,
+		"SNFS_PEER_DOWNLOAD_RATE": &limits.PeerDownloadRate,
+	}
+	for env, rate := range rates {
+		if value := os.Getenv(env); value != "" {
+			parsed, err := transfer.ParseRate(value)
+			if err != nil {
+				return limits, fmt.Errorf("%s: %s", env, err)
+			}
+			*rate = parsed
+		}
+	}
+
+	counts := map[string]*int{
+		"SNFS_MAX_TRANSFERS":      &limits.MaxTransfers,
+		"SNFS_MAX_PEER_TRANSFERS": &limits.MaxPeerTransfers,
+	}
+	for env, count := range counts {
+		if value := os.Getenv(env); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				return limits, fmt.Errorf("%s: Invalid Count %s", env, value)
+			}
+			*count = parsed
+		}
+	}
+
+	timeouts := map[string]*time.Duration{
+		"SNFS_REQUEST_TIMEOUT": &limits.RequestTimeout,
+		"SNFS_IDLE_TIMEOUT":    &limits.IdleTimeout,
+	}
+	for env, timeout := range timeouts {
+		if value := os.Getenv(env); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed < 0 {
+				return limits, fmt.Errorf("%s: Invalid Duration %s", env, value)
+			}
+			*timeout = parsed
+		}
+	}
+
+	return limits, nil
+}
+
 func configureMDNS(port int, address, id string) discovery.Option {
 	return func(m *discovery.MdnsService) {
 		text := []string{
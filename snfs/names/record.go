@@ -0,0 +1,58 @@
+package names
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alabianca/snfs/util"
+)
+
+// Errors
+const ErrInvalidSignature = "Record Is Not Signed By The Publisher Of Its Name"
+
+// Record points a name at the latest content published under it. Records are signed with the
+// key the name's publisher id is derived from, so any node holding one can hand it out
+type Record struct {
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	Sequence  uint64    `json:"sequence"`
+	Updated   time.Time `json:"updated"`
+	PublicKey []byte    `json:"publicKey"`
+	Signature []byte    `json:"signature"`
+}
+
+func (r Record) payload() []byte {
+	return []byte(fmt.Sprintf("snfs-name|%s|%s|%d|%d", r.Name, r.Hash, r.Sequence, r.Updated.Unix()))
+}
+
+// Verify checks that r is signed by the publisher of its name and points at a valid content id
+func (r Record) Verify() error {
+	name, err := util.ParseName(r.Name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := util.ParseContentID(r.Hash); err != nil {
+		return err
+	}
+
+	if len(r.PublicKey) != ed25519.PublicKeySize || PublisherID(r.PublicKey) != name.Publisher {
+		return errors.New(ErrInvalidSignature)
+	}
+
+	if !ed25519.Verify(r.PublicKey, r.payload(), r.Signature) {
+		return errors.New(ErrInvalidSignature)
+	}
+
+	return nil
+}
+
+// PublisherID derives the publisher id names of key are published under
+func PublisherID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:util.PublisherIDSize])
+}
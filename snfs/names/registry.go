@@ -0,0 +1,234 @@
+package names
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/alabianca/snfs/util"
+)
+
+// KeyFile holds the key this node signs its names with
+const KeyFile = "node.key"
+
+// RecordsFile holds the records of the names this node published, so sequence numbers survive restarts
+const RecordsFile = "names.json"
+
+// SupersededGrace is how long the content a synced directory's name pointed at before an update
+// is still served, so followers fetching it can finish
+const SupersededGrace = 10 * time.Minute
+
+// Errors
+const ErrNameNotFound = "Name Not Found"
+const ErrStaleRecord = "Record Is Older Than One Already Seen"
+
+// Registry publishes this node's names and remembers the newest record seen of other names
+type Registry struct {
+	dir  string
+	key  ed25519.PrivateKey
+	mtx  sync.Mutex
+	own  map[string]Record
+	seen map[string]Record
+}
+
+// NewRegistry loads the key and published names kept in dir. A key is generated on first use
+func NewRegistry(dir string) (*Registry, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	key, err := loadKey(filepath.Join(dir, KeyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Registry{
+		dir:  dir,
+		key:  key,
+		own:  make(map[string]Record),
+		seen: make(map[string]Record),
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(dir, RecordsFile))
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]Record, 0)
+	if err := json.Unmarshal(raw, &records); err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		r.own[record.Name] = record
+	}
+
+	return r, nil
+}
+
+// Publisher returns the publisher id of this node's names
+func (r *Registry) Publisher() string {
+	return PublisherID(r.key.Public().(ed25519.PublicKey))
+}
+
+// Publish points the name label@<publisher> at the content id hash with the next sequence number.
+// It returns the new record and the hash the name pointed at before. Publishing the current hash
+// again leaves the record unchanged
+func (r *Registry) Publish(label, hash string) (Record, string, error) {
+	if err := util.ValidateLabel(label); err != nil {
+		return Record{}, "", err
+	}
+
+	if _, err := util.ParseContentID(hash); err != nil {
+		return Record{}, "", err
+	}
+
+	name := util.Name{Label: label, Publisher: r.Publisher()}.String()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	previous, ok := r.own[name]
+	if ok && previous.Hash == hash {
+		return previous, previous.Hash, nil
+	}
+
+	record := Record{
+		Name:      name,
+		Hash:      hash,
+		Sequence:  previous.Sequence + 1,
+		Updated:   time.Now().Truncate(time.Second),
+		PublicKey: r.key.Public().(ed25519.PublicKey),
+	}
+	record.Signature = ed25519.Sign(r.key, record.payload())
+
+	r.own[name] = record
+	if err := r.save(); err != nil {
+		r.own[name] = previous
+		return Record{}, "", err
+	}
+
+	return record, previous.Hash, nil
+}
+
+// Lookup returns the record of name published by this node or the newest one seen
+func (r *Registry) Lookup(name string) (Record, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if record, ok := r.own[name]; ok {
+		return record, nil
+	}
+
+	if record, ok := r.seen[name]; ok {
+		return record, nil
+	}
+
+	return Record{}, errors.New(ErrNameNotFound)
+}
+
+// Accept verifies a record fetched from a peer and remembers it. Records with a lower sequence number
+// than the newest one seen are rejected, so a peer can't roll a name back to an older version
+func (r *Registry) Accept(record Record) error {
+	if err := record.Verify(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	newest, ok := r.own[record.Name]
+	if !ok {
+		newest, ok = r.seen[record.Name]
+	}
+
+	if ok && (record.Sequence < newest.Sequence || record.Sequence == newest.Sequence && record.Hash != newest.Hash) {
+		return errors.New(ErrStaleRecord)
+	}
+
+	if _, own := r.own[record.Name]; !own {
+		r.seen[record.Name] = record
+	}
+
+	return nil
+}
+
+// save writes the records of this node's names. The caller holds mtx
+func (r *Registry) save() error {
+	records := make([]Record, 0, len(r.own))
+	for _, record := range r.own {
+		records = append(records, record)
+	}
+
+	raw, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(r.dir, RecordsFile)
+	if err := ioutil.WriteFile(path+".tmp", raw, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// loadKey reads the PKCS #8 encoded ed25519 key at path, generating it if there is none
+func loadKey(path string) (ed25519.PrivateKey, error) {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return generateKey(path)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("Invalid Key In " + path)
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("Key In " + path + " Is Not An Ed25519 Key")
+	}
+
+	return key, nil
+}
+
+func generateKey(path string) (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(path, raw, 0600); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
@@ -0,0 +1,298 @@
+package network
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// KeySize is the length of a network key in bytes
+const KeySize = 32
+
+// SealedPrefix marks the single TXT record that carries the sealed text of a private node
+const SealedPrefix = "Sealed:"
+
+// tagSize is the number of hex characters of the network tag. Together with "snfs-"
+// it stays within the 15 characters DNS-SD allows for service names
+const tagSize = 10
+
+// Errors
+const ErrInvalidKey = "Network Key Must Be 64 Hex Characters"
+const ErrForeignPeer = "Peer Is Not A Member Of This Network"
+const ErrNotSealed = "Text Is Not Sealed With This Network Key"
+const ErrForeignPacket = "Packet Is Not Sealed With This Network Key"
+
+// Key is the pre-shared secret of a private network. Every value a node
+// derives from it (service name, DHT keys, certificate authority) is shared by all
+// members and meaningless to nodes outside of the network
+type Key struct {
+	secret []byte
+	caKey  ed25519.PrivateKey
+	ca     *x509.Certificate
+}
+
+// NewKey returns the network key for secret
+func NewKey(secret []byte) (*Key, error) {
+	if len(secret) != KeySize {
+		return nil, errors.New(ErrInvalidKey)
+	}
+
+	k := &Key{secret: append([]byte{}, secret...)}
+
+	k.caKey = ed25519.NewKeyFromSeed(k.derive("ca"))
+	ca, err := authority(k.caKey, "snfs-"+k.Tag()+" Network Authority")
+	if err != nil {
+		return nil, err
+	}
+
+	k.ca = ca
+
+	return k, nil
+}
+
+// ParseKey parses a hex encoded network key
+func ParseKey(s string) (*Key, error) {
+	secret, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.New(ErrInvalidKey)
+	}
+
+	return NewKey(secret)
+}
+
+// ReadKey reads a hex encoded network key from the file at path
+func ReadKey(path string) (*Key, error) {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseKey(string(bts))
+}
+
+// Tag is a short public fingerprint of the key. Nodes on the same network share it
+func (k *Key) Tag() string {
+	return hex.EncodeToString(k.derive("tag"))[:tagSize]
+}
+
+// ServiceName namespaces the mDNS service, _snfs._tcp becomes _snfs-<tag>._tcp
+func (k *Key) ServiceName(service string) string {
+	parts := strings.SplitN(service, ".", 2)
+	parts[0] += "-" + k.Tag()
+
+	return strings.Join(parts, ".")
+}
+
+// DHTKey maps the key content is announced under in the DHT into the network's keyspace.
+// Nodes without the network key can neither look the content up nor announce it
+func (k *Key) DHTKey(key string) string {
+	mac := hmac.New(sha256.New, k.derive("dht"))
+	mac.Write([]byte(key))
+
+	return hex.EncodeToString(mac.Sum(nil))[:len(key)]
+}
+
+// Seal encrypts text into a single record so other networks sharing the link
+// cannot read the addresses and node ids of our nodes
+func (k *Key) Seal(text []string) ([]string, error) {
+	aead, err := k.aead("mdns")
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(strings.Join(text, "\n")), nil)
+
+	return []string{SealedPrefix + base64.RawURLEncoding.EncodeToString(sealed)}, nil
+}
+
+// Open reverses Seal
+func (k *Key) Open(text []string) ([]string, error) {
+	if len(text) != 1 || !strings.HasPrefix(text[0], SealedPrefix) {
+		return nil, errors.New(ErrNotSealed)
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(text[0], SealedPrefix))
+	if err != nil {
+		return nil, errors.New(ErrNotSealed)
+	}
+
+	aead, err := k.aead("mdns")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New(ErrNotSealed)
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New(ErrNotSealed)
+	}
+
+	return strings.Split(string(plain), "\n"), nil
+}
+
+// Issue certifies public as the key of a node of the network named commonName and names.
+// Every member can issue certificates, the network key is the only credential
+func (k *Key) Issue(commonName string, names []string, public crypto.PublicKey, ttl time.Duration) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     names,
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	return x509.CreateCertificate(rand.Reader, template, k.ca, public, k.caKey)
+}
+
+// Pool returns the pool holding the network's certificate authority
+func (k *Key) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(k.ca)
+
+	return pool
+}
+
+// Member checks that the key of the leaf of chain was certified by the network.
+// The certificate may be the leaf itself or, next to a leaf issued by authd, one of the others
+func (k *Key) Member(chain [][]byte) error {
+	return k.member(chain, true)
+}
+
+// Certified is Member for signatures that outlive certificates. The certificate only has to
+// have been issued by the network, network certificates can't be revoked
+func (k *Key) Certified(chain [][]byte) error {
+	return k.member(chain, false)
+}
+
+func (k *Key) member(chain [][]byte, current bool) error {
+	if len(chain) == 0 {
+		return errors.New(ErrForeignPeer)
+	}
+
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, raw := range chain {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			continue
+		}
+
+		if !bytes.Equal(cert.RawSubjectPublicKeyInfo, leaf.RawSubjectPublicKeyInfo) ||
+			current && (now.Before(cert.NotBefore) || now.After(cert.NotAfter)) {
+			continue
+		}
+
+		if cert.CheckSignatureFrom(k.ca) == nil {
+			return nil
+		}
+	}
+
+	return errors.New(ErrForeignPeer)
+}
+
+// SealPacket encrypts and authenticates a DHT datagram
+func (k *Key) SealPacket(packet []byte) ([]byte, error) {
+	aead, err := k.aead("rpc")
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, packet, nil), nil
+}
+
+// OpenPacket reverses SealPacket. Datagrams of nodes without the key fail to open
+func (k *Key) OpenPacket(sealed []byte) ([]byte, error) {
+	aead, err := k.aead("rpc")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New(ErrForeignPacket)
+	}
+
+	packet, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New(ErrForeignPacket)
+	}
+
+	return packet, nil
+}
+
+func (k *Key) aead(purpose string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k.derive(purpose))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// derive returns an independent 32 byte subkey for purpose
+func (k *Key) derive(purpose string) []byte {
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write([]byte("snfs-network|" + purpose))
+
+	return mac.Sum(nil)
+}
+
+// authority returns the certificate of the network's certificate authority. It is
+// derived from the key alone, so every member arrives at the same certificate
+func authority(private ed25519.PrivateKey, name string) (*x509.Certificate, error) {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:              time.Date(2120, time.January, 1, 0, 0, 0, 0, time.UTC),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, private.Public(), private)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
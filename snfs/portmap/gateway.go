@@ -0,0 +1,44 @@
+package portmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"strings"
+)
+
+// defaultGateway reads the gateway of the default route. It only knows the linux routing table,
+// elsewhere the gateway has to be configured
+func defaultGateway() (net.IP, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, errors.New(ErrNoGateway)
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+
+		// the kernel prints the address in host byte order
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(raw))
+
+		return ip, nil
+	}
+
+	return nil, errors.New(ErrNoGateway)
+}
@@ -0,0 +1,332 @@
+package portmap
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alabianca/snfs/util"
+)
+
+const ServiceName = "PortMapper"
+
+// Lifetime is the lease requested for every mapping. Leases are renewed at half their lifetime
+const Lifetime = time.Hour
+
+// RetryInterval is how long the mapper waits before trying again after the gateway failed
+const RetryInterval = time.Minute
+
+// Methods of talking to the gateway
+const (
+	Auto   = "auto"
+	UPnP   = "upnp"
+	NATPMP = "natpmp"
+)
+
+// Errors
+const ErrNoGateway = "No Port Mapping Gateway Found"
+const ErrNotMapped = "Port Is Not Mapped"
+const ErrUnknownMethod = "Unknown Port Mapping Method"
+
+// Protocol is the transport protocol of a mapping
+type Protocol string
+
+const (
+	TCP Protocol = "TCP"
+	UDP Protocol = "UDP"
+)
+
+// Mapping forwards ExternalPort on the gateway to InternalPort on this node
+type Mapping struct {
+	Protocol     Protocol  `json:"protocol"`
+	InternalPort int       `json:"internalPort"`
+	ExternalPort int       `json:"externalPort"`
+	Expires      time.Time `json:"expires"`
+}
+
+// Status describes the gateway and the mappings it granted
+type Status struct {
+	Method     string    `json:"method"`
+	Gateway    string    `json:"gateway"`
+	ExternalIP string    `json:"externalIp"`
+	Mappings   []Mapping `json:"mappings"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// gateway is a router that forwards ports on request
+type gateway interface {
+	String() string
+	ExternalIP() (net.IP, error)
+	// AddMapping returns the external port and lease the gateway granted
+	AddMapping(protocol Protocol, internalPort, externalPort int, lifetime time.Duration) (int, time.Duration, error)
+	DeleteMapping(protocol Protocol, internalPort, externalPort int) error
+}
+
+// Mapper keeps the DHT and object ports of this node forwarded on the router and
+// learns the address peers reach them at
+type Mapper struct {
+	internalIP string
+	method     string
+	address    string
+	dhtPort    int
+	objectPort int
+	mtx        sync.Mutex
+	gateway    gateway
+	external   net.IP
+	mappings   map[Protocol]*Mapping
+	lastErr    error
+	stop       chan struct{}
+	stopOnce   sync.Once
+	id         []byte
+}
+
+// NewMapper returns a mapper forwarding the DHT port (UDP) and the object port (TCP) of the node at internalIP
+func NewMapper(internalIP string, dhtPort, objectPort int) *Mapper {
+	m := &Mapper{
+		internalIP: internalIP,
+		method:     Auto,
+		dhtPort:    dhtPort,
+		objectPort: objectPort,
+		mappings:   make(map[Protocol]*Mapping),
+		stop:       make(chan struct{}),
+		id:         make([]byte, 20),
+	}
+
+	util.RandomID(m.id)
+
+	return m
+}
+
+// SetMethod picks UPnP or NAT-PMP instead of trying both
+func (m *Mapper) SetMethod(method string) error {
+	if method != Auto && method != UPnP && method != NATPMP {
+		return errors.New(ErrUnknownMethod + " " + method)
+	}
+
+	m.method = method
+	return nil
+}
+
+// SetGateway skips discovery. address is the device description url of a UPnP gateway
+// or the host[:port] of a NAT-PMP gateway
+func (m *Mapper) SetGateway(address string) {
+	m.address = address
+}
+
+// DHTAddr returns the address peers reach the DHT node at
+func (m *Mapper) DHTAddr() (*net.UDPAddr, error) {
+	ip, port, err := m.externalAddr(UDP)
+	if err != nil {
+		return nil, err
+	}
+
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+// ObjectAddr returns the address peers reach the object server at
+func (m *Mapper) ObjectAddr() (*net.TCPAddr, error) {
+	ip, port, err := m.externalAddr(TCP)
+	if err != nil {
+		return nil, err
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func (m *Mapper) externalAddr(protocol Protocol) (net.IP, int, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	mapping, ok := m.mappings[protocol]
+	if !ok || m.external == nil {
+		return nil, 0, errors.New(ErrNotMapped)
+	}
+
+	return m.external, mapping.ExternalPort, nil
+}
+
+// Status reports the gateway and the current mappings
+func (m *Mapper) Status() Status {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	status := Status{
+		Method:   m.method,
+		Mappings: make([]Mapping, 0, len(m.mappings)),
+	}
+
+	if m.gateway != nil {
+		status.Gateway = m.gateway.String()
+	}
+
+	if m.external != nil {
+		status.ExternalIP = m.external.String()
+	}
+
+	for _, protocol := range []Protocol{UDP, TCP} {
+		if mapping, ok := m.mappings[protocol]; ok {
+			status.Mappings = append(status.Mappings, *mapping)
+		}
+	}
+
+	if m.lastErr != nil {
+		status.Error = m.lastErr.Error()
+	}
+
+	return status
+}
+
+// Service interface ID, Name, Run, Shutdown
+
+func (m *Mapper) ID() string {
+	return fmt.Sprintf("%x", m.id)
+}
+
+func (m *Mapper) Name() string {
+	return ServiceName
+}
+
+// Run maps the ports and renews the leases until Shutdown
+func (m *Mapper) Run() error {
+	for {
+		wait, err := m.renew()
+		m.mtx.Lock()
+		m.lastErr = err
+		m.mtx.Unlock()
+
+		if err != nil {
+			log.Printf("Port Mapping [Error] %s\n", err)
+			wait = RetryInterval
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-m.stop:
+			return nil
+		}
+	}
+}
+
+// Shutdown removes the mappings from the gateway
+func (m *Mapper) Shutdown() error {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.gateway == nil {
+		return nil
+	}
+
+	var err error
+	for protocol, mapping := range m.mappings {
+		if e := m.gateway.DeleteMapping(protocol, mapping.InternalPort, mapping.ExternalPort); e != nil {
+			err = e
+		}
+		delete(m.mappings, protocol)
+	}
+
+	return err
+}
+
+// renew requests or refreshes both mappings and returns when to renew them next
+func (m *Mapper) renew() (time.Duration, error) {
+	m.mtx.Lock()
+	gw := m.gateway
+	m.mtx.Unlock()
+
+	if gw == nil {
+		discovered, err := m.discover()
+		if err != nil {
+			return 0, err
+		}
+
+		gw = discovered
+		m.mtx.Lock()
+		m.gateway = gw
+		m.mtx.Unlock()
+		log.Printf("Port Mapping [Gateway] %s\n", gw)
+	}
+
+	external, err := gw.ExternalIP()
+	if err != nil {
+		m.forget()
+		return 0, err
+	}
+
+	next := Lifetime / 2
+	ports := map[Protocol]int{UDP: m.dhtPort, TCP: m.objectPort}
+	for protocol, port := range ports {
+		m.mtx.Lock()
+		requested := port
+		if mapping, ok := m.mappings[protocol]; ok {
+			requested = mapping.ExternalPort
+		}
+		m.mtx.Unlock()
+
+		mapped, lease, err := gw.AddMapping(protocol, port, requested, Lifetime)
+		if err != nil {
+			m.forget()
+			return 0, err
+		}
+
+		// a lease of zero is permanent, check on it as if it was an hour
+		if lease == 0 {
+			lease = Lifetime
+		}
+
+		if lease/2 < next {
+			next = lease / 2
+		}
+
+		m.mtx.Lock()
+		previous, ok := m.mappings[protocol]
+		m.mappings[protocol] = &Mapping{
+			Protocol:     protocol,
+			InternalPort: port,
+			ExternalPort: mapped,
+			Expires:      time.Now().Add(lease),
+		}
+		m.mtx.Unlock()
+
+		if !ok || previous.ExternalPort != mapped {
+			log.Printf("Port Mapping [Mapped] %s %s:%d -> %d\n", protocol, external, mapped, port)
+		}
+	}
+
+	m.mtx.Lock()
+	m.external = external
+	m.mtx.Unlock()
+
+	return next, nil
+}
+
+// forget drops the gateway after it failed so it is discovered again
+func (m *Mapper) forget() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.gateway = nil
+	m.external = nil
+	m.mappings = make(map[Protocol]*Mapping)
+}
+
+func (m *Mapper) discover() (gateway, error) {
+	switch m.method {
+	case UPnP:
+		return discoverUPnP(m.address, m.internalIP)
+	case NATPMP:
+		return discoverNATPMP(m.address)
+	}
+
+	if gw, err := discoverNATPMP(m.address); err == nil {
+		return gw, nil
+	}
+
+	return discoverUPnP(m.address, m.internalIP)
+}
@@ -0,0 +1,139 @@
+package portmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NATPMPPort is the port NAT-PMP gateways listen on
+const NATPMPPort = 5351
+
+// natpmpTries bounds the retransmissions of a request, the first waits 250ms and every retry doubles it
+const natpmpTries = 4
+
+const (
+	natpmpOpExternal = 0
+	natpmpOpMapUDP   = 1
+	natpmpOpMapTCP   = 2
+)
+
+// natpmp talks NAT-PMP (RFC 6886) to the gateway at addr
+type natpmp struct {
+	addr string
+}
+
+// discoverNATPMP returns the NAT-PMP gateway at address, or at the default route when address is empty
+func discoverNATPMP(address string) (gateway, error) {
+	if strings.HasPrefix(address, "http") {
+		return nil, errors.New(ErrNoGateway)
+	}
+
+	if address == "" {
+		ip, err := defaultGateway()
+		if err != nil {
+			return nil, err
+		}
+		address = ip.String()
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, strconv.Itoa(NATPMPPort))
+	}
+
+	gw := &natpmp{addr: address}
+	if _, err := gw.ExternalIP(); err != nil {
+		return nil, err
+	}
+
+	return gw, nil
+}
+
+func (n *natpmp) String() string {
+	return "NAT-PMP " + n.addr
+}
+
+func (n *natpmp) ExternalIP() (net.IP, error) {
+	res, err := n.request([]byte{0, natpmpOpExternal}, 12)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.IPv4(res[8], res[9], res[10], res[11]), nil
+}
+
+func (n *natpmp) AddMapping(protocol Protocol, internalPort, externalPort int, lifetime time.Duration) (int, time.Duration, error) {
+	res, err := n.request(natpmpMapRequest(protocol, internalPort, externalPort, lifetime), 16)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	mapped := int(binary.BigEndian.Uint16(res[10:]))
+	lease := time.Duration(binary.BigEndian.Uint32(res[12:])) * time.Second
+
+	return mapped, lease, nil
+}
+
+// DeleteMapping requests a lifetime of zero, which removes the mapping
+func (n *natpmp) DeleteMapping(protocol Protocol, internalPort, externalPort int) error {
+	_, err := n.request(natpmpMapRequest(protocol, internalPort, 0, 0), 16)
+	return err
+}
+
+func natpmpMapRequest(protocol Protocol, internalPort, externalPort int, lifetime time.Duration) []byte {
+	req := make([]byte, 12)
+	req[1] = natpmpOpMapUDP
+	if protocol == TCP {
+		req[1] = natpmpOpMapTCP
+	}
+
+	binary.BigEndian.PutUint16(req[4:], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+
+	return req
+}
+
+// request sends req until the gateway answers with a response of size bytes
+func (n *natpmp) request(req []byte, size int) ([]byte, error) {
+	conn, err := net.Dial("udp", n.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	res := make([]byte, 16)
+	timeout := 250 * time.Millisecond
+	for try := 0; try < natpmpTries; try++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		read, err := conn.Read(res)
+		timeout *= 2
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				continue
+			}
+			return nil, err
+		}
+
+		if read < size || res[0] != 0 || res[1] != req[1]+128 {
+			continue
+		}
+
+		if code := binary.BigEndian.Uint16(res[2:]); code != 0 {
+			return nil, fmt.Errorf("NAT-PMP Error %d", code)
+		}
+
+		return res[:size], nil
+	}
+
+	return nil, errors.New(ErrNoGateway)
+}
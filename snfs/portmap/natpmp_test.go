@@ -0,0 +1,219 @@
+package portmap
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNATPMP is a NAT-PMP gateway granting external ports offset from the requested ones
+type fakeNATPMP struct {
+	conn   net.PacketConn
+	offset int
+	lease  uint32
+	mtx    sync.Mutex
+	// mappings maps opcode/internal port to the external port
+	mappings map[[2]int]int
+	requests [][]byte
+}
+
+func newFakeNATPMP(t *testing.T) *fakeNATPMP {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeNATPMP{conn: conn, offset: 10000, lease: 1200, mappings: make(map[[2]int]int)}
+	go f.serve()
+	t.Cleanup(func() { conn.Close() })
+
+	return f
+}
+
+func (f *fakeNATPMP) serve() {
+	buf := make([]byte, 64)
+	for {
+		n, from, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		req := append([]byte{}, buf[:n]...)
+		f.mtx.Lock()
+		f.requests = append(f.requests, req)
+		f.mtx.Unlock()
+
+		if res := f.answer(req); res != nil {
+			f.conn.WriteTo(res, from)
+		}
+	}
+}
+
+func (f *fakeNATPMP) answer(req []byte) []byte {
+	if len(req) < 2 || req[0] != 0 {
+		return nil
+	}
+
+	switch req[1] {
+	case natpmpOpExternal:
+		res := make([]byte, 12)
+		res[1] = 128 + natpmpOpExternal
+		copy(res[8:], net.IPv4(198, 51, 100, 4).To4())
+		return res
+
+	case natpmpOpMapUDP, natpmpOpMapTCP:
+		if len(req) != 12 {
+			return nil
+		}
+
+		internal := int(binary.BigEndian.Uint16(req[4:]))
+		requested := int(binary.BigEndian.Uint16(req[6:]))
+		lifetime := binary.BigEndian.Uint32(req[8:])
+
+		f.mtx.Lock()
+		key := [2]int{int(req[1]), internal}
+		external, ok := f.mappings[key]
+		switch {
+		case lifetime == 0:
+			delete(f.mappings, key)
+			external = 0
+		case !ok && requested == internal:
+			external = internal + f.offset
+		case !ok:
+			external = requested
+		}
+		if lifetime != 0 {
+			f.mappings[key] = external
+			lifetime = f.lease
+		}
+		f.mtx.Unlock()
+
+		res := make([]byte, 16)
+		res[1] = 128 + req[1]
+		binary.BigEndian.PutUint16(res[8:], uint16(internal))
+		binary.BigEndian.PutUint16(res[10:], uint16(external))
+		binary.BigEndian.PutUint32(res[12:], lifetime)
+		return res
+	}
+
+	// unsupported opcode
+	res := make([]byte, 8)
+	res[1] = 128 + req[1]
+	binary.BigEndian.PutUint16(res[2:], 5)
+	return res
+}
+
+func (f *fakeNATPMP) snapshot() map[[2]int]int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	mappings := make(map[[2]int]int)
+	for key, external := range f.mappings {
+		mappings[key] = external
+	}
+
+	return mappings
+}
+
+func newNATPMPMapper(t *testing.T, gw *fakeNATPMP) *Mapper {
+	t.Helper()
+
+	m := NewMapper("192.168.1.10", 4000, 5000)
+	if err := m.SetMethod(NATPMP); err != nil {
+		t.Fatal(err)
+	}
+	m.SetGateway(gw.conn.LocalAddr().String())
+
+	return m
+}
+
+func TestNATPMPMapRenewUnmap(t *testing.T) {
+	gw := newFakeNATPMP(t)
+	m := newNATPMPMapper(t, gw)
+
+	next, err := m.renew()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// leases shorter than the requested lifetime are renewed at half of theirs
+	if next != 10*time.Minute {
+		t.Errorf("renews in %s, want 10m", next)
+	}
+
+	mappings := gw.snapshot()
+	if mappings[[2]int{natpmpOpMapUDP, 4000}] != 14000 || mappings[[2]int{natpmpOpMapTCP, 5000}] != 15000 || len(mappings) != 2 {
+		t.Errorf("gateway mappings = %v", mappings)
+	}
+
+	dht, err := m.DHTAddr()
+	if err != nil || dht.String() != "198.51.100.4:14000" {
+		t.Errorf("dht address = %v, %v", dht, err)
+	}
+
+	object, err := m.ObjectAddr()
+	if err != nil || object.String() != "198.51.100.4:15000" {
+		t.Errorf("object address = %v, %v", object, err)
+	}
+
+	status := m.Status()
+	if status.ExternalIP != "198.51.100.4" || len(status.Mappings) != 2 || time.Until(status.Mappings[0].Expires) < 19*time.Minute {
+		t.Errorf("status = %+v", status)
+	}
+
+	// renewals ask for the external port the gateway granted
+	gw.mtx.Lock()
+	gw.requests = nil
+	gw.mtx.Unlock()
+
+	if _, err := m.renew(); err != nil {
+		t.Fatal(err)
+	}
+
+	gw.mtx.Lock()
+	requests := gw.requests
+	gw.mtx.Unlock()
+	for _, req := range requests {
+		if req[1] == natpmpOpMapTCP && binary.BigEndian.Uint16(req[6:]) != 15000 {
+			t.Errorf("renewal requested external port %d", binary.BigEndian.Uint16(req[6:]))
+		}
+	}
+
+	if object, _ := m.ObjectAddr(); object == nil || object.Port != 15000 {
+		t.Errorf("object address after renewal = %v", object)
+	}
+
+	if err := m.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	if mappings := gw.snapshot(); len(mappings) != 0 {
+		t.Errorf("gateway mappings after shutdown = %v", mappings)
+	}
+}
+
+func TestNATPMPNoGateway(t *testing.T) {
+	// nothing answers on this port
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	m := NewMapper("192.168.1.10", 4000, 5000)
+	m.SetMethod(NATPMP)
+	m.SetGateway(addr)
+
+	if _, err := m.renew(); err == nil {
+		t.Fatal("mapped without a gateway")
+	}
+
+	if _, err := m.DHTAddr(); err == nil || err.Error() != ErrNotMapped {
+		t.Errorf("err = %v, want %s", err, ErrNotMapped)
+	}
+}
@@ -0,0 +1,320 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ssdpAddr = "239.255.255.250:1900"
+
+// ssdpTimeout is how long gateways have to answer a search
+const ssdpTimeout = 3 * time.Second
+
+const igdDevice = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+
+// upnpPermanentOnly is the error of gateways that only support leases of zero
+const upnpPermanentOnly = 725
+
+// upnpConflict is the error of gateways that forward the port to another node already
+const upnpConflict = 718
+
+// upnpTries bounds the external ports tried when the requested one is taken
+const upnpTries = 3
+
+// upnp talks to the WANIPConnection (or WANPPPConnection) service of an internet gateway device
+type upnp struct {
+	control     string
+	service     string
+	internalIP  string
+	client      *http.Client
+	permanentOK bool
+}
+
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+type upnpDescription struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpError struct {
+	code        int
+	description string
+}
+
+func (e upnpError) Error() string {
+	return fmt.Sprintf("UPnP Error %d %s", e.code, e.description)
+}
+
+// discoverUPnP returns the gateway described at location, or searches for one with SSDP when location is empty.
+// Mappings forward to internalIP
+func discoverUPnP(location, internalIP string) (gateway, error) {
+	if location != "" && !strings.HasPrefix(location, "http") {
+		return nil, errors.New(ErrNoGateway)
+	}
+
+	if location == "" {
+		found, err := ssdpSearch()
+		if err != nil {
+			return nil, err
+		}
+		location = found
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	var description upnpDescription
+	if err := xml.NewDecoder(res.Body).Decode(&description); err != nil {
+		return nil, err
+	}
+
+	service, control, ok := findConnection(description.Device)
+	if !ok {
+		return nil, errors.New(ErrNoGateway)
+	}
+
+	base := location
+	if description.URLBase != "" {
+		base = description.URLBase
+	}
+
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+
+	controlURL, err := baseURL.Parse(control)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upnp{
+		control:    controlURL.String(),
+		service:    service,
+		internalIP: internalIP,
+		client:     client,
+	}, nil
+}
+
+// findConnection looks for the service that forwards ports among device and its embedded devices
+func findConnection(device upnpDevice) (string, string, bool) {
+	for _, service := range device.Services {
+		if strings.Contains(service.ServiceType, ":WANIPConnection:") ||
+			strings.Contains(service.ServiceType, ":WANPPPConnection:") {
+			return service.ServiceType, service.ControlURL, true
+		}
+	}
+
+	for _, embedded := range device.Devices {
+		if service, control, ok := findConnection(embedded); ok {
+			return service, control, true
+		}
+	}
+
+	return "", "", false
+}
+
+// ssdpSearch multicasts a search for internet gateway devices and returns the location of the first answer
+func ssdpSearch() (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+
+	defer conn.Close()
+
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", err
+	}
+
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"ST: " + igdDevice + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), addr); err != nil {
+		return "", err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(ssdpTimeout))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return "", errors.New(ErrNoGateway)
+		}
+
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+
+		if location := res.Header.Get("Location"); location != "" {
+			return location, nil
+		}
+	}
+}
+
+func (u *upnp) String() string {
+	return "UPnP " + u.control
+}
+
+func (u *upnp) ExternalIP() (net.IP, error) {
+	res, err := u.call("GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(res["NewExternalIPAddress"])
+	if ip == nil {
+		return nil, errors.New("UPnP Gateway Has No External Address")
+	}
+
+	return ip, nil
+}
+
+// AddMapping forwards externalPort, or the next free one of the few tried after it
+func (u *upnp) AddMapping(protocol Protocol, internalPort, externalPort int, lifetime time.Duration) (int, time.Duration, error) {
+	if u.permanentOK {
+		lifetime = 0
+	}
+
+	var err error
+	for try := 0; try < upnpTries; try++ {
+		port := externalPort + try
+		err = u.addMapping(protocol, internalPort, port, lifetime)
+		if e, ok := err.(upnpError); ok && e.code == upnpPermanentOnly && lifetime != 0 {
+			u.permanentOK = true
+			lifetime = 0
+			err = u.addMapping(protocol, internalPort, port, lifetime)
+		}
+
+		if e, ok := err.(upnpError); ok && e.code == upnpConflict {
+			continue
+		}
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		return port, lifetime, nil
+	}
+
+	return 0, 0, err
+}
+
+func (u *upnp) addMapping(protocol Protocol, internalPort, externalPort int, lifetime time.Duration) error {
+	_, err := u.call("AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(externalPort)},
+		{"NewProtocol", string(protocol)},
+		{"NewInternalPort", strconv.Itoa(internalPort)},
+		{"NewInternalClient", u.internalIP},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", "snfs " + strings.ToLower(string(protocol))},
+		{"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second))},
+	})
+
+	return err
+}
+
+func (u *upnp) DeleteMapping(protocol Protocol, internalPort, externalPort int) error {
+	_, err := u.call("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(externalPort)},
+		{"NewProtocol", string(protocol)},
+	})
+
+	return err
+}
+
+// call invokes action with the ordered arguments and returns the values of the response
+func (u *upnp) call(action string, args [][2]string) (map[string]string, error) {
+	body := new(bytes.Buffer)
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + u.service + `">`)
+	for _, arg := range args {
+		body.WriteString("<" + arg[0] + ">")
+		xml.EscapeText(body, []byte(arg[1]))
+		body.WriteString("</" + arg[0] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequest(http.MethodPost, u.control, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+u.service+"#"+action+`"`)
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	raw, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	values := soapValues(raw)
+	if res.StatusCode != http.StatusOK {
+		code, _ := strconv.Atoi(values["errorCode"])
+		return nil, upnpError{code: code, description: values["errorDescription"]}
+	}
+
+	return values, nil
+}
+
+// soapValues collects the text of the leaf elements of a SOAP response by their local name
+func soapValues(raw []byte) map[string]string {
+	values := make(map[string]string)
+	decoder := xml.NewDecoder(bytes.NewReader(raw))
+
+	var name, text string
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return values
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			name, text = t.Name.Local, ""
+		case xml.CharData:
+			text += string(t)
+		case xml.EndElement:
+			if t.Name.Local == name {
+				values[name] = strings.TrimSpace(text)
+			}
+			name = ""
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package portmap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const wanIPConnection = "urn:schemas-upnp-org:service:WANIPConnection:1"
+
+// fakeIGD is an internet gateway device whose WANIPConnection service is embedded like on most routers
+type fakeIGD struct {
+	mtx           sync.Mutex
+	permanentOnly bool
+	// mappings maps protocol/external port to internal client:port
+	mappings map[string]string
+	leases   map[string]int
+	actions  []string
+}
+
+func newFakeIGD(t *testing.T) (*fakeIGD, *httptest.Server) {
+	t.Helper()
+
+	igd := &fakeIGD{mappings: make(map[string]string), leases: make(map[string]int)}
+	server := httptest.NewServer(igd)
+	t.Cleanup(server.Close)
+
+	return igd, server
+}
+
+func (f *fakeIGD) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet && req.URL.Path == "/rootDesc.xml" {
+		fmt.Fprintf(res, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>%s</deviceType>
+    <serviceList>
+      <service><serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType><controlURL>/ctl/L3F</controlURL></service>
+    </serviceList>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service><serviceType>%s</serviceType><controlURL>/ctl/IPConn</controlURL></service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`, igdDevice, wanIPConnection)
+		return
+	}
+
+	if req.Method != http.MethodPost || req.URL.Path != "/ctl/IPConn" {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	raw, _ := ioutil.ReadAll(req.Body)
+	args := soapValues(raw)
+	action := strings.TrimSuffix(strings.TrimPrefix(req.Header.Get("SOAPAction"), `"`+wanIPConnection+"#"), `"`)
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.actions = append(f.actions, action)
+	key := args["NewProtocol"] + "/" + args["NewExternalPort"]
+
+	switch action {
+	case "GetExternalIPAddress":
+		soapResponse(res, action, "<NewExternalIPAddress>203.0.113.7</NewExternalIPAddress>")
+
+	case "AddPortMapping":
+		internal := args["NewInternalClient"] + ":" + args["NewInternalPort"]
+		if owner, ok := f.mappings[key]; ok && owner != internal {
+			soapFault(res, upnpConflict, "ConflictInMappingEntry")
+			return
+		}
+
+		lease, _ := strconv.Atoi(args["NewLeaseDuration"])
+		if f.permanentOnly && lease != 0 {
+			soapFault(res, upnpPermanentOnly, "OnlyPermanentLeasesSupported")
+			return
+		}
+
+		f.mappings[key] = internal
+		f.leases[key] = lease
+		soapResponse(res, action, "")
+
+	case "DeletePortMapping":
+		if _, ok := f.mappings[key]; !ok {
+			soapFault(res, 714, "NoSuchEntryInArray")
+			return
+		}
+
+		delete(f.mappings, key)
+		soapResponse(res, action, "")
+
+	default:
+		soapFault(res, 401, "Invalid Action")
+	}
+}
+
+func soapResponse(res http.ResponseWriter, action, values string) {
+	fmt.Fprintf(res, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+		`<u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body></s:Envelope>`, action, wanIPConnection, values, action)
+}
+
+func soapFault(res http.ResponseWriter, code int, description string) {
+	res.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(res, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>`+
+		`<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError>`+
+		`</detail></s:Fault></s:Body></s:Envelope>`, code, description)
+}
+
+func (f *fakeIGD) snapshot() (map[string]string, map[string]int) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	mappings := make(map[string]string)
+	leases := make(map[string]int)
+	for key, internal := range f.mappings {
+		mappings[key] = internal
+		leases[key] = f.leases[key]
+	}
+
+	return mappings, leases
+}
+
+func newUPnPMapper(t *testing.T, server *httptest.Server) *Mapper {
+	t.Helper()
+
+	m := NewMapper("192.168.1.10", 4000, 5000)
+	if err := m.SetMethod(UPnP); err != nil {
+		t.Fatal(err)
+	}
+	m.SetGateway(server.URL + "/rootDesc.xml")
+
+	return m
+}
+
+func TestUPnPMapRenewUnmap(t *testing.T) {
+	igd, server := newFakeIGD(t)
+	m := newUPnPMapper(t, server)
+
+	next, err := m.renew()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if next != Lifetime/2 {
+		t.Errorf("renews in %s, want %s", next, Lifetime/2)
+	}
+
+	mappings, leases := igd.snapshot()
+	want := map[string]string{"UDP/4000": "192.168.1.10:4000", "TCP/5000": "192.168.1.10:5000"}
+	if fmt.Sprint(mappings) != fmt.Sprint(want) {
+		t.Errorf("gateway mappings = %v, want %v", mappings, want)
+	}
+
+	for key, lease := range leases {
+		if lease != int(Lifetime/time.Second) {
+			t.Errorf("%s was mapped for %ds", key, lease)
+		}
+	}
+
+	dht, err := m.DHTAddr()
+	if err != nil || dht.String() != "203.0.113.7:4000" {
+		t.Errorf("dht address = %v, %v", dht, err)
+	}
+
+	object, err := m.ObjectAddr()
+	if err != nil || object.String() != "203.0.113.7:5000" {
+		t.Errorf("object address = %v, %v", object, err)
+	}
+
+	// renewing refreshes the same mappings
+	if _, err := m.renew(); err != nil {
+		t.Fatal(err)
+	}
+
+	if after, _ := igd.snapshot(); fmt.Sprint(after) != fmt.Sprint(want) {
+		t.Errorf("gateway mappings after renewal = %v, want %v", after, want)
+	}
+
+	if err := m.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	if after, _ := igd.snapshot(); len(after) != 0 {
+		t.Errorf("gateway mappings after shutdown = %v", after)
+	}
+
+	if _, err := m.ObjectAddr(); err == nil || err.Error() != ErrNotMapped {
+		t.Errorf("err = %v, want %s", err, ErrNotMapped)
+	}
+}
+
+func TestUPnPTakenPort(t *testing.T) {
+	igd, server := newFakeIGD(t)
+	igd.mappings["TCP/5000"] = "192.168.1.20:5000"
+
+	m := newUPnPMapper(t, server)
+	if _, err := m.renew(); err != nil {
+		t.Fatal(err)
+	}
+
+	object, err := m.ObjectAddr()
+	if err != nil || object.Port != 5001 {
+		t.Errorf("object address = %v, %v, want port 5001", object, err)
+	}
+
+	// the renewal asks for the port it was granted
+	if _, err := m.renew(); err != nil {
+		t.Fatal(err)
+	}
+
+	mappings, _ := igd.snapshot()
+	if mappings["TCP/5000"] != "192.168.1.20:5000" || mappings["TCP/5001"] != "192.168.1.10:5000" || len(mappings) != 3 {
+		t.Errorf("gateway mappings = %v", mappings)
+	}
+
+	if err := m.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	if mappings, _ := igd.snapshot(); len(mappings) != 1 {
+		t.Errorf("gateway mappings after shutdown = %v", mappings)
+	}
+}
+
+func TestUPnPPermanentLeases(t *testing.T) {
+	igd, server := newFakeIGD(t)
+	igd.permanentOnly = true
+
+	m := newUPnPMapper(t, server)
+	next, err := m.renew()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if next != Lifetime/2 {
+		t.Errorf("renews in %s, want %s", next, Lifetime/2)
+	}
+
+	_, leases := igd.snapshot()
+	if len(leases) != 2 || leases["UDP/4000"] != 0 || leases["TCP/5000"] != 0 {
+		t.Errorf("gateway leases = %v", leases)
+	}
+
+	// once refused, leases aren't asked for again
+	igd.mtx.Lock()
+	igd.actions = nil
+	igd.mtx.Unlock()
+
+	if _, err := m.renew(); err != nil {
+		t.Fatal(err)
+	}
+
+	igd.mtx.Lock()
+	actions := igd.actions
+	igd.mtx.Unlock()
+	if fmt.Sprint(actions) != "[GetExternalIPAddress AddPortMapping AddPortMapping]" {
+		t.Errorf("renewal called %v", actions)
+	}
+}
+
+func TestUPnPGatewayLost(t *testing.T) {
+	_, server := newFakeIGD(t)
+
+	m := newUPnPMapper(t, server)
+	if _, err := m.renew(); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Close()
+	if _, err := m.renew(); err == nil {
+		t.Fatal("renewed with a gateway that is gone")
+	}
+
+	if status := m.Status(); status.Gateway != "" || len(status.Mappings) != 0 {
+		t.Errorf("status = %+v", status)
+	}
+}
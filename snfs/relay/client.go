@@ -0,0 +1,386 @@
+package relay
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alabianca/snfs/util"
+)
+
+const ClientServiceName = "RelayClient"
+
+// RetryInterval is how long the client waits before registering again after losing its relay
+const RetryInterval = 5 * time.Second
+
+// TunnelIdle is how long the DHT tunnel of a remote node stays open without traffic
+const TunnelIdle = 2 * time.Minute
+
+// ClientStatus describes the registration of this node with its relay
+type ClientStatus struct {
+	Relay      string `json:"relay"`
+	Connected  bool   `json:"connected"`
+	ObjectAddr string `json:"objectAddr"`
+	DHTAddr    string `json:"dhtAddr"`
+}
+
+// Client keeps this node registered with a relay. It is the net.Listener
+// the object server accepts relayed connections on, and it delivers relayed
+// DHT datagrams to the local DHT node at dht
+type Client struct {
+	relay      string
+	nodeID     string
+	dht        string
+	tlsConfig  func() (*tls.Config, error)
+	conns      chan net.Conn
+	mtx        sync.Mutex
+	writeMtx   sync.Mutex
+	control    net.Conn
+	objectAddr *net.TCPAddr
+	dhtAddr    *net.UDPAddr
+	tunnels    map[string]*net.UDPConn
+	stop       chan struct{}
+	stopOnce   sync.Once
+	id         []byte
+}
+
+// NewClient returns a client registering nodeID with the relay at host:port.
+// Relayed DHT datagrams are delivered to the local DHT node at dht (host:port)
+func NewClient(relay, nodeID, dht string) *Client {
+	c := &Client{
+		relay:   relay,
+		nodeID:  nodeID,
+		dht:     dht,
+		conns:   make(chan net.Conn),
+		tunnels: make(map[string]*net.UDPConn),
+		stop:    make(chan struct{}),
+		id:      make([]byte, 20),
+	}
+
+	util.RandomID(c.id)
+
+	return c
+}
+
+// SetTLSConfig makes the client talk TLS to the relay. config is asked on every dial
+// so renewed certificates are picked up
+func (c *Client) SetTLSConfig(config func() (*tls.Config, error)) {
+	c.tlsConfig = config
+}
+
+// ObjectAddr returns the address peers reach this node's object server at
+func (c *Client) ObjectAddr() (*net.TCPAddr, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.objectAddr == nil {
+		return nil, errors.New(ErrNotRegistered)
+	}
+
+	return c.objectAddr, nil
+}
+
+// DHTAddr returns the address peers reach this node's DHT node at
+func (c *Client) DHTAddr() (*net.UDPAddr, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.dhtAddr == nil {
+		return nil, errors.New(ErrNotRegistered)
+	}
+
+	return c.dhtAddr, nil
+}
+
+// Status reports the relay and the addresses it assigned
+func (c *Client) Status() ClientStatus {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	status := ClientStatus{
+		Relay:     c.relay,
+		Connected: c.objectAddr != nil,
+	}
+	if c.objectAddr != nil {
+		status.ObjectAddr = c.objectAddr.String()
+		status.DHTAddr = c.dhtAddr.String()
+	}
+
+	return status
+}
+
+// net.Listener
+
+// Accept returns the next connection relayed to this node
+func (c *Client) Accept() (net.Conn, error) {
+	select {
+	case conn := <-c.conns:
+		return conn, nil
+	case <-c.stop:
+		return nil, errors.New(ErrClosed)
+	}
+}
+
+func (c *Client) Close() error {
+	return c.Shutdown()
+}
+
+func (c *Client) Addr() net.Addr {
+	if addr, err := c.ObjectAddr(); err == nil {
+		return addr
+	}
+
+	return &net.TCPAddr{}
+}
+
+// Service interface ID, Name, Run, Shutdown
+
+func (c *Client) ID() string {
+	return fmt.Sprintf("%x", c.id)
+}
+
+func (c *Client) Name() string {
+	return ClientServiceName
+}
+
+// Run registers with the relay and registers again whenever the connection is lost
+func (c *Client) Run() error {
+	for {
+		err := c.session()
+
+		select {
+		case <-c.stop:
+			return nil
+		default:
+		}
+
+		log.Printf("Relay [Disconnected] %s %s\n", c.relay, err)
+
+		select {
+		case <-time.After(RetryInterval):
+		case <-c.stop:
+			return nil
+		}
+	}
+}
+
+func (c *Client) Shutdown() error {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.control != nil {
+		return c.control.Close()
+	}
+
+	return nil
+}
+
+func (c *Client) session() error {
+	control, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	defer control.Close()
+
+	reader := bufio.NewReader(control)
+	control.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := writeLine(control, "REGISTER", c.nodeID); err != nil {
+		return err
+	}
+
+	words, err := readLine(reader)
+	if err != nil {
+		return err
+	}
+
+	if words[0] != "OK" || len(words) != 3 {
+		return errors.New(strings.Join(words[1:], " "))
+	}
+
+	objectAddr, err := net.ResolveTCPAddr("tcp", words[1])
+	if err != nil {
+		return err
+	}
+
+	dhtAddr, err := net.ResolveUDPAddr("udp", words[2])
+	if err != nil {
+		return err
+	}
+
+	control.SetDeadline(time.Time{})
+	c.mtx.Lock()
+	c.control = control
+	c.objectAddr = objectAddr
+	c.dhtAddr = dhtAddr
+	c.mtx.Unlock()
+
+	defer c.reset()
+
+	log.Printf("Relay [Registered] %s objects %s dht %s\n", c.relay, objectAddr, dhtAddr)
+
+	for {
+		control.SetReadDeadline(time.Now().Add(2 * KeepAlive))
+		f, err := readFrame(reader)
+		if err != nil {
+			return err
+		}
+
+		switch f.kind {
+		case frameConnect:
+			go c.dialBack(hex.EncodeToString(f.payload))
+		case frameDatagram:
+			c.deliver(f.payload)
+		case framePing:
+			if err := c.send(frame{kind: framePong}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// reset forgets the assigned addresses and closes the DHT tunnels of a lost session
+func (c *Client) reset() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.control = nil
+	c.objectAddr = nil
+	c.dhtAddr = nil
+	for addr, tunnel := range c.tunnels {
+		tunnel.Close()
+		delete(c.tunnels, addr)
+	}
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	raw, err := net.DialTimeout("tcp", c.relay, handshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.tlsConfig == nil {
+		return raw, nil
+	}
+
+	config, err := c.tlsConfig()
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+
+	return secure(raw, config, false), nil
+}
+
+func (c *Client) send(f frame) error {
+	c.mtx.Lock()
+	control := c.control
+	c.mtx.Unlock()
+
+	if control == nil {
+		return errors.New(ErrNotRegistered)
+	}
+
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+
+	control.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	return writeFrame(control, f)
+}
+
+// dialBack opens the connection the relay pipes a waiting peer to
+func (c *Client) dialBack(token string) {
+	conn, err := c.dial()
+	if err != nil {
+		log.Printf("Relay [Dial Back Error] %s\n", err)
+		return
+	}
+
+	if err := writeLine(conn, "ACCEPT", token); err != nil {
+		conn.Close()
+		return
+	}
+
+	select {
+	case c.conns <- conn:
+	case <-c.stop:
+		conn.Close()
+	}
+}
+
+// deliver hands a relayed datagram to the local DHT node. Every remote node gets
+// its own local socket so the replies can be sent back to it
+func (c *Client) deliver(payload []byte) {
+	addr, data, err := parseDatagram(payload)
+	if err != nil {
+		return
+	}
+
+	tunnel, err := c.tunnel(addr)
+	if err != nil {
+		log.Printf("Relay [Tunnel Error] %s\n", err)
+		return
+	}
+
+	tunnel.Write(data)
+}
+
+func (c *Client) tunnel(addr string) (*net.UDPConn, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if tunnel, ok := c.tunnels[addr]; ok {
+		return tunnel, nil
+	}
+
+	dht, err := net.ResolveUDPAddr("udp", c.dht)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnel, err := net.DialUDP("udp", nil, dht)
+	if err != nil {
+		return nil, err
+	}
+
+	c.tunnels[addr] = tunnel
+	go c.replies(addr, tunnel)
+
+	return tunnel, nil
+}
+
+// replies sends the local DHT node's answers to the remote node at addr back through the relay
+func (c *Client) replies(addr string, tunnel *net.UDPConn) {
+	defer func() {
+		c.mtx.Lock()
+		if c.tunnels[addr] == tunnel {
+			delete(c.tunnels, addr)
+		}
+		c.mtx.Unlock()
+		tunnel.Close()
+	}()
+
+	buf := make([]byte, maxFrameSize)
+	for {
+		tunnel.SetReadDeadline(time.Now().Add(TunnelIdle))
+		n, err := tunnel.Read(buf)
+		if err != nil {
+			return
+		}
+
+		if err := c.send(datagramFrame(addr, buf[:n])); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package relay
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// A node behind NAT keeps a control connection open to its relay:
+//
+//	node -> relay  REGISTER <node id>\n
+//	relay -> node  OK <object addr> <dht addr>\n   or   ERR <message>\n
+//
+// after which both sides exchange frames. For every peer connecting to the node's
+// object address the relay sends a connect frame and the node dials back with
+//
+//	node -> relay  ACCEPT <token>\n
+//
+// from then on the relay copies bytes between the peer and the node. DHT datagrams
+// reaching the node's dht address travel inside datagram frames
+
+const (
+	frameConnect byte = iota + 1
+	frameDatagram
+	framePing
+	framePong
+)
+
+// maxFrameSize bounds frames, datagrams are far smaller
+const maxFrameSize = 64 * 1024
+
+// KeepAlive is how often the relay pings registered nodes
+const KeepAlive = 30 * time.Second
+
+// handshakeTimeout bounds the time a connection has to identify itself
+const handshakeTimeout = 10 * time.Second
+
+// Errors
+const ErrNotRegistered = "Node Is Not Registered With A Relay"
+const ErrRelayFull = "Relay Is Full"
+const ErrInvalidFrame = "Invalid Relay Frame"
+const ErrInvalidHandshake = "Invalid Relay Handshake"
+const ErrIdentityMismatch = "Node Id Does Not Match Certificate"
+const ErrClosed = "Relay Client Closed"
+
+type frame struct {
+	kind    byte
+	payload []byte
+}
+
+func writeFrame(w io.Writer, f frame) error {
+	if len(f.payload) > maxFrameSize {
+		return errors.New(ErrInvalidFrame)
+	}
+
+	header := make([]byte, 5)
+	header[0] = f.kind
+	binary.BigEndian.PutUint32(header[1:], uint32(len(f.payload)))
+
+	_, err := w.Write(append(header, f.payload...))
+	return err
+}
+
+func readFrame(r io.Reader) (frame, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return frame{}, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return frame{}, errors.New(ErrInvalidFrame)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return frame{}, err
+	}
+
+	return frame{kind: header[0], payload: payload}, nil
+}
+
+// datagram frames carry the address of the remote DHT node along with the packet
+func datagramFrame(addr string, data []byte) frame {
+	payload := make([]byte, 2+len(addr)+len(data))
+	binary.BigEndian.PutUint16(payload, uint16(len(addr)))
+	copy(payload[2:], addr)
+	copy(payload[2+len(addr):], data)
+
+	return frame{kind: frameDatagram, payload: payload}
+}
+
+func parseDatagram(payload []byte) (string, []byte, error) {
+	if len(payload) < 2 {
+		return "", nil, errors.New(ErrInvalidFrame)
+	}
+
+	size := int(binary.BigEndian.Uint16(payload))
+	if len(payload) < 2+size {
+		return "", nil, errors.New(ErrInvalidFrame)
+	}
+
+	return string(payload[2 : 2+size]), payload[2+size:], nil
+}
+
+func writeLine(w io.Writer, words ...string) error {
+	_, err := fmt.Fprintf(w, "%s\n", strings.Join(words, " "))
+	return err
+}
+
+func readLine(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		return nil, errors.New(ErrInvalidHandshake)
+	}
+
+	return words, nil
+}
+
+// conn is a connection whose reads go through the buffered reader used for the handshake
+type conn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// secure wraps raw in TLS when config is set
+func secure(raw net.Conn, config *tls.Config, server bool) net.Conn {
+	if config == nil {
+		return raw
+	}
+
+	if server {
+		return tls.Server(raw, config)
+	}
+
+	return tls.Client(raw, config)
+}
+
+// pipe copies between a and b until either side is done and closes both
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
@@ -0,0 +1,183 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startServer runs a relay on a free loopback port
+func startServer(t *testing.T) (*Server, string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	server := NewServer("127.0.0.1", port, "127.0.0.1")
+	go server.Run()
+	t.Cleanup(func() { server.Shutdown() })
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	waitFor(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	})
+
+	return server, addr
+}
+
+// startClient registers nodeID with the relay at addr, delivering datagrams to dht
+func startClient(t *testing.T, addr, nodeID, dht string) *Client {
+	t.Helper()
+
+	client := NewClient(addr, nodeID, dht)
+	go client.Run()
+	t.Cleanup(func() { client.Shutdown() })
+
+	waitFor(t, func() bool {
+		_, err := client.ObjectAddr()
+		return err == nil
+	})
+
+	return client
+}
+
+func waitFor(t *testing.T, ready func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !ready() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRelayObjectStream(t *testing.T) {
+	server, addr := startServer(t)
+	node := startClient(t, addr, "node-a", "127.0.0.1:1")
+
+	// the node serves objects on its relay client like the object server does
+	content := make([]byte, 1<<20)
+	rand.Read(content)
+	go http.Serve(node, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write(content)
+	}))
+
+	objectAddr, err := node.ObjectAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two transfers in a row each get their own dial back
+	for i := 0; i < 2; i++ {
+		response, err := http.Get("http://" + objectAddr.String() + "/v1/object/hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		received, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(received, content) {
+			t.Fatalf("received %d bytes that differ from the %d sent", len(received), len(content))
+		}
+	}
+
+	status := server.Status()
+	if len(status) != 1 || status[0].NodeID != "node-a" || status[0].ObjectAddr != objectAddr.String() {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+func TestRelayDatagrams(t *testing.T) {
+	_, addr := startServer(t)
+
+	// the node's DHT answers every packet with its upper case
+	dht, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dht.Close()
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := dht.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			dht.WriteTo(bytes.ToUpper(buf[:n]), from)
+		}
+	}()
+
+	node := startClient(t, addr, "node-a", dht.LocalAddr().String())
+	dhtAddr, err := node.DHTAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := net.DialUDP("udp", nil, dhtAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	for _, msg := range []string{"ping", "find node"} {
+		if _, err := peer.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+
+		peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1024)
+		n, err := peer.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := string(buf[:n]); got != string(bytes.ToUpper([]byte(msg))) {
+			t.Errorf("reply = %q to %q", got, msg)
+		}
+	}
+}
+
+func TestRelayFull(t *testing.T) {
+	server, addr := startServer(t)
+	server.SetMaxNodes(1)
+
+	startClient(t, addr, "node-a", "127.0.0.1:1")
+
+	second := NewClient(addr, "node-b", "127.0.0.1:1")
+	defer second.Shutdown()
+
+	if err := second.session(); err == nil || err.Error() != ErrRelayFull {
+		t.Errorf("err = %v, want %s", err, ErrRelayFull)
+	}
+
+	// a node registering again replaces its own session
+	again := startClient(t, addr, "node-a", "127.0.0.1:1")
+	if status := server.Status(); len(status) != 1 {
+		t.Errorf("status = %+v", status)
+	}
+
+	if _, err := again.ObjectAddr(); err != nil {
+		t.Error(err)
+	}
+}
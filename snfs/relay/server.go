@@ -0,0 +1,460 @@
+package relay
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alabianca/snfs/snfs/certs"
+	"github.com/alabianca/snfs/util"
+)
+
+const ServiceName = "RelayService"
+
+// ConnectTimeout is how long a peer waits for the relayed node to dial back
+const ConnectTimeout = 10 * time.Second
+
+// DefaultMaxNodes is the number of nodes a relay serves at once
+const DefaultMaxNodes = 32
+
+// SessionStatus describes a node registered with this relay
+type SessionStatus struct {
+	NodeID     string    `json:"nodeId"`
+	ObjectAddr string    `json:"objectAddr"`
+	DHTAddr    string    `json:"dhtAddr"`
+	Since      time.Time `json:"since"`
+}
+
+// Server relays object streams and DHT rpcs to nodes that cannot accept inbound connections.
+// Every registered node gets its own TCP (objects) and UDP (DHT) port on the relay
+type Server struct {
+	addr      string
+	port      int
+	host      string
+	maxNodes  int
+	tlsConfig *tls.Config
+	listener  net.Listener
+	mtx       sync.Mutex
+	sessions  map[string]*session
+	pending   map[string]chan net.Conn
+	id        []byte
+}
+
+// NewServer returns a relay that accepts registrations on addr:port.
+// host is the address peers reach the relayed nodes at
+func NewServer(addr string, port int, host string) *Server {
+	s := &Server{
+		addr:     addr,
+		port:     port,
+		host:     host,
+		maxNodes: DefaultMaxNodes,
+		sessions: make(map[string]*session),
+		pending:  make(map[string]chan net.Conn),
+		id:       make([]byte, 20),
+	}
+
+	util.RandomID(s.id)
+
+	return s
+}
+
+// SetTLSConfig makes nodes register over TLS. With certificates nodes may only register their own node id
+func (s *Server) SetTLSConfig(config *tls.Config) {
+	s.tlsConfig = config
+}
+
+// SetMaxNodes limits the number of nodes served at once
+func (s *Server) SetMaxNodes(n int) {
+	s.maxNodes = n
+}
+
+// Status lists the nodes registered with this relay
+func (s *Server) Status() []SessionStatus {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	status := make([]SessionStatus, 0, len(s.sessions))
+	for _, ss := range s.sessions {
+		status = append(status, ss.status())
+	}
+
+	return status
+}
+
+// Service interface ID, Name, Run, Shutdown
+
+func (s *Server) ID() string {
+	return fmt.Sprintf("%x", s.id)
+}
+
+func (s *Server) Name() string {
+	return ServiceName
+}
+
+func (s *Server) Run() error {
+	listener, err := net.Listen("tcp", net.JoinHostPort(s.addr, strconv.Itoa(s.port)))
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	s.listener = listener
+	s.mtx.Unlock()
+
+	log.Printf("Relay [Listening] %s\n", listener.Addr())
+
+	for {
+		raw, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.handle(raw)
+	}
+}
+
+func (s *Server) Shutdown() error {
+	s.mtx.Lock()
+	listener := s.listener
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, ss := range s.sessions {
+		sessions = append(sessions, ss)
+	}
+	s.mtx.Unlock()
+
+	for _, ss := range sessions {
+		ss.close()
+	}
+
+	if listener != nil {
+		return listener.Close()
+	}
+
+	return nil
+}
+
+func (s *Server) handle(raw net.Conn) {
+	raw.SetDeadline(time.Now().Add(handshakeTimeout))
+	c := secure(raw, s.tlsConfig, true)
+	reader := bufio.NewReader(c)
+
+	words, err := readLine(reader)
+	if err != nil || len(words) != 2 {
+		c.Close()
+		return
+	}
+
+	switch words[0] {
+	case "REGISTER":
+		s.register(&conn{Conn: c, reader: reader}, words[1])
+	case "ACCEPT":
+		s.accept(&conn{Conn: c, reader: reader}, words[1])
+	default:
+		c.Close()
+	}
+}
+
+func (s *Server) register(c *conn, nodeID string) {
+	if err := s.checkIdentity(c, nodeID); err != nil {
+		writeLine(c, "ERR", err.Error())
+		c.Close()
+		return
+	}
+
+	ss, err := s.open(c, nodeID)
+	if err != nil {
+		writeLine(c, "ERR", err.Error())
+		c.Close()
+		return
+	}
+
+	if err := writeLine(c, "OK", ss.objectAddr(), ss.dhtAddr()); err != nil {
+		ss.close()
+		return
+	}
+
+	log.Printf("Relay [Registered] %s objects %s dht %s\n", nodeID, ss.objectAddr(), ss.dhtAddr())
+	c.SetDeadline(time.Time{})
+
+	go ss.serveObjects()
+	go ss.serveDHT()
+	go ss.keepAlive()
+	ss.readControl()
+	ss.close()
+
+	log.Printf("Relay [Unregistered] %s\n", nodeID)
+}
+
+// checkIdentity makes sure a node registers the node id its certificate was issued for
+func (s *Server) checkIdentity(c *conn, nodeID string) error {
+	tlsConn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	id, err := certs.NodeID(state.PeerCertificates[0])
+	if err != nil {
+		return err
+	}
+
+	if id != nodeID {
+		return errors.New(ErrIdentityMismatch)
+	}
+
+	return nil
+}
+
+// open allocates the ports of a new session. A node registering again replaces its old session
+func (s *Server) open(c *conn, nodeID string) (*session, error) {
+	s.mtx.Lock()
+	old := s.sessions[nodeID]
+	full := old == nil && s.maxNodes > 0 && len(s.sessions) >= s.maxNodes
+	s.mtx.Unlock()
+
+	if full {
+		return nil, errors.New(ErrRelayFull)
+	}
+
+	if old != nil {
+		old.close()
+	}
+
+	objects, err := net.Listen("tcp", net.JoinHostPort(s.addr, "0"))
+	if err != nil {
+		return nil, err
+	}
+
+	// prefer the same port number for both so the node is reachable at one address
+	port := objects.Addr().(*net.TCPAddr).Port
+	dht, err := net.ListenPacket("udp", net.JoinHostPort(s.addr, strconv.Itoa(port)))
+	if err != nil {
+		dht, err = net.ListenPacket("udp", net.JoinHostPort(s.addr, "0"))
+	}
+	if err != nil {
+		objects.Close()
+		return nil, err
+	}
+
+	ss := &session{
+		server:  s,
+		nodeID:  nodeID,
+		control: c,
+		objects: objects,
+		dht:     dht,
+		since:   time.Now(),
+		closed:  make(chan struct{}),
+	}
+
+	s.mtx.Lock()
+	s.sessions[nodeID] = ss
+	s.mtx.Unlock()
+
+	return ss, nil
+}
+
+// accept hands the connection a node dialed back with to the peer waiting for it
+func (s *Server) accept(c *conn, token string) {
+	s.mtx.Lock()
+	waiting, ok := s.pending[token]
+	delete(s.pending, token)
+	s.mtx.Unlock()
+
+	if !ok {
+		c.Close()
+		return
+	}
+
+	c.SetDeadline(time.Time{})
+	waiting <- c
+}
+
+func (s *Server) expect(token string) chan net.Conn {
+	waiting := make(chan net.Conn, 1)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.pending[token] = waiting
+
+	return waiting
+}
+
+func (s *Server) forget(token string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.pending, token)
+}
+
+func (s *Server) remove(ss *session) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.sessions[ss.nodeID] == ss {
+		delete(s.sessions, ss.nodeID)
+	}
+}
+
+type session struct {
+	server    *Server
+	nodeID    string
+	control   *conn
+	writeMtx  sync.Mutex
+	objects   net.Listener
+	dht       net.PacketConn
+	since     time.Time
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (ss *session) objectAddr() string {
+	return net.JoinHostPort(ss.server.host, strconv.Itoa(ss.objects.Addr().(*net.TCPAddr).Port))
+}
+
+func (ss *session) dhtAddr() string {
+	return net.JoinHostPort(ss.server.host, strconv.Itoa(ss.dht.LocalAddr().(*net.UDPAddr).Port))
+}
+
+func (ss *session) status() SessionStatus {
+	return SessionStatus{
+		NodeID:     ss.nodeID,
+		ObjectAddr: ss.objectAddr(),
+		DHTAddr:    ss.dhtAddr(),
+		Since:      ss.since,
+	}
+}
+
+func (ss *session) send(f frame) error {
+	ss.writeMtx.Lock()
+	defer ss.writeMtx.Unlock()
+
+	ss.control.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	return writeFrame(ss.control, f)
+}
+
+func (ss *session) serveObjects() {
+	for {
+		peer, err := ss.objects.Accept()
+		if err != nil {
+			return
+		}
+
+		go ss.relay(peer)
+	}
+}
+
+// relay asks the node to dial back and pipes the peer's connection to it
+func (ss *session) relay(peer net.Conn) {
+	token, err := randomToken()
+	if err != nil {
+		peer.Close()
+		return
+	}
+
+	waiting := ss.server.expect(token)
+	defer ss.server.forget(token)
+
+	raw, _ := hex.DecodeString(token)
+	if err := ss.send(frame{kind: frameConnect, payload: raw}); err != nil {
+		peer.Close()
+		return
+	}
+
+	select {
+	case node := <-waiting:
+		pipe(peer, node)
+	case <-time.After(ConnectTimeout):
+		peer.Close()
+	case <-ss.closed:
+		peer.Close()
+	}
+}
+
+func (ss *session) serveDHT() {
+	buf := make([]byte, maxFrameSize)
+	for {
+		n, addr, err := ss.dht.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		if err := ss.send(datagramFrame(addr.String(), buf[:n])); err != nil {
+			ss.close()
+			return
+		}
+	}
+}
+
+// readControl forwards the node's DHT replies until the node goes away
+func (ss *session) readControl() {
+	for {
+		ss.control.SetReadDeadline(time.Now().Add(2 * KeepAlive))
+		f, err := readFrame(ss.control)
+		if err != nil {
+			return
+		}
+
+		if f.kind != frameDatagram {
+			continue
+		}
+
+		addr, data, err := parseDatagram(f.payload)
+		if err != nil {
+			return
+		}
+
+		to, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			continue
+		}
+
+		ss.dht.WriteTo(data, to)
+	}
+}
+
+func (ss *session) keepAlive() {
+	ticker := time.NewTicker(KeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := ss.send(frame{kind: framePing}); err != nil {
+				ss.close()
+				return
+			}
+		case <-ss.closed:
+			return
+		}
+	}
+}
+
+func (ss *session) close() {
+	ss.closeOnce.Do(func() {
+		close(ss.closed)
+		ss.server.remove(ss)
+		ss.control.Close()
+		ss.objects.Close()
+		ss.dht.Close()
+	})
+}
+
+func randomToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(token), nil
+}
@@ -8,12 +8,18 @@ import (
 	"time"
 )
 
-const NumServices = 5
+const NumServices = 10
 
 const DiscoveryManager = "DiscoveryManager"
 const ClientConnectivityService = "ConnectivityService"
 const RPCManager = "RPCManager"
 const StorageManager = "StorageManager"
+const CertificateManager = "CertificateManager"
+const RelayService = "RelayService"
+const RelayClient = "RelayClient"
+const RendezvousService = "RendezvousService"
+const HolePuncher = "HolePuncher"
+const PortMapper = "PortMapper"
 
 var queue chan ServiceRequest
 var onceQueue sync.Once
@@ -0,0 +1,42 @@
+package transfer
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Errors
+const ErrInvalidRate = "Invalid Rate"
+
+var rateUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"G", 1000 * 1000 * 1000},
+	{"M", 1000 * 1000},
+	{"K", 1000},
+}
+
+// ParseRate parses a rate in bytes per second like 500K, 10MB or 1G/s. Units are decimal
+func ParseRate(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	value = strings.TrimSuffix(value, "/S")
+	value = strings.TrimSuffix(value, "B")
+
+	factor := int64(1)
+	for _, unit := range rateUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			factor = unit.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || n < 0 {
+		return 0, errors.New(ErrInvalidRate + " " + s)
+	}
+
+	return int64(n * float64(factor)), nil
+}
@@ -0,0 +1,283 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ChunkSize is the largest write a transfer makes before it waits for its turn again.
+// Small chunks interleave concurrent transfers so none of them starves the others
+const ChunkSize = 32 * 1024
+
+// Errors
+const ErrTooManyTransfers = "Too Many Concurrent Transfers"
+
+// Direction tells uploads (peers fetching from us) from downloads (us fetching from peers)
+type Direction int
+
+const (
+	Upload Direction = iota
+	Download
+)
+
+func (d Direction) String() string {
+	if d == Upload {
+		return "upload"
+	}
+
+	return "download"
+}
+
+// Limits configures the scheduler. Rates are in bytes per second, zero means unlimited
+type Limits struct {
+	UploadRate       int64         `json:"uploadRate"`
+	PeerUploadRate   int64         `json:"peerUploadRate"`
+	DownloadRate     int64         `json:"downloadRate"`
+	PeerDownloadRate int64         `json:"peerDownloadRate"`
+	MaxTransfers     int           `json:"maxTransfers"`
+	MaxPeerTransfers int           `json:"maxPeerTransfers"`
+	RequestTimeout   time.Duration `json:"requestTimeout"`
+	IdleTimeout      time.Duration `json:"idleTimeout"`
+}
+
+// DefaultLimits leave bandwidth unlimited but bound concurrency and slow clients
+func DefaultLimits() Limits {
+	return Limits{
+		MaxTransfers:     16,
+		MaxPeerTransfers: 4,
+		RequestTimeout:   30 * time.Second,
+		IdleTimeout:      2 * time.Minute,
+	}
+}
+
+func (l Limits) rate(dir Direction) int64 {
+	if dir == Upload {
+		return l.UploadRate
+	}
+
+	return l.DownloadRate
+}
+
+func (l Limits) peerRate(dir Direction) int64 {
+	if dir == Upload {
+		return l.PeerUploadRate
+	}
+
+	return l.PeerDownloadRate
+}
+
+// Status is a snapshot of the scheduler reported by the daemon
+type Status struct {
+	Limits        Limits           `json:"limits"`
+	Transfers     []TransferStatus `json:"transfers"`
+	BytesSent     int64            `json:"bytesSent"`
+	BytesReceived int64            `json:"bytesReceived"`
+	Rejected      int64            `json:"rejected"`
+}
+
+// TransferStatus describes a running transfer
+type TransferStatus struct {
+	Direction string    `json:"direction"`
+	Peer      string    `json:"peer"`
+	Name      string    `json:"name"`
+	Bytes     int64     `json:"bytes"`
+	Started   time.Time `json:"started"`
+}
+
+type peerKey struct {
+	dir  Direction
+	host string
+}
+
+type peer struct {
+	limiter   *rate.Limiter
+	transfers int
+}
+
+// Scheduler admits transfers and shares the configured bandwidth between them
+type Scheduler struct {
+	limits   Limits
+	mtx      sync.Mutex
+	global   [2]*rate.Limiter
+	peers    map[peerKey]*peer
+	active   map[*Transfer]bool
+	counts   [2]int
+	bytes    [2]int64
+	rejected int64
+}
+
+// NewScheduler returns a Scheduler enforcing limits
+func NewScheduler(limits Limits) *Scheduler {
+	return &Scheduler{
+		limits: limits,
+		global: [2]*rate.Limiter{
+			newLimiter(limits.rate(Upload)),
+			newLimiter(limits.rate(Download)),
+		},
+		peers:  make(map[peerKey]*peer),
+		active: make(map[*Transfer]bool),
+	}
+}
+
+// Limits returns the limits the scheduler enforces
+func (s *Scheduler) Limits() Limits {
+	return s.limits
+}
+
+// Start admits a transfer of name with the peer at host, or fails with ErrTooManyTransfers
+// when the global or the peer's number of concurrent transfers is exhausted.
+// Every started transfer must be finished
+func (s *Scheduler) Start(dir Direction, host, name string) (*Transfer, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	key := peerKey{dir: dir, host: host}
+	p, ok := s.peers[key]
+	if !ok {
+		p = &peer{limiter: newLimiter(s.limits.peerRate(dir))}
+	}
+
+	if (s.limits.MaxTransfers > 0 && s.counts[dir] >= s.limits.MaxTransfers) ||
+		(s.limits.MaxPeerTransfers > 0 && p.transfers >= s.limits.MaxPeerTransfers) {
+		s.rejected++
+		return nil, errors.New(ErrTooManyTransfers)
+	}
+
+	p.transfers++
+	s.peers[key] = p
+	s.counts[dir]++
+
+	t := &Transfer{
+		scheduler: s,
+		dir:       dir,
+		key:       key,
+		peer:      p,
+		name:      name,
+		started:   time.Now(),
+	}
+	s.active[t] = true
+
+	return t, nil
+}
+
+// Status returns a snapshot of the running transfers and counters
+func (s *Scheduler) Status() Status {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	status := Status{
+		Limits:        s.limits,
+		Transfers:     make([]TransferStatus, 0, len(s.active)),
+		BytesSent:     atomic.LoadInt64(&s.bytes[Upload]),
+		BytesReceived: atomic.LoadInt64(&s.bytes[Download]),
+		Rejected:      s.rejected,
+	}
+
+	for t := range s.active {
+		status.Transfers = append(status.Transfers, TransferStatus{
+			Direction: t.dir.String(),
+			Peer:      t.key.host,
+			Name:      t.name,
+			Bytes:     atomic.LoadInt64(&t.bytes),
+			Started:   t.started,
+		})
+	}
+
+	return status
+}
+
+func (s *Scheduler) finish(t *Transfer) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if !s.active[t] {
+		return
+	}
+
+	delete(s.active, t)
+	s.counts[t.dir]--
+	t.peer.transfers--
+	if t.peer.transfers == 0 {
+		delete(s.peers, t.key)
+	}
+}
+
+// Transfer is an admitted transfer. Its writes are paced by the global and the peer's limiter
+type Transfer struct {
+	scheduler *Scheduler
+	dir       Direction
+	key       peerKey
+	peer      *peer
+	name      string
+	started   time.Time
+	bytes     int64
+}
+
+// Writer returns a writer that paces writes to w. Waiting stops when ctx is done
+func (t *Transfer) Writer(ctx context.Context, w io.Writer) io.Writer {
+	return &writer{
+		transfer: t,
+		ctx:      ctx,
+		w:        w,
+	}
+}
+
+// Finish releases the transfer's slot
+func (t *Transfer) Finish() {
+	t.scheduler.finish(t)
+}
+
+func (t *Transfer) wait(ctx context.Context, n int) error {
+	if err := t.peer.limiter.WaitN(ctx, n); err != nil {
+		return err
+	}
+
+	return t.scheduler.global[t.dir].WaitN(ctx, n)
+}
+
+type writer struct {
+	transfer *Transfer
+	ctx      context.Context
+	w        io.Writer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > ChunkSize {
+			n = ChunkSize
+		}
+
+		if err := w.transfer.wait(w.ctx, n); err != nil {
+			return written, err
+		}
+
+		m, err := w.w.Write(p[:n])
+		written += m
+		atomic.AddInt64(&w.transfer.bytes, int64(m))
+		atomic.AddInt64(&w.transfer.scheduler.bytes[w.transfer.dir], int64(m))
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// newLimiter returns a limiter for bytesPerSecond. Bursts are one chunk so writes never exceed it
+func newLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, ChunkSize)
+	}
+
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), ChunkSize)
+}
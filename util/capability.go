@@ -0,0 +1,47 @@
+package util
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// ErrInvalidCapability is returned for malformed capability links
+var ErrInvalidCapability = errors.New("Invalid Capability Link")
+
+// Capability grants access to an encrypted share. It is the content id of the ciphertext
+// together with the key, written as <content id>#<base64url key>
+type Capability struct {
+	ID  ContentID
+	Key []byte
+}
+
+// IsCapability reports whether s is a capability link rather than a plain content id
+func IsCapability(s string) bool {
+	return strings.Contains(s, "#")
+}
+
+// ParseCapability parses a capability link
+func ParseCapability(s string) (Capability, error) {
+	i := strings.Index(s, "#")
+	if i < 0 {
+		return Capability{}, ErrInvalidCapability
+	}
+
+	id, err := ParseContentID(s[:i])
+	if err != nil {
+		return Capability{}, err
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(s[i+1:])
+	if err != nil || len(key) != EncryptionKeySize {
+		return Capability{}, ErrInvalidCapability
+	}
+
+	return Capability{ID: id, Key: key}, nil
+}
+
+// String returns the capability link
+func (c Capability) String() string {
+	return c.ID.String() + "#" + base64.RawURLEncoding.EncodeToString(c.Key)
+}
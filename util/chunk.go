@@ -0,0 +1,82 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// Content defined chunking bounds. Boundaries depend on the content only, so an edit
+// in the middle of a file leaves the chunks before and after it unchanged
+const (
+	MinChunkSize = 256 * 1024
+	AvgChunkSize = 1024 * 1024
+	MaxChunkSize = 4 * 1024 * 1024
+)
+
+// chunkMask has log2(AvgChunkSize) bits set. A boundary is cut where the rolling hash has them all cleared
+const chunkMask = AvgChunkSize - 1
+
+// gear maps every byte to a random looking value. It is derived rather than random
+// because every node has to cut the same content at the same boundaries
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		sum := sha256.Sum256([]byte{'s', 'n', 'f', 's', byte(i)})
+		table[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return table
+}()
+
+// SplitChunks reads reader to the end and calls chunk with every content defined chunk.
+// The slice passed to chunk is only valid until chunk returns
+func SplitChunks(reader io.Reader, chunk func(data []byte) error) error {
+	buf := make([]byte, MaxChunkSize)
+	filled := 0
+	eof := false
+
+	for {
+		for !eof && filled < len(buf) {
+			n, err := reader.Read(buf[filled:])
+			filled += n
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		if filled == 0 {
+			return nil
+		}
+
+		cut := chunkBoundary(buf[:filled])
+		if err := chunk(buf[:cut]); err != nil {
+			return err
+		}
+
+		filled = copy(buf, buf[cut:filled])
+	}
+}
+
+// chunkBoundary returns the length of the first chunk of data
+func chunkBoundary(data []byte) int {
+	if len(data) <= MinChunkSize {
+		return len(data)
+	}
+
+	var hash uint64
+	end := len(data)
+	if end > MaxChunkSize {
+		end = MaxChunkSize
+	}
+
+	for i := MinChunkSize; i < end; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash&chunkMask == 0 {
+			return i + 1
+		}
+	}
+
+	return end
+}
@@ -0,0 +1,108 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/zeebo/blake3"
+)
+
+// Supported content hash algorithms
+const (
+	HashSHA1   = "sha1"
+	HashSHA256 = "sha256"
+	HashBLAKE3 = "blake3"
+)
+
+// DefaultHashAlgorithm is used for new content when no algorithm is requested
+const DefaultHashAlgorithm = HashSHA256
+
+// dhtKeySize is the size of a kademlia key in bytes (160 bits)
+const dhtKeySize = 20
+
+// Errors
+var (
+	ErrUnknownHashAlgorithm = errors.New("Unknown Hash Algorithm")
+	ErrInvalidContentID     = errors.New("Invalid Content ID")
+)
+
+var digestSizes = map[string]int{
+	HashSHA1:   sha1.Size,
+	HashSHA256: sha256.Size,
+	HashBLAKE3: 32,
+}
+
+// ContentID is a self describing content hash of the form <algorithm>-<hex digest>.
+// A bare 40 character hex string is accepted as a legacy SHA-1 content id
+type ContentID struct {
+	Algorithm string
+	Digest    []byte
+}
+
+// NewHasher returns a hash.Hash for algorithm
+func NewHasher(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case HashSHA1:
+		return sha1.New(), nil
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashBLAKE3:
+		return blake3.New(), nil
+	default:
+		return nil, ErrUnknownHashAlgorithm
+	}
+}
+
+// NewContentID returns the content id of the digest computed with algorithm
+func NewContentID(algorithm string, digest []byte) (ContentID, error) {
+	size, ok := digestSizes[algorithm]
+	if !ok {
+		return ContentID{}, ErrUnknownHashAlgorithm
+	}
+
+	if len(digest) != size {
+		return ContentID{}, ErrInvalidContentID
+	}
+
+	return ContentID{Algorithm: algorithm, Digest: digest}, nil
+}
+
+// ParseContentID parses s into a ContentID
+func ParseContentID(s string) (ContentID, error) {
+	algorithm := HashSHA1
+	digest := s
+
+	if i := strings.Index(s, "-"); i >= 0 {
+		algorithm = s[:i]
+		digest = s[i+1:]
+	}
+
+	bts, err := hex.DecodeString(digest)
+	if err != nil {
+		return ContentID{}, ErrInvalidContentID
+	}
+
+	return NewContentID(strings.ToLower(algorithm), bts)
+}
+
+// String returns the self describing form of the content id
+func (c ContentID) String() string {
+	return fmt.Sprintf("%s-%x", c.Algorithm, c.Digest)
+}
+
+// Equal reports whether both ids name the same content
+func (c ContentID) Equal(other ContentID) bool {
+	return c.Algorithm == other.Algorithm && bytes.Equal(c.Digest, other.Digest)
+}
+
+// DHTKey returns the hex encoded 160 bit key the content is stored under in the DHT.
+// Legacy SHA-1 ids map to their digest so they still resolve, longer digests are truncated
+func (c ContentID) DHTKey() string {
+	return fmt.Sprintf("%x", c.Digest[:dhtKeySize])
+}
@@ -0,0 +1,204 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// EncryptionKeySize is the size of share keys in bytes (AES-256)
+const EncryptionKeySize = 32
+
+// encryptedChunkSize is the amount of plaintext sealed per chunk
+const encryptedChunkSize = 64 << 10
+
+// encryptedMagic starts every encrypted stream
+var encryptedMagic = []byte("SNFSENC1")
+
+// Errors
+var (
+	ErrInvalidKey       = errors.New("Invalid Encryption Key")
+	ErrDecryptionFailed = errors.New("Decryption Failed")
+	ErrNotEncrypted     = errors.New("Content Is Not Encrypted")
+)
+
+// NewEncryptionKey returns a random share key
+func NewEncryptionKey() ([]byte, error) {
+	key := make([]byte, EncryptionKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// The stream is the magic followed by chunks of at most encryptedChunkSize plaintext bytes,
+// each sealed with AES-GCM. The nonce is the chunk index and a flag marking the last chunk,
+// so reordered, dropped or truncated chunks fail to open.
+func chunkNonce(index uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, index)
+	if last {
+		nonce[11] = 1
+	}
+
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != EncryptionKeySize {
+		return nil, ErrInvalidKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+type encryptWriter struct {
+	writer  io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	index   uint64
+	started bool
+}
+
+// NewEncryptWriter returns a writer encrypting everything written to it with key into writer.
+// Close must be called to seal the last chunk
+func NewEncryptWriter(writer io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		writer: writer,
+		aead:   aead,
+		buf:    make([]byte, 0, encryptedChunkSize),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data arrives, since the last chunk is sealed differently
+		if len(e.buf) == encryptedChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(e.buf[len(e.buf):encryptedChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	if !e.started {
+		if _, err := e.writer.Write(encryptedMagic); err != nil {
+			return err
+		}
+		e.started = true
+	}
+
+	sealed := e.aead.Seal(nil, chunkNonce(e.index, last), e.buf, nil)
+	if _, err := e.writer.Write(sealed); err != nil {
+		return err
+	}
+
+	e.index++
+	e.buf = e.buf[:0]
+
+	return nil
+}
+
+type decryptReader struct {
+	reader  *bufio.Reader
+	aead    cipher.AEAD
+	chunk   []byte
+	plain   []byte
+	index   uint64
+	started bool
+	done    bool
+}
+
+// NewDecryptReader returns a reader decrypting the stream written by an encrypt writer with key
+func NewDecryptReader(reader io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		reader: bufio.NewReader(reader),
+		aead:   aead,
+		chunk:  make([]byte, encryptedChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	if !d.started {
+		magic := make([]byte, len(encryptedMagic))
+		if _, err := io.ReadFull(d.reader, magic); err != nil || !bytes.Equal(magic, encryptedMagic) {
+			return ErrNotEncrypted
+		}
+		d.started = true
+	}
+
+	n, err := io.ReadFull(d.reader, d.chunk)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+
+	// a short chunk, or a full one with nothing after it, is the last one
+	last := n < len(d.chunk)
+	if !last {
+		if _, err := d.reader.Peek(1); err == io.EOF {
+			last = true
+		}
+	}
+
+	plain, err := d.aead.Open(d.chunk[:0], chunkNonce(d.index, last), d.chunk[:n], nil)
+	if err != nil {
+		return ErrDecryptionFailed
+	}
+
+	d.plain = plain
+	d.index++
+	d.done = last
+
+	return nil
+}
@@ -0,0 +1,602 @@
+package util
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Extraction errors
+var (
+	ErrAbsolutePath      = errors.New("Absolute Path Not Allowed")
+	ErrPathEscape        = errors.New("Path Escapes Destination")
+	ErrLinkEscape        = errors.New("Link Target Escapes Destination")
+	ErrSymlinkTraversal  = errors.New("Path Traverses A Symlink")
+	ErrInvalidHardLink   = errors.New("Hard Link Target Is Not A Regular File")
+	ErrUnsupportedEntry  = errors.New("Unsupported Entry Type")
+	ErrDestinationNotDir = errors.New("Destination Is Not A Directory")
+)
+
+// ExtractError is returned when an archive entry can not be extracted.
+// Err is one of the extraction errors above or the underlying os error
+type ExtractError struct {
+	Name string
+	Err  error
+}
+
+func (e *ExtractError) Error() string {
+	return fmt.Sprintf("extract %s: %s", e.Name, e.Err)
+}
+
+func (e *ExtractError) Unwrap() error {
+	return e.Err
+}
+
+// ConflictPolicy decides what happens when an entry already exists in the destination
+type ConflictPolicy int
+
+// Conflict policies
+const (
+	// ConflictOverwrite replaces existing files
+	ConflictOverwrite ConflictPolicy = iota
+	// ConflictSkip keeps existing files and drops the archive's entry
+	ConflictSkip
+	// ConflictRename writes the archive's entry next to the existing file as "name (n).ext"
+	ConflictRename
+)
+
+// Extract actions
+const (
+	ActionCreate    = "create"
+	ActionOverwrite = "overwrite"
+	ActionSkip      = "skip"
+	ActionRename    = "rename"
+)
+
+// ExtractAction reports what the Extractor does with a single entry.
+// Path is where the entry is (or would be) written
+type ExtractAction struct {
+	Name   string
+	Path   string
+	Action string
+}
+
+// ExtractOption configures an Extractor
+type ExtractOption func(e *Extractor)
+
+// OnConflict sets the policy for entries that already exist. The default is ConflictOverwrite
+func OnConflict(policy ConflictPolicy) ExtractOption {
+	return func(e *Extractor) {
+		e.policy = policy
+	}
+}
+
+// DryRun validates the archive and reports what would be written without touching the destination
+func DryRun() ExtractOption {
+	return func(e *Extractor) {
+		e.dryRun = true
+	}
+}
+
+// OnAction calls report for every entry that is created, overwritten, skipped or renamed
+func OnAction(report func(ExtractAction)) ExtractOption {
+	return func(e *Extractor) {
+		e.report = report
+	}
+}
+
+// maxLinkHops bounds the symlinks followed while resolving a link target
+const maxLinkHops = 40
+
+// Extractor unpacks tar archives into a destination directory.
+// All writes are confined to the destination: absolute names, names containing
+// ".." that leave the destination, links resolving outside of it (also through other
+// links) and entries that would be written through a symlink are rejected with an *ExtractError
+type Extractor struct {
+	dest    string
+	dirs    []*tar.Header
+	links   []extractedLink
+	policy  ConflictPolicy
+	dryRun  bool
+	report  func(ExtractAction)
+	renamed map[string]string
+}
+
+// NewExtractor returns an Extractor that writes into dest
+func NewExtractor(dest string, opts ...ExtractOption) *Extractor {
+	e := &Extractor{
+		dest:    filepath.Clean(dest),
+		policy:  ConflictOverwrite,
+		renamed: make(map[string]string),
+	}
+
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	return e
+}
+
+// Extract reads the tar stream from reader and writes its entries into the destination.
+// Permissions and modification times are restored once all entries are written
+func (e *Extractor) Extract(reader io.Reader) error {
+	if err := e.prepareDest(); err != nil {
+		return err
+	}
+
+	e.dirs = e.dirs[:0]
+	e.links = e.links[:0]
+	tr := tar.NewReader(reader)
+
+	for {
+		header, err := tr.Next()
+
+		switch {
+		case err == io.EOF:
+			if err := e.checkLinks(); err != nil {
+				return err
+			}
+
+			return e.finalizeDirs()
+
+		case err != nil:
+			return err
+
+		case header == nil:
+			continue
+
+		}
+
+		if err := e.extractEntry(tr, header); err != nil {
+			if _, ok := err.(*ExtractError); ok {
+				return err
+			}
+
+			return &ExtractError{Name: header.Name, Err: err}
+		}
+	}
+}
+
+func (e *Extractor) prepareDest() error {
+	if !e.dryRun {
+		if err := os.MkdirAll(e.dest, 0755); err != nil {
+			return err
+		}
+	}
+
+	info, err := os.Lstat(e.dest)
+	if e.dryRun && os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return &ExtractError{Name: e.dest, Err: ErrDestinationNotDir}
+	}
+
+	return nil
+}
+
+func (e *Extractor) extractEntry(tr *tar.Reader, header *tar.Header) error {
+	switch header.Typeflag {
+	case tar.TypeXGlobalHeader:
+		return nil
+
+	case tar.TypeDir:
+		return e.extractDir(header)
+
+	case tar.TypeReg:
+		return e.extractFile(tr, header)
+
+	case tar.TypeSymlink:
+		return e.extractSymlink(header)
+
+	case tar.TypeLink:
+		return e.extractHardLink(header)
+
+	default:
+		return ErrUnsupportedEntry
+	}
+}
+
+func (e *Extractor) extractDir(header *tar.Header) error {
+	target, err := e.resolve(header.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := e.prepareParent(target); err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(target)
+	switch {
+	case os.IsNotExist(err):
+		e.notify(header.Name, target, ActionCreate)
+		if e.dryRun {
+			return nil
+		}
+
+		if err := os.Mkdir(target, 0755); err != nil {
+			return err
+		}
+
+	case err != nil:
+		return err
+
+	case info.Mode()&os.ModeSymlink != 0:
+		return ErrSymlinkTraversal
+
+	case !info.IsDir():
+		return ErrDestinationNotDir
+
+	case e.policy != ConflictOverwrite:
+		// existing directories are merged into but left as they are
+		return nil
+
+	}
+
+	e.dirs = append(e.dirs, header)
+
+	return nil
+}
+
+func (e *Extractor) extractFile(tr *tar.Reader, header *tar.Header) error {
+	target, err := e.resolve(header.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := e.prepareParent(target); err != nil {
+		return err
+	}
+
+	target, ok, err := e.place(header.Name, target)
+	if err != nil || !ok || e.dryRun {
+		return err
+	}
+
+	mode := header.FileInfo().Mode().Perm()
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, tr); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(target, mode); err != nil {
+		return err
+	}
+
+	return os.Chtimes(target, accessTime(header), header.ModTime)
+}
+
+func (e *Extractor) extractSymlink(header *tar.Header) error {
+	target, err := e.resolve(header.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := e.checkLinkTarget(target, header.Linkname); err != nil {
+		return err
+	}
+
+	if err := e.prepareParent(target); err != nil {
+		return err
+	}
+
+	target, ok, err := e.place(header.Name, target)
+	if err != nil || !ok || e.dryRun {
+		return err
+	}
+
+	if err := os.Symlink(header.Linkname, target); err != nil {
+		return err
+	}
+
+	e.links = append(e.links, extractedLink{name: header.Name, path: target, target: header.Linkname})
+
+	return nil
+}
+
+// extractedLink is a symlink written by the current extraction
+type extractedLink struct {
+	name   string
+	path   string
+	target string
+}
+
+// checkLinkTarget resolves the target of a symlink at link the way the filesystem would,
+// following the symlinks already in the destination, and fails if it leaves the destination
+// at any step. Missing entries are resolved lexically
+func (e *Extractor) checkLinkTarget(link, target string) error {
+	if path.IsAbs(target) || filepath.IsAbs(target) {
+		return ErrLinkEscape
+	}
+
+	rel, err := filepath.Rel(e.dest, filepath.Dir(link))
+	if err != nil {
+		return err
+	}
+
+	pending := append(strings.Split(filepath.ToSlash(rel), "/"), strings.Split(target, "/")...)
+	resolved := make([]string, 0, len(pending))
+	hops := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+
+		switch part {
+		case "", ".":
+			continue
+
+		case "..":
+			if len(resolved) == 0 {
+				return ErrLinkEscape
+			}
+
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		resolved = append(resolved, part)
+		current := filepath.Join(e.dest, filepath.FromSlash(path.Join(resolved...)))
+		info, err := os.Lstat(current)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		if hops++; hops > maxLinkHops {
+			return ErrLinkEscape
+		}
+
+		next, err := os.Readlink(current)
+		if err != nil {
+			return err
+		}
+
+		// the link's target replaces it and is relative to the directory containing it
+		if path.IsAbs(next) || filepath.IsAbs(next) {
+			return ErrLinkEscape
+		}
+
+		resolved = resolved[:len(resolved)-1]
+		pending = append(strings.Split(filepath.ToSlash(next), "/"), pending...)
+	}
+
+	return nil
+}
+
+// checkLinks checks the symlinks of this extraction again once every entry is written.
+// A link that was confined when it was written can escape through a symlink written after it.
+// Escaping links are removed
+func (e *Extractor) checkLinks() error {
+	for _, link := range e.links {
+		if err := e.checkLinkTarget(link.path, link.target); err != nil {
+			os.Remove(link.path)
+			return &ExtractError{Name: link.name, Err: ErrLinkEscape}
+		}
+	}
+
+	return nil
+}
+
+func (e *Extractor) extractHardLink(header *tar.Header) error {
+	target, err := e.resolve(header.Name)
+	if err != nil {
+		return err
+	}
+
+	// hard link targets are relative to the archive root
+	source, err := e.resolve(header.Linkname)
+	if err != nil {
+		return ErrLinkEscape
+	}
+
+	if renamed, ok := e.renamed[source]; ok {
+		source = renamed
+	}
+
+	if err := e.checkParents(source); err != nil {
+		return err
+	}
+
+	if !e.dryRun {
+		info, err := os.Lstat(source)
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return ErrInvalidHardLink
+		}
+	}
+
+	if err := e.prepareParent(target); err != nil {
+		return err
+	}
+
+	target, ok, err := e.place(header.Name, target)
+	if err != nil || !ok || e.dryRun {
+		return err
+	}
+
+	return os.Link(source, target)
+}
+
+// resolve maps an archive name onto a path within the destination
+func (e *Extractor) resolve(name string) (string, error) {
+	name = filepath.FromSlash(name)
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" || strings.HasPrefix(name, string(filepath.Separator)) {
+		return "", ErrAbsolutePath
+	}
+
+	clean := filepath.Clean(name)
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", ErrPathEscape
+	}
+
+	return filepath.Join(e.dest, clean), nil
+}
+
+// prepareParent creates the parent directories of target making sure
+// none of the existing ones is a symlink
+func (e *Extractor) prepareParent(target string) error {
+	if err := e.checkParents(target); err != nil {
+		return err
+	}
+
+	if e.dryRun {
+		return nil
+	}
+
+	return os.MkdirAll(filepath.Dir(target), 0755)
+}
+
+// place applies the conflict policy to a non directory entry about to be written at target.
+// It returns where to write the entry, or false if the entry is skipped
+func (e *Extractor) place(name, target string) (string, bool, error) {
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		e.notify(name, target, ActionCreate)
+		return target, true, nil
+	}
+
+	if err != nil {
+		return "", false, err
+	}
+
+	switch e.policy {
+	case ConflictSkip:
+		e.notify(name, target, ActionSkip)
+		return "", false, nil
+
+	case ConflictRename:
+		renamed, err := freeName(target)
+		if err != nil {
+			return "", false, err
+		}
+
+		e.renamed[target] = renamed
+		e.notify(name, renamed, ActionRename)
+		return renamed, true, nil
+
+	}
+
+	if info.IsDir() {
+		return "", false, fmt.Errorf("%s is a directory", target)
+	}
+
+	e.notify(name, target, ActionOverwrite)
+	if e.dryRun {
+		return target, true, nil
+	}
+
+	// remove the existing entry so new files never follow an existing symlink
+	return target, true, os.Remove(target)
+}
+
+func (e *Extractor) notify(name, target, action string) {
+	if e.report != nil {
+		e.report(ExtractAction{Name: name, Path: target, Action: action})
+	}
+}
+
+// checkParents walks the directories between the destination and target
+// and fails if one of them is a symlink
+func (e *Extractor) checkParents(target string) error {
+	rel, err := filepath.Rel(e.dest, filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+
+	// target is the destination itself or sits right inside of it
+	if rel == "." || rel == ".." {
+		return nil
+	}
+
+	current := e.dest
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return ErrSymlinkTraversal
+		}
+	}
+
+	return nil
+}
+
+// finalizeDirs applies directory permissions and modification times in reverse archive order,
+// so children are done before their parent and don't bump its mtime again
+func (e *Extractor) finalizeDirs() error {
+	if e.dryRun {
+		return nil
+	}
+
+	for i := len(e.dirs) - 1; i >= 0; i-- {
+		header := e.dirs[i]
+		target, err := e.resolve(header.Name)
+		if err != nil {
+			return err
+		}
+
+		if err := os.Chmod(target, header.FileInfo().Mode().Perm()); err != nil {
+			return &ExtractError{Name: header.Name, Err: err}
+		}
+
+		if err := os.Chtimes(target, accessTime(header), header.ModTime); err != nil {
+			return &ExtractError{Name: header.Name, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// freeName returns the first "name (n).ext" next to target that does not exist yet
+func freeName(target string) (string, error) {
+	dir, base := filepath.Split(target)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+
+	for i := 1; ; i++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", stem, i, ext))
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
+
+func accessTime(header *tar.Header) time.Time {
+	if header.AccessTime.IsZero() {
+		return header.ModTime
+	}
+
+	return header.AccessTime
+}
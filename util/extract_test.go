@@ -0,0 +1,210 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// entry is an archive entry. Files have content, links a target
+type entry struct {
+	name    string
+	kind    byte
+	content string
+	link    string
+}
+
+func dir(name string) entry {
+	return entry{name: name, kind: tar.TypeDir}
+}
+
+func file(name, content string) entry {
+	return entry{name: name, kind: tar.TypeReg, content: content}
+}
+
+func symlink(name, target string) entry {
+	return entry{name: name, kind: tar.TypeSymlink, link: target}
+}
+
+func hardlink(name, target string) entry {
+	return entry{name: name, kind: tar.TypeLink, link: target}
+}
+
+func archive(t *testing.T, entries ...entry) *bytes.Buffer {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Typeflag: e.kind, Linkname: e.link, Mode: 0644, Size: int64(len(e.content))}
+		if e.kind == tar.TypeDir {
+			header.Mode = 0755
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf
+}
+
+// sandbox returns a destination inside an otherwise empty directory, so anything
+// written next to the destination shows up in the outside listing
+func sandbox(t *testing.T) (string, string) {
+	t.Helper()
+
+	outside := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(outside, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return outside, filepath.Join(outside, "dest")
+}
+
+func assertOutsideUntouched(t *testing.T, outside string) {
+	t.Helper()
+
+	names, err := ioutil.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, info := range names {
+		if info.Name() != "secret" && info.Name() != "etc" && info.Name() != "dest" {
+			t.Errorf("%s was written outside of the destination", info.Name())
+		}
+	}
+
+	if etc, _ := ioutil.ReadDir(filepath.Join(outside, "etc")); len(etc) != 0 {
+		t.Errorf("%d entries were written to a directory outside of the destination", len(etc))
+	}
+
+	if secret, _ := ioutil.ReadFile(filepath.Join(outside, "secret")); string(secret) != "secret" {
+		t.Error("a file outside of the destination was changed")
+	}
+}
+
+func TestExtractRejectsMaliciousArchives(t *testing.T) {
+	cases := []struct {
+		name    string
+		entries []entry
+		err     error
+	}{
+		{"absolute path", []entry{file("/secret", "x")}, ErrAbsolutePath},
+		{"parent path", []entry{file("../secret", "x")}, ErrPathEscape},
+		{"nested parent path", []entry{dir("a/"), file("a/../../secret", "x")}, ErrPathEscape},
+		{"absolute symlink", []entry{symlink("l", "/etc")}, ErrLinkEscape},
+		{"parent symlink", []entry{symlink("l", "../etc")}, ErrLinkEscape},
+		{"nested parent symlink", []entry{dir("a/"), symlink("a/l", "../../etc")}, ErrLinkEscape},
+		{"symlink chain", []entry{dir("a/"), symlink("a/s", ".."), symlink("l", "a/s/../../etc")}, ErrLinkEscape},
+		{"symlink chain through a link to a link", []entry{dir("a/"), symlink("a/s", ".."), symlink("t", "a/s"), symlink("l", "t/../etc")}, ErrLinkEscape},
+		{"symlink chain written out of order", []entry{dir("a/"), symlink("l", "a/s/../../etc"), symlink("a/s", "..")}, ErrLinkEscape},
+		{"symlink loop", []entry{symlink("a", "b"), symlink("b", "a"), symlink("l", "a/x")}, ErrLinkEscape},
+		{"write through symlink", []entry{dir("a/"), symlink("s", "a"), file("s/x", "x")}, ErrSymlinkTraversal},
+		{"write through escaping symlink", []entry{symlink("s", "."), file("s/x", "x")}, ErrSymlinkTraversal},
+		{"hard link outside", []entry{hardlink("h", "../secret")}, ErrLinkEscape},
+		{"absolute hard link", []entry{hardlink("h", "/secret")}, ErrLinkEscape},
+		{"hard link to symlink", []entry{symlink("s", "x"), hardlink("h", "s")}, ErrInvalidHardLink},
+		{"hard link to directory", []entry{dir("a/"), hardlink("h", "a")}, ErrInvalidHardLink},
+		{"hard link through symlink", []entry{dir("a/"), file("a/f", "x"), symlink("s", "a"), hardlink("h", "s/f")}, ErrSymlinkTraversal},
+		{"unsupported entry", []entry{{name: "fifo", kind: tar.TypeFifo}}, ErrUnsupportedEntry},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			outside, dest := sandbox(t)
+
+			err := NewExtractor(dest).Extract(archive(t, c.entries...))
+			if !errors.Is(err, c.err) {
+				t.Fatalf("err = %v, want %v", err, c.err)
+			}
+
+			var extractErr *ExtractError
+			if !errors.As(err, &extractErr) {
+				t.Errorf("err is a %T, want *ExtractError", err)
+			}
+
+			assertOutsideUntouched(t, outside)
+		})
+	}
+}
+
+func TestExtractRemovesLinksEscapingThroughLaterLinks(t *testing.T) {
+	_, dest := sandbox(t)
+
+	err := NewExtractor(dest).Extract(archive(t, dir("a/"), symlink("l", "a/s/../../etc"), symlink("a/s", "..")))
+	if !errors.Is(err, ErrLinkEscape) {
+		t.Fatalf("err = %v, want %v", err, ErrLinkEscape)
+	}
+
+	if _, err := os.Lstat(filepath.Join(dest, "l")); !os.IsNotExist(err) {
+		t.Error("the escaping link was left in the destination")
+	}
+}
+
+func TestExtractConfinedLinks(t *testing.T) {
+	outside, dest := sandbox(t)
+
+	err := NewExtractor(dest).Extract(archive(t,
+		dir("lib/"),
+		dir("lib/v1/"),
+		file("lib/v1/lib.so", "lib"),
+		symlink("lib/current", "v1"),
+		symlink("lib/lib.so", "current/lib.so"),
+		dir("bin/"),
+		symlink("bin/lib.so", "../lib/current/../v1/lib.so"),
+		symlink("bin/dangling", "../missing/file"),
+		hardlink("bin/copy.so", "lib/v1/lib.so"),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"lib/lib.so", "bin/lib.so", "bin/copy.so"} {
+		content, err := ioutil.ReadFile(filepath.Join(dest, name))
+		if err != nil || string(content) != "lib" {
+			t.Errorf("%s = %q, %v", name, content, err)
+		}
+	}
+
+	assertOutsideUntouched(t, outside)
+}
+
+func TestExtractDryRunWritesNothing(t *testing.T) {
+	outside, dest := sandbox(t)
+
+	actions := make([]ExtractAction, 0)
+	err := NewExtractor(dest, DryRun(), OnAction(func(a ExtractAction) {
+		actions = append(actions, a)
+	})).Extract(archive(t, dir("a/"), file("a/f", "x"), symlink("l", "a/f")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(actions) != 3 {
+		t.Errorf("actions = %+v", actions)
+	}
+
+	if _, err := os.Lstat(dest); !os.IsNotExist(err) {
+		t.Error("dry run created the destination")
+	}
+
+	assertOutsideUntouched(t, outside)
+}
@@ -0,0 +1,187 @@
+package util
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// IgnoreFileName is the name of the file in the root of a share context
+// that lists paths to leave out of the share. The syntax is the one of .gitignore
+const IgnoreFileName = ".snfsignore"
+
+// IgnoreRules decides which paths of a share context are left out of the archive.
+// Like in .gitignore the last matching pattern wins and a "!" pattern re-includes a path
+type IgnoreRules struct {
+	rules    []string
+	patterns []ignorePattern
+}
+
+type ignorePattern struct {
+	negate  bool
+	dirOnly bool
+	expr    *regexp.Regexp
+}
+
+// NewIgnoreRules compiles the gitignore style patterns in rules.
+// Blank lines and comments are dropped
+func NewIgnoreRules(rules []string) (*IgnoreRules, error) {
+	ir := &IgnoreRules{
+		rules:    make([]string, 0, len(rules)),
+		patterns: make([]ignorePattern, 0, len(rules)),
+	}
+
+	for _, rule := range rules {
+		pattern, ok, err := compileIgnorePattern(rule)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		ir.rules = append(ir.rules, strings.TrimSpace(rule))
+		ir.patterns = append(ir.patterns, pattern)
+	}
+
+	return ir, nil
+}
+
+// ReadIgnoreFile returns the lines of the ignore file at path.
+// A missing file, or a parent that is not a directory, yields no lines
+func ReadIgnoreFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	return lines, scanner.Err()
+}
+
+// Rules returns the effective patterns in the order they are applied
+func (ir *IgnoreRules) Rules() []string {
+	return ir.rules
+}
+
+// Match reports whether name, a slash separated path relative to the share base, is ignored
+func (ir *IgnoreRules) Match(name string, isDir bool) bool {
+	ignored := false
+	for _, p := range ir.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+
+		if p.expr.MatchString(name) {
+			ignored = !p.negate
+		}
+	}
+
+	return ignored
+}
+
+func compileIgnorePattern(rule string) (ignorePattern, bool, error) {
+	var p ignorePattern
+
+	rule = strings.TrimRight(rule, " \t\r")
+	if rule == "" || strings.HasPrefix(rule, "#") {
+		return p, false, nil
+	}
+
+	if strings.HasPrefix(rule, "!") {
+		p.negate = true
+		rule = rule[1:]
+	} else if strings.HasPrefix(rule, `\!`) || strings.HasPrefix(rule, `\#`) {
+		rule = rule[1:]
+	}
+
+	if strings.HasSuffix(rule, "/") {
+		p.dirOnly = true
+		rule = strings.TrimRight(rule, "/")
+	}
+
+	// a slash anywhere but at the end anchors the pattern at the share base
+	anchored := strings.Contains(rule, "/")
+	rule = strings.TrimPrefix(rule, "/")
+	if rule == "" {
+		return p, false, nil
+	}
+
+	expr := globToRegexp(rule)
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "^(.*/)?" + expr + "$"
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return p, false, err
+	}
+
+	p.expr = re
+
+	return p, true, nil
+}
+
+func globToRegexp(glob string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+
+		case c == '*':
+			b.WriteString("[^/]*")
+
+		case c == '?':
+			b.WriteString("[^/]")
+
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			b.WriteString("[" + class + "]")
+			i += end + 1
+
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return b.String()
+}
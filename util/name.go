@@ -0,0 +1,72 @@
+package util
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// ErrInvalidName is returned for malformed names
+var ErrInvalidName = errors.New("Invalid Name, Expected <label>@<publisher>")
+
+// ErrInvalidLabel is returned for labels that can't be published
+var ErrInvalidLabel = errors.New("Labels Are 1 To 64 Letters, Digits, '.', '_' Or '-'")
+
+// MaxLabelLength bounds the length of the label of a name
+const MaxLabelLength = 64
+
+// PublisherIDSize is the size of a publisher id in bytes
+const PublisherIDSize = 16
+
+// Name is a mutable pointer to content, written as <label>@<publisher>.
+// The publisher is the hex id of the key that signs the name's records
+type Name struct {
+	Label     string
+	Publisher string
+}
+
+// IsName reports whether s is a name rather than a content id or capability link
+func IsName(s string) bool {
+	return strings.Contains(s, "@") && !IsCapability(s)
+}
+
+// ParseName parses a name
+func ParseName(s string) (Name, error) {
+	i := strings.LastIndex(s, "@")
+	if i < 0 {
+		return Name{}, ErrInvalidName
+	}
+
+	name := Name{Label: s[:i], Publisher: strings.ToLower(s[i+1:])}
+	if err := ValidateLabel(name.Label); err != nil {
+		return Name{}, err
+	}
+
+	if id, err := hex.DecodeString(name.Publisher); err != nil || len(id) != PublisherIDSize {
+		return Name{}, ErrInvalidName
+	}
+
+	return name, nil
+}
+
+// ValidateLabel checks that label can be published
+func ValidateLabel(label string) error {
+	if label == "" || len(label) > MaxLabelLength {
+		return ErrInvalidLabel
+	}
+
+	for _, c := range label {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			return ErrInvalidLabel
+		}
+	}
+
+	return nil
+}
+
+// String returns the name as <label>@<publisher>
+func (n Name) String() string {
+	return n.Label + "@" + n.Publisher
+}
@@ -0,0 +1,212 @@
+package util
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TarballOption configures how WriteTarball builds the archive
+type TarballOption func(c *tarballConfig)
+
+type tarballConfig struct {
+	canonical bool
+	modTime   *time.Time
+	ignore    *IgnoreRules
+}
+
+// Canonical produces byte for byte identical archives for identical content.
+// Entries are named relative to the share base, ownership is zeroed, access and change
+// times are dropped and permissions are normalized to 0755/0644
+func Canonical() TarballOption {
+	return func(c *tarballConfig) {
+		c.canonical = true
+	}
+}
+
+// FixedModTime stamps every entry with t instead of the file's modification time
+func FixedModTime(t time.Time) TarballOption {
+	return func(c *tarballConfig) {
+		c.modTime = &t
+	}
+}
+
+// Ignore leaves out every path matched by rules. Ignored directories are not descended into
+func Ignore(rules *IgnoreRules) TarballOption {
+	return func(c *tarballConfig) {
+		c.ignore = rules
+	}
+}
+
+// WriteTarball walks the filepath starting at dir and writes the tarball into writer.
+// Entries are written in lexical order. It returns the number of uncompressed content bytes written
+func WriteTarball(writer io.Writer, dir string, opts ...TarballOption) (int64, error) {
+	var config tarballConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	tw := tar.NewWriter(writer)
+
+	defer tw.Close()
+
+	base, err := tarballBase(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	// walk path
+	var bytesWritten int64
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if config.ignored(path, info, base) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		header, err := tarHeader(path, info, base, &config)
+		if err != nil || header == nil {
+			return err
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+
+		n, err := io.Copy(tw, f)
+		bytesWritten += n
+
+		return err
+	})
+
+	return bytesWritten, err
+}
+
+// tarballBase returns the directory entry names are relative to in canonical mode.
+// Sharing a directory roots the archive at that directory, sharing a single file
+// roots it at the file's parent
+func tarballBase(dir string) (string, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+
+	if info.IsDir() {
+		return dir, nil
+	}
+
+	return filepath.Dir(dir), nil
+}
+
+// ignored reports whether path is matched by the ignore rules. The share base itself is never ignored
+func (c *tarballConfig) ignored(path string, info os.FileInfo, base string) bool {
+	if c.ignore == nil {
+		return false
+	}
+
+	name, err := filepath.Rel(base, path)
+	if err != nil || name == "." {
+		return false
+	}
+
+	return c.ignore.Match(filepath.ToSlash(name), info.IsDir())
+}
+
+// tarHeader builds the header for path. A nil header means the entry is skipped
+func tarHeader(path string, info os.FileInfo, base string, config *tarballConfig) (*tar.Header, error) {
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+
+		link = target
+	}
+
+	if !config.canonical {
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return nil, err
+		}
+
+		header.Name = path
+		if config.modTime != nil {
+			header.ModTime = *config.modTime
+		}
+
+		return header, nil
+	}
+
+	name, err := filepath.Rel(base, path)
+	if err != nil {
+		return nil, err
+	}
+
+	// the share base itself is the extraction target
+	if name == "." {
+		return nil, nil
+	}
+
+	header := &tar.Header{
+		Name:    filepath.ToSlash(name),
+		ModTime: info.ModTime().Truncate(time.Second),
+		Format:  tar.FormatPAX,
+	}
+
+	if config.modTime != nil {
+		header.ModTime = config.modTime.Truncate(time.Second)
+	}
+
+	mode := info.Mode()
+	switch {
+	case mode.IsDir():
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+		header.Mode = 0755
+
+	case mode.IsRegular():
+		header.Typeflag = tar.TypeReg
+		header.Size = info.Size()
+		header.Mode = 0644
+		if mode.Perm()&0111 != 0 {
+			header.Mode = 0755
+		}
+
+	case mode&os.ModeSymlink != 0:
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = filepath.ToSlash(link)
+		header.Mode = 0777
+
+	default:
+		// devices, sockets and pipes are not shareable content
+		return nil, nil
+	}
+
+	return header, nil
+}
+
+// ReadTarball reads from reader and creates the resulting directory at target.
+// Entries that would be written outside of target are rejected (see Extractor)
+func ReadTarball(reader io.Reader, target string, opts ...ExtractOption) error {
+	return NewExtractor(target, opts...).Extract(reader)
+}